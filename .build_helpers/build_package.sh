@@ -53,12 +53,13 @@ function build_package() {
         mkdir -p "$pkgDir"
         mkdir -p "$pkgDir/usr/bin"
         mkdir -p "$pkgDir/lib/systemd/system"
-        mkdir -p "$pkgDir/etc/apparmor.d"
+        mkdir -p "$pkgDir/etc/apparmor.d/apthl.d"
         mkdir -p "$pkgDir/usr/share/bash-completion/completions"
 
         mv "$outputEXE" "$pkgDir/usr/bin/"
         cp "$repoRoot/packaging/apthl.service" "$pkgDir/lib/systemd/system/"
         cp "$repoRoot/packaging/usr.bin.apthl" "$pkgDir/etc/apparmor.d/"
+        cp "$repoRoot/packaging/apthl-restart-check" "$pkgDir/etc/apparmor.d/apthl.d/restart-check"
         cp "$repoRoot/packaging/apthl_bash_completion" "$pkgDir/usr/share/bash-completion/completions/apthl"
         cp -r "$repoRoot/packaging/DEBIAN" "$pkgDir/"
         cp "$repoRoot/LICENSE.md" "$pkgDir/DEBIAN/copyright"
@@ -69,7 +70,7 @@ function build_package() {
         chmod 755 "$pkgDir"/DEBIAN/{postrm,postinst,preinst,prerm}
         chmod 644 "$pkgDir"/lib/systemd/system/*
         chmod 755 "$pkgDir"/usr/bin/*
-        chmod 644 "$pkgDir"/etc/apparmor.d/*
+        chmod 644 "$pkgDir"/etc/apparmor.d/usr.bin.apthl "$pkgDir"/etc/apparmor.d/apthl.d/*
         chmod 644 "$pkgDir/usr/share/bash-completion/completions/apthl"
 
         # Move into build dir
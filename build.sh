@@ -97,7 +97,7 @@ function compile_program() {
 
 	# Run tests
 	echo "[*] Running all tests..."
-	go test
+	go test ./...
 	echo -e "   ${GREEN}[+] DONE${RESET}"
 
 	echo "[*] Compiling program binary..."
@@ -0,0 +1,452 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Alert rules evaluated by the daemon and the sinks alerts are sent to
+type AlertConfig struct {
+	Rules []AlertRuleConfig `json:"rules"`
+	Sinks []AlertSinkConfig `json:"sinks"`
+}
+
+type AlertRuleConfig struct {
+	Name        string `json:"name"`
+	Query       string `json:"query"`    // Search query language expression
+	Severity    string `json:"severity"` // info, warning or critical [default: warning]
+	Description string `json:"description"`
+}
+
+type AlertSinkConfig struct {
+	Type        string            `json:"type"`         // exec, webhook or syslog
+	MinSeverity string            `json:"min_severity"` // Only send alerts at or above this severity [default: info]
+	Timeout     string            `json:"timeout"`      // Go duration for exec and webhook sinks [default: 10s]
+	Command     []string          `json:"command"`      // exec: program and arguments
+	URL         string            `json:"url"`          // webhook: endpoint receiving a POST per alert
+	Headers     map[string]string `json:"headers"`      // webhook: extra request headers
+	Network     string            `json:"network"`      // syslog: udp, tcp or empty for the local syslog daemon
+	Address     string            `json:"address"`      // syslog: host:port of a remote syslog server
+	Facility    string            `json:"facility"`     // syslog: facility name [default: daemon]
+	Tag         string            `json:"tag"`          // syslog: program tag [default: apthl]
+}
+
+// Alert severities from lowest to highest
+var alertSeverities = []string{"info", "warning", "critical"}
+
+const defaultAlertTimeout = 10 * time.Second
+
+// Alerts waiting for delivery, further alerts are dropped while the sinks are this far behind
+const alertQueueSize = 256
+
+// Time the daemon keeps delivering waiting alerts once it is stopping, the rest are dropped
+const alertDrainTimeout = 15 * time.Second
+
+// Largest syslog message every receiver must accept (RFC 5426), bigger alerts are sent without the event
+const syslogMaxMessageSize = 2048
+
+// Single alert for one rule an event matched
+type alertRecord struct {
+	Rule        string          `json:"rule"`
+	Severity    string          `json:"severity"`
+	Description string          `json:"description,omitempty"`
+	Hostname    string          `json:"hostname"`
+	EventID     string          `json:"event_id"`
+	Event       json.RawMessage `json:"event,omitempty"` // Only the packages that satisfied the rule, in the daemon schema version
+	Omitted     bool            `json:"event_omitted,omitempty"`
+}
+
+type alertRule struct {
+	name        string
+	severity    string
+	description string
+	matcher     apthistory.Matcher
+}
+
+// Delivers alerts to an external system
+type alertSink interface {
+	send(ctx context.Context, alert alertRecord, payload []byte) (err error)
+}
+
+type configuredSink struct {
+	kind        string
+	minSeverity int
+	sink        alertSink
+}
+
+// Evaluates alert rules against events and sends matches to the alert sinks
+type alerter struct {
+	rules         []alertRule
+	sinks         []configuredSink
+	schemaVersion int
+	hostname      string
+	queue         chan alertRecord // Alerts for the background sender, nil sends them directly
+	running       *sync.WaitGroup  // Held by each queued alert so shutdown waits for its delivery
+	drainTimeout  time.Duration    // Time left for queued alerts once the daemon is stopping
+}
+
+func newAlerter(config AlertConfig, schemaVersion int, host hostInfo) (alerts *alerter, err error) {
+	alerts = &alerter{schemaVersion: schemaVersion, hostname: host.hostname, drainTimeout: alertDrainTimeout}
+
+	var ruleNames []string
+	for index, ruleConfig := range config.Rules {
+		if ruleConfig.Name == "" {
+			err = fmt.Errorf("rule %d: missing name", index+1)
+			return
+		}
+		if slices.Contains(ruleNames, ruleConfig.Name) {
+			err = fmt.Errorf("rule %s: name is used by another rule", ruleConfig.Name)
+			return
+		}
+		ruleNames = append(ruleNames, ruleConfig.Name)
+
+		if ruleConfig.Severity == "" {
+			ruleConfig.Severity = "warning"
+		}
+		if !slices.Contains(alertSeverities, ruleConfig.Severity) {
+			err = fmt.Errorf("rule %s: unknown severity '%s': must be one of %s", ruleConfig.Name, ruleConfig.Severity, strings.Join(alertSeverities, ", "))
+			return
+		}
+
+		if ruleConfig.Query == "" {
+			err = fmt.Errorf("rule %s: missing query", ruleConfig.Name)
+			return
+		}
+		var root apthistory.Node
+		root, err = apthistory.CompileQuery(ruleConfig.Query, time.Local)
+		if err != nil {
+			err = fmt.Errorf("rule %s: %v", ruleConfig.Name, err)
+			return
+		}
+
+		alerts.rules = append(alerts.rules, alertRule{
+			name:        ruleConfig.Name,
+			severity:    ruleConfig.Severity,
+			description: ruleConfig.Description,
+			matcher:     apthistory.Matcher{Root: root},
+		})
+	}
+
+	for index, sinkConfig := range config.Sinks {
+		var sink configuredSink
+		sink, err = newAlertSink(sinkConfig)
+		if err != nil {
+			err = fmt.Errorf("sink %d: %v", index+1, err)
+			return
+		}
+		alerts.sinks = append(alerts.sinks, sink)
+	}
+
+	if len(alerts.rules) > 0 && len(alerts.sinks) == 0 {
+		printMessage(verbosityStandard, "Warning: alert rules are configured without any alert sinks, matching events are only tagged\n")
+	}
+	return
+}
+
+// Tags the event with the names of all rules it matches and returns an alert for each of them
+func (alerts *alerter) evaluate(log *LogJSON) (matchedAlerts []alertRecord, err error) {
+	var matchedEvents []LogJSON
+	var matchedRules []alertRule
+	for _, rule := range alerts.rules {
+		var matched bool
+		var result LogJSON
+		matched, result, err = rule.matcher.Match(*log)
+		if err != nil {
+			err = fmt.Errorf("rule %s: %v", rule.name, err)
+			return
+		}
+		if !matched {
+			continue
+		}
+
+		log.Tags = append(log.Tags, rule.name)
+		matchedEvents = append(matchedEvents, result)
+		matchedRules = append(matchedRules, rule)
+	}
+
+	for index, rule := range matchedRules {
+		matchedEvent := matchedEvents[index]
+		matchedEvent.Tags = log.Tags
+
+		var eventJSON []byte
+		eventJSON, err = apthistory.MarshalEvent(matchedEvent, alerts.schemaVersion)
+		if err != nil {
+			return
+		}
+
+		matchedAlerts = append(matchedAlerts, alertRecord{
+			Rule:        rule.name,
+			Severity:    rule.severity,
+			Description: rule.description,
+			Hostname:    alerts.hostname,
+			EventID:     log.EventID,
+			Event:       eventJSON,
+		})
+	}
+	return
+}
+
+// Starts delivering alerts in the background, so slow sinks do not hold up the daemon's events
+// Once shutdown is closed, all waiting alerts share one deadline, after which deliveries are cancelled and the rest dropped
+func (alerts *alerter) startSending(running *sync.WaitGroup, shutdown <-chan struct{}) {
+	alerts.queue = make(chan alertRecord, alertQueueSize)
+	alerts.running = running
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-shutdown
+		<-time.After(alerts.drainTimeout)
+		cancel()
+	}()
+
+	go func() {
+		var dropped int
+		for alert := range alerts.queue {
+			if ctx.Err() == nil {
+				alerts.deliver(ctx, alert)
+			} else {
+				dropped++
+				if len(alerts.queue) == 0 {
+					printMessage(verbosityNone, "Dropped %d alerts not delivered within %s of shutdown\n", dropped, alerts.drainTimeout)
+					dropped = 0
+				}
+			}
+			alerts.running.Done()
+		}
+	}()
+}
+
+// Passes each alert on for delivery, to the background sender once it is started
+func (alerts *alerter) send(matchedAlerts []alertRecord) {
+	for _, alert := range matchedAlerts {
+		printMessage(verbosityProgress, "Event %s matched alert rule %s (%s)\n", alert.EventID, alert.Rule, alert.Severity)
+
+		if alerts.queue == nil {
+			alerts.deliver(context.Background(), alert)
+			continue
+		}
+
+		alerts.running.Add(1)
+		select {
+		case alerts.queue <- alert:
+		default:
+			alerts.running.Done()
+			printMessage(verbosityNone, "Failed to send alert %s for event %s: %d alerts are still waiting for delivery\n", alert.Rule, alert.EventID, alertQueueSize)
+		}
+	}
+}
+
+// Sends the alert to every sink accepting its severity
+// Failed deliveries are reported but do not stop the daemon
+func (alerts *alerter) deliver(ctx context.Context, alert alertRecord) {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		printMessage(verbosityNone, "Failed to encode alert %s: %v\n", alert.Rule, err)
+		return
+	}
+
+	severity := slices.Index(alertSeverities, alert.Severity)
+	for _, sink := range alerts.sinks {
+		if severity < sink.minSeverity {
+			continue
+		}
+
+		err = sink.sink.send(ctx, alert, payload)
+		if err != nil {
+			printMessage(verbosityNone, "Failed to send alert %s for event %s to %s sink: %v\n", alert.Rule, alert.EventID, sink.kind, err)
+		}
+	}
+}
+
+func newAlertSink(config AlertSinkConfig) (sink configuredSink, err error) {
+	sink.kind = config.Type
+
+	if config.MinSeverity != "" {
+		sink.minSeverity = slices.Index(alertSeverities, config.MinSeverity)
+		if sink.minSeverity == -1 {
+			err = fmt.Errorf("unknown minimum severity '%s': must be one of %s", config.MinSeverity, strings.Join(alertSeverities, ", "))
+			return
+		}
+	}
+
+	timeout := defaultAlertTimeout
+	if config.Timeout != "" {
+		timeout, err = time.ParseDuration(config.Timeout)
+		if err != nil || timeout <= 0 {
+			err = fmt.Errorf("invalid timeout '%s': must be a positive duration like 5s", config.Timeout)
+			return
+		}
+	}
+
+	switch config.Type {
+	case "exec":
+		if len(config.Command) == 0 {
+			err = fmt.Errorf("exec sink requires a command")
+			return
+		}
+		sink.sink = &execSink{command: config.Command, timeout: timeout}
+	case "webhook":
+		if !strings.HasPrefix(config.URL, "http://") && !strings.HasPrefix(config.URL, "https://") {
+			err = fmt.Errorf("webhook sink requires an http or https url")
+			return
+		}
+		sink.sink = &webhookSink{url: config.URL, headers: config.Headers, client: &http.Client{Timeout: timeout}}
+	case "syslog":
+		sink.sink, err = newSyslogSink(config)
+	default:
+		err = fmt.Errorf("unknown sink type '%s': must be one of exec, webhook, syslog", config.Type)
+	}
+	return
+}
+
+// ###################################
+//      SINKS
+// ###################################
+
+// Runs a command per alert with the alert JSON on stdin
+type execSink struct {
+	command []string
+	timeout time.Duration
+}
+
+func (sink *execSink) send(ctx context.Context, alert alertRecord, payload []byte) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, sink.timeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, sink.command[0], sink.command[1:]...)
+	command.Stdin = bytes.NewReader(payload)
+	command.Env = append(os.Environ(),
+		"APTHL_ALERT_RULE="+alert.Rule,
+		"APTHL_ALERT_SEVERITY="+alert.Severity,
+		"APTHL_EVENT_ID="+alert.EventID,
+	)
+
+	// Children of the command hold its output open, the whole process group is killed on timeout
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	command.Cancel = func() error {
+		return syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+	}
+	command.WaitDelay = time.Second
+
+	output, err := command.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+		return
+	}
+	return
+}
+
+// Posts the alert JSON to a URL
+type webhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (sink *webhookSink) send(ctx context.Context, alert alertRecord, payload []byte) (err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.url, bytes.NewReader(payload))
+	if err != nil {
+		err = fmt.Errorf("failed to create request: %v", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "APTHistoryLogger/"+programVersion)
+	for name, value := range sink.headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		err = fmt.Errorf("server responded with %s", response.Status)
+		return
+	}
+	return
+}
+
+// Writes the alert JSON to syslog with the priority of the alert severity
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+func newSyslogSink(config AlertSinkConfig) (sink *syslogSink, err error) {
+	if config.Facility == "" {
+		config.Facility = "daemon"
+	}
+	facility, validFacility := syslogFacilities[config.Facility]
+	if !validFacility {
+		err = fmt.Errorf("unknown syslog facility '%s'", config.Facility)
+		return
+	}
+	if config.Tag == "" {
+		config.Tag = "apthl"
+	}
+	if (config.Network == "") != (config.Address == "") {
+		err = fmt.Errorf("syslog network and address must be given together")
+		return
+	}
+
+	writer, err := syslog.Dial(config.Network, config.Address, facility|syslog.LOG_WARNING, config.Tag)
+	if err != nil {
+		err = fmt.Errorf("failed to connect to syslog: %v", err)
+		return
+	}
+	sink = &syslogSink{writer: writer}
+	return
+}
+
+func (sink *syslogSink) send(ctx context.Context, alert alertRecord, payload []byte) (err error) {
+	if len(payload) > syslogMaxMessageSize {
+		alert.Event = nil
+		alert.Omitted = true
+		payload, err = json.Marshal(alert)
+		if err != nil {
+			return
+		}
+	}
+
+	switch alert.Severity {
+	case "critical":
+		err = sink.writer.Crit(string(payload))
+	case "warning":
+		err = sink.writer.Warning(string(payload))
+	default:
+		err = sink.writer.Info(string(payload))
+	}
+	return
+}
@@ -0,0 +1,200 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAlertRules(t *testing.T) {
+	config := AlertConfig{
+		Rules: []AlertRuleConfig{
+			{Name: "ssh-server-removed", Query: `pkg ~ "^openssh-server" and op in (remove, purge)`, Severity: "critical"},
+			{Name: "any-purge", Query: "op = purge"},
+			{Name: "non-admin", Query: "has(user) and not uid in (0, 1000)", Severity: "info"},
+			{Name: "slow-run", Query: "elapsed > 600", Severity: "info"},
+			{Name: "apt-error", Query: "has(error)", Severity: "critical"},
+		},
+	}
+	alerts, err := newAlerter(config, apthistory.SchemaVersion2, hostInfo{hostname: "test"})
+	if err != nil {
+		t.Fatalf("newAlerter() unexpected error = %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		log            LogJSON
+		wantTags       []string
+		wantSeverities []string
+		wantInAlert    string
+		notInAlert     string
+	}{
+		{
+			name: "SSH server purged by admin",
+			log: LogJSON{
+				RequestedBy:    "admin",
+				RequestedByUID: 1000,
+				ElapsedSeconds: 5,
+				TotalPackages:  2,
+				Purge:          []PackageInfo{{Name: "openssh-server", Arch: "amd64", Version: "1:9.2p1-2"}, {Name: "telnet", Arch: "amd64", Version: "0.17"}},
+			},
+			wantTags:       []string{"ssh-server-removed", "any-purge"},
+			wantSeverities: []string{"critical", "warning"},
+			wantInAlert:    "openssh-server",
+			notInAlert:     "telnet",
+		},
+		{
+			name: "Slow failed run by other user",
+			log: LogJSON{
+				RequestedBy:    "bob",
+				RequestedByUID: 1001,
+				ElapsedSeconds: 900,
+				Error:          "Sub-process /usr/bin/dpkg returned an error code (1)",
+			},
+			wantTags:       []string{"non-admin", "slow-run", "apt-error"},
+			wantSeverities: []string{"info", "info", "critical"},
+		},
+		{
+			name: "Unattended install",
+			log: LogJSON{
+				ElapsedSeconds: 30,
+				TotalPackages:  1,
+				Install:        []PackageInfo{{Name: "nginx", Arch: "amd64", Version: "1.22.1-9"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.log.StartTimestamp = "2025-06-01T10:00:00Z"
+			test.log.EndTimeStamp = "2025-06-01T10:00:30Z"
+
+			matchedAlerts, err := alerts.evaluate(&test.log)
+			if err != nil {
+				t.Fatalf("evaluate() unexpected error = %v", err)
+			}
+
+			if !slices.Equal(test.log.Tags, test.wantTags) {
+				t.Errorf("evaluate() tagged %v, want %v", test.log.Tags, test.wantTags)
+			}
+
+			var severities []string
+			for _, alert := range matchedAlerts {
+				severities = append(severities, alert.Severity)
+			}
+			if !slices.Equal(severities, test.wantSeverities) {
+				t.Errorf("evaluate() alert severities %v, want %v", severities, test.wantSeverities)
+			}
+
+			if len(matchedAlerts) > 0 {
+				event := string(matchedAlerts[0].Event)
+				if !strings.Contains(event, test.wantInAlert) || (test.notInAlert != "" && strings.Contains(event, test.notInAlert)) {
+					t.Errorf("first alert event = %s, want only the matched packages", event)
+				}
+			}
+		})
+	}
+}
+
+func TestAlertConfigValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config AlertConfig
+	}{
+		{name: "Missing name", config: AlertConfig{Rules: []AlertRuleConfig{{Query: "op = purge"}}}},
+		{name: "Duplicate name", config: AlertConfig{Rules: []AlertRuleConfig{{Name: "a", Query: "op = purge"}, {Name: "a", Query: "op = remove"}}}},
+		{name: "Unknown severity", config: AlertConfig{Rules: []AlertRuleConfig{{Name: "a", Query: "op = purge", Severity: "high"}}}},
+		{name: "Invalid query", config: AlertConfig{Rules: []AlertRuleConfig{{Name: "a", Query: "bogus = x"}}}},
+		{name: "Unknown sink", config: AlertConfig{Sinks: []AlertSinkConfig{{Type: "email"}}}},
+		{name: "Exec without command", config: AlertConfig{Sinks: []AlertSinkConfig{{Type: "exec"}}}},
+		{name: "Webhook without URL", config: AlertConfig{Sinks: []AlertSinkConfig{{Type: "webhook", URL: "example.com"}}}},
+		{name: "Invalid timeout", config: AlertConfig{Sinks: []AlertSinkConfig{{Type: "exec", Command: []string{"true"}, Timeout: "soon"}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newAlerter(test.config, apthistory.SchemaVersion2, hostInfo{})
+			if err == nil {
+				t.Errorf("newAlerter() expected an error")
+			}
+		})
+	}
+}
+
+// Records alerts, waiting for release before accepting each one
+type blockingSink struct {
+	release   chan struct{}
+	delivered []string
+}
+
+func (sink *blockingSink) send(ctx context.Context, alert alertRecord, payload []byte) (err error) {
+	select {
+	case <-sink.release:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+	sink.delivered = append(sink.delivered, alert.Rule)
+	return
+}
+
+func TestAlertSendInBackground(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	alerts := &alerter{sinks: []configuredSink{{kind: "test", sink: sink}}, drainTimeout: time.Minute}
+
+	var running sync.WaitGroup
+	alerts.startSending(&running, make(chan struct{}))
+
+	// A hung sink must not hold up the caller
+	sent := make(chan struct{})
+	go func() {
+		alerts.send([]alertRecord{{Rule: "first", Severity: "info"}, {Rule: "second", Severity: "critical"}})
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("send() waited for the sink")
+	}
+
+	close(sink.release)
+	running.Wait()
+
+	want := []string{"first", "second"}
+	if !slices.Equal(sink.delivered, want) {
+		t.Errorf("sink received %v, want %v", sink.delivered, want)
+	}
+}
+
+func TestAlertDrainDeadline(t *testing.T) {
+	// Never released, like an unreachable webhook
+	sink := &blockingSink{release: make(chan struct{})}
+	alerts := &alerter{sinks: []configuredSink{{kind: "test", sink: sink}}, drainTimeout: 100 * time.Millisecond}
+
+	var running sync.WaitGroup
+	shutdown := make(chan struct{})
+	alerts.startSending(&running, shutdown)
+	alerts.send([]alertRecord{{Rule: "first", Severity: "info"}, {Rule: "second", Severity: "info"}, {Rule: "third", Severity: "info"}})
+	close(shutdown)
+
+	// All waiting alerts share one deadline instead of one sink timeout each
+	drained := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("queued alerts held up shutdown past the drain deadline")
+	}
+
+	if len(sink.delivered) != 0 {
+		t.Errorf("sink received %v, want nothing", sink.delivered)
+	}
+}
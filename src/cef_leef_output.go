@@ -0,0 +1,245 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	siemVendor  string = "EvSecDev"
+	siemProduct string = "APTHistoryLogger"
+)
+
+// Severity (0-10) of each operation, removals rank higher than installs
+var operationSeverity = map[string]int{
+	"install":   3,
+	"reinstall": 3,
+	"upgrade":   4,
+	"downgrade": 5,
+	"remove":    6,
+	"purge":     7,
+}
+
+// Severity of events where APT reported an error
+const errorSeverity int = 8
+
+// Ordered key/value pairs of a CEF or LEEF event
+type siemField struct {
+	key   string
+	value string
+}
+
+// Identifies the event class by its operations, like 'apt:upgrade' or 'apt:install+remove'
+// Severity is the highest of all operations and errors
+func siemClassification(log LogJSON) (signature string, name string, severity int, operations []string) {
+	severity = 1
+	for _, opList := range log.OperationLists() {
+		if len(*opList.Packages) == 0 {
+			continue
+		}
+		operations = append(operations, opList.Name)
+		severity = max(severity, operationSeverity[opList.Name])
+	}
+	if log.Error != "" {
+		severity = errorSeverity
+	}
+
+	if len(operations) == 0 {
+		signature = "apt:none"
+		name = "APT operation"
+	} else {
+		signature = "apt:" + strings.Join(operations, "+")
+		name = "APT " + strings.Join(operations, ", ")
+	}
+	if log.Error != "" {
+		name += " failed"
+	}
+	return
+}
+
+// Event values shared by CEF and LEEF, under their custom key names
+func siemPackageFields(log LogJSON) (packages string, versions string, previousVersions string) {
+	var packageList, versionList, previousList []string
+	for _, opList := range log.OperationLists() {
+		for _, pkg := range *opList.Packages {
+			packageList = append(packageList, pkg.Name+":"+pkg.Arch)
+			versionList = append(versionList, pkg.Name+"="+pkg.Version)
+			if pkg.OldVersion != "" {
+				previousList = append(previousList, pkg.Name+"="+pkg.OldVersion)
+			}
+		}
+	}
+	packages = strings.Join(packageList, " ")
+	versions = strings.Join(versionList, " ")
+	previousVersions = strings.Join(previousList, " ")
+	return
+}
+
+func siemOutcome(log LogJSON) string {
+	if log.Error != "" {
+		return "failure"
+	}
+	return "success"
+}
+
+// Numbers that are only set in some records (zero means not set)
+func optionalNumber(value int) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.Itoa(value)
+}
+
+// ###################################
+//      CEF
+// ###################################
+
+// Formats an event as an ArcSight Common Event Format line
+func cefLine(log LogJSON, host hostInfo) (line string) {
+	signature, name, severity, operations := siemClassification(log)
+	packages, versions, previousVersions := siemPackageFields(log)
+	start, _ := time.Parse(time.RFC3339, log.StartTimestamp)
+	end, _ := time.Parse(time.RFC3339, log.EndTimeStamp)
+
+	header := []string{"CEF:0", siemVendor, siemProduct, programVersion, signature, name, strconv.Itoa(severity)}
+	for index := range header[1:] {
+		header[index+1] = cefHeaderEscape(header[index+1])
+	}
+
+	fields := []siemField{
+		{"rt", strconv.FormatInt(start.UnixMilli(), 10)},
+		{"start", strconv.FormatInt(start.UnixMilli(), 10)},
+		{"end", strconv.FormatInt(end.UnixMilli(), 10)},
+		{"dvchost", host.hostname},
+		{"suser", log.RequestedBy},
+		{"outcome", siemOutcome(log)},
+		{"reason", log.Error},
+	}
+	if log.RequestedBy != "" {
+		fields = append(fields, siemField{"suid", strconv.Itoa(log.RequestedByUID)})
+	}
+
+	// Custom extension keys are only added together with their label
+	customFields := []struct {
+		key   string
+		label string
+		value string
+	}{
+		{"cs1", "EventID", log.EventID},
+		{"cs2", "Operations", strings.Join(operations, ",")},
+		{"cs3", "Packages", packages},
+		{"cs4", "Versions", versions},
+		{"cs5", "PreviousVersions", previousVersions},
+		{"cs6", "CommandLine", log.CommandLine},
+		{"cn1", "TotalPackages", strconv.Itoa(log.TotalPackages)},
+		{"cn2", "ElapsedSeconds", strconv.Itoa(log.ElapsedSeconds)},
+		{"cn3", "PackageIndex", optionalNumber(log.PackageIndex)},
+		{"flexNumber1", "ChunkIndex", optionalNumber(log.ChunkIndex)},
+		{"flexNumber2", "ChunkTotal", optionalNumber(log.ChunkTotal)},
+		{"flexString1", "ChunkOf", log.ChunkOf},
+	}
+	for _, customField := range customFields {
+		if customField.value == "" {
+			continue
+		}
+		fields = append(fields, siemField{customField.key + "Label", customField.label}, siemField{customField.key, customField.value})
+	}
+
+	var extension []string
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		extension = append(extension, field.key+"="+cefExtensionEscape(field.value))
+	}
+
+	line = strings.Join(header, "|") + "|" + strings.Join(extension, " ")
+	return
+}
+
+// Header fields escape backslashes and pipes
+func cefHeaderEscape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "|", `\|`)
+	value = strings.ReplaceAll(value, "\n", " ")
+	value = strings.ReplaceAll(value, "\r", " ")
+	return value
+}
+
+// Extension values escape backslashes, equal signs and line breaks
+func cefExtensionEscape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "=", `\=`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, "\r", `\r`)
+	return value
+}
+
+// ###################################
+//      LEEF
+// ###################################
+
+// Formats an event as an IBM QRadar Log Event Extended Format (LEEF 2.0) line with tab separated attributes
+func leefLine(log LogJSON, host hostInfo) (line string) {
+	signature, name, severity, operations := siemClassification(log)
+	packages, versions, previousVersions := siemPackageFields(log)
+	header := []string{"LEEF:2.0", siemVendor, siemProduct, programVersion, signature, "x09"}
+	for index := range header[1:5] {
+		header[index+1] = leefHeaderEscape(header[index+1])
+	}
+
+	fields := []siemField{
+		{"devTime", log.StartTimestamp},
+		{"devTimeFormat", "yyyy-MM-dd'T'HH:mm:ssXXX"},
+		{"sev", strconv.Itoa(max(severity, 1))},
+		{"cat", name},
+		{"identHostName", host.hostname},
+		{"usrName", log.RequestedBy},
+		{"outcome", siemOutcome(log)},
+		{"error", log.Error},
+		{"eventID", log.EventID},
+		{"operations", strings.Join(operations, ",")},
+		{"packages", packages},
+		{"versions", versions},
+		{"previousVersions", previousVersions},
+		{"commandLine", log.CommandLine},
+		{"totalPackages", strconv.Itoa(log.TotalPackages)},
+		{"elapsedSeconds", strconv.Itoa(log.ElapsedSeconds)},
+		{"packageIndex", optionalNumber(log.PackageIndex)},
+		{"packageTotal", optionalNumber(log.PackageTotal)},
+		{"chunkIndex", optionalNumber(log.ChunkIndex)},
+		{"chunkTotal", optionalNumber(log.ChunkTotal)},
+		{"chunkOf", log.ChunkOf},
+	}
+	if log.RequestedBy != "" {
+		fields = append(fields, siemField{"usrUID", strconv.Itoa(log.RequestedByUID)})
+	}
+
+	var attributes []string
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		attributes = append(attributes, field.key+"="+leefAttributeEscape(field.value))
+	}
+
+	line = strings.Join(header, "|") + "|" + strings.Join(attributes, "\t")
+	return
+}
+
+func leefHeaderEscape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "|", `\|`)
+	return value
+}
+
+// Attribute values cannot contain the tab delimiter or line breaks
+func leefAttributeEscape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\t", `\t`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, "\r", `\r`)
+	return value
+}
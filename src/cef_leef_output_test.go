@@ -0,0 +1,64 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCEFLine(t *testing.T) {
+	tests := []struct {
+		name         string
+		log          LogJSON
+		wantHeader   string
+		wantContains []string
+	}{
+		{
+			name: "Install",
+			log: LogJSON{
+				EventID:        "be15fb0b-7dff-cb97-8bf2-2bbada2040f4",
+				StartTimestamp: "2025-06-01T10:00:00Z",
+				EndTimeStamp:   "2025-06-01T10:00:30Z",
+				TotalPackages:  1,
+				Install:        []PackageInfo{{Name: "nginx", Arch: "amd64", Version: "1.22.1-9"}},
+			},
+			wantHeader:   "CEF:0|EvSecDev|APTHistoryLogger||apt:install|APT install|3|",
+			wantContains: []string{"cs3=nginx:amd64", `cs4=nginx\=1.22.1-9`, "outcome=success"},
+		},
+		{
+			name: "Removal ranks higher",
+			log: LogJSON{
+				StartTimestamp: "2025-06-01T10:00:00Z",
+				EndTimeStamp:   "2025-06-01T10:00:30Z",
+				Install:        []PackageInfo{{Name: "a", Arch: "amd64", Version: "1"}},
+				Purge:          []PackageInfo{{Name: "b", Arch: "amd64", Version: "2"}},
+			},
+			wantHeader: "CEF:0|EvSecDev|APTHistoryLogger||apt:install+purge|APT install, purge|7|",
+		},
+		{
+			name: "Error and escaping",
+			log: LogJSON{
+				StartTimestamp: "2025-06-01T10:00:00Z",
+				EndTimeStamp:   "2025-06-01T10:00:30Z",
+				CommandLine:    `apt install a=1 b\c`,
+				Error:          "line one\nline two",
+			},
+			wantHeader:   "CEF:0|EvSecDev|APTHistoryLogger||apt:none|APT operation failed|8|",
+			wantContains: []string{`cs6=apt install a\=1 b\\c`, `reason=line one\nline two`, "outcome=failure"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line := cefLine(test.log, hostInfo{})
+			if !strings.HasPrefix(line, test.wantHeader) {
+				t.Errorf("cefLine() = %s, want header %s", line, test.wantHeader)
+			}
+			for _, want := range test.wantContains {
+				if !strings.Contains(line, want) {
+					t.Errorf("cefLine() = %s, want it to contain %s", line, want)
+				}
+			}
+		})
+	}
+}
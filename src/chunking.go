@@ -2,16 +2,30 @@
 package main
 
 import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"reflect"
+	"slices"
+	"strings"
+	"unicode/utf8"
 )
 
+// Room kept free in each chunk for the chunk metadata fields
+const chunkMetadataSize = 160
+
+// Smallest chunk size that leaves room for event metadata and a few packages
+const minimumChunkSize = 1024
+
 // Splits a big array into separate arrays, keeping other slices empty
-func splitLargeArray(log LogJSON, fieldIndex int) (chunks []LogJSON, err error) {
+func splitLargeArray(log LogJSON, fieldIndex int, maxSize int, schemaVersion int) (chunks []LogJSON, err error) {
 	v := reflect.ValueOf(log)
 	sliceVal := v.Field(fieldIndex)
 
-	if sliceVal.Len() == 0 {
+	// A single package cannot be split any further
+	if sliceVal.Len() <= 1 {
 		return
 	}
 
@@ -23,12 +37,12 @@ func splitLargeArray(log LogJSON, fieldIndex int) (chunks []LogJSON, err error)
 		}
 	}
 
-	tmpB, err := json.Marshal(tmp)
+	tmpB, err := apthistory.MarshalEvent(tmp, schemaVersion)
 	if err != nil {
 		return
 	}
 
-	if len(tmpB) <= journalDMaxSize {
+	if len(tmpB) <= maxSize {
 		// Small enough — keep in base log
 		return
 	}
@@ -44,11 +58,11 @@ func splitLargeArray(log LogJSON, fieldIndex int) (chunks []LogJSON, err error)
 	reflect.ValueOf(&left).Elem().Field(fieldIndex).Set(reflect.ValueOf(leftSlice))
 	reflect.ValueOf(&right).Elem().Field(fieldIndex).Set(reflect.ValueOf(rightSlice))
 
-	leftChunks, err := splitLargeArray(left, fieldIndex)
+	leftChunks, err := splitLargeArray(left, fieldIndex, maxSize, schemaVersion)
 	if err != nil {
 		return
 	}
-	rightChunks, err := splitLargeArray(right, fieldIndex)
+	rightChunks, err := splitLargeArray(right, fieldIndex, maxSize, schemaVersion)
 	if err != nil {
 		return
 	}
@@ -64,10 +78,33 @@ func splitLargeArray(log LogJSON, fieldIndex int) (chunks []LogJSON, err error)
 	return
 }
 
-// Splits package lists that exceed size as to fit in journald
+// Splits package lists that exceed size as to fit in the output sink (like journald)
 // Non-package list fields are untouched and duplicated as many times as needed
-func splitLog(log LogJSON) (chunks []LogJSON, err error) {
-	baseLog := log
+// Raw event text is split over chunks of its own that carry only the event ID, timestamps and source
+// Split events have every chunk numbered and marked with the digest of the whole event, a size of 0 disables splitting
+// Sizes are measured on the records as written in the given schema version
+func splitLog(log LogJSON, maxSize int, schemaVersion int) (chunks []LogJSON, err error) {
+	if maxSize <= 0 {
+		chunks = []LogJSON{log}
+		return
+	}
+	maxSize -= chunkMetadataSize
+
+	// The parsed command line can be as large as the package lists, oversized events leave it out and readers rebuild it from CommandLine
+	logJSON, err := apthistory.MarshalEvent(log, schemaVersion)
+	if err != nil {
+		return
+	}
+	if len(logJSON) <= maxSize {
+		chunks = []LogJSON{log}
+		return
+	}
+	log.Command = nil
+
+	// Raw event text goes in chunks of its own after the package chunks
+	packagesLog := log
+	packagesLog.Raw = ""
+	baseLog := packagesLog
 
 	t := reflect.TypeOf(log)
 	var extraLogs []LogJSON
@@ -75,7 +112,7 @@ func splitLog(log LogJSON) (chunks []LogJSON, err error) {
 	for i := 0; i < t.NumField(); i++ {
 		if t.Field(i).Type == reflect.TypeOf([]PackageInfo{}) {
 			var fieldChunks []LogJSON
-			fieldChunks, err = splitLargeArray(log, i)
+			fieldChunks, err = splitLargeArray(packagesLog, i, maxSize, schemaVersion)
 			if err != nil {
 				return
 			}
@@ -86,6 +123,340 @@ func splitLog(log LogJSON) (chunks []LogJSON, err error) {
 		}
 	}
 
+	// Raw chunks only identify the event, the other fields can be as large as the text
+	if log.Raw != "" {
+		rawBase := LogJSON{
+			EventID:        log.EventID,
+			StartTimestamp: log.StartTimestamp,
+			EndTimeStamp:   log.EndTimeStamp,
+			Source:         log.Source,
+		}
+
+		var rawChunks []LogJSON
+		rawChunks, err = splitRawText(rawBase, log.Raw, maxSize, schemaVersion)
+		if err != nil {
+			return
+		}
+		extraLogs = append(extraLogs, rawChunks...)
+	}
+
 	chunks = append([]LogJSON{baseLog}, extraLogs...)
+	if len(chunks) == 1 {
+		return
+	}
+
+	digest, err := eventDigest(log)
+	if err != nil {
+		return
+	}
+	for index := range chunks {
+		chunks[index].ChunkIndex = index + 1
+		chunks[index].ChunkTotal = len(chunks)
+		chunks[index].ChunkOf = digest
+	}
+	return
+}
+
+// Cuts raw event text into pieces that each fit a chunk once JSON escaped, only between characters
+func splitRawText(base LogJSON, raw string, maxSize int, schemaVersion int) (chunks []LogJSON, err error) {
+	baseJSON, err := apthistory.MarshalEvent(base, schemaVersion)
+	if err != nil {
+		return
+	}
+
+	// Escaped characters take up to 6 bytes (\u003c)
+	room := maxSize - len(baseJSON) - len(`,"Raw":""`)
+	if room < 6 {
+		err = fmt.Errorf("event fields leave no room for raw text in %d byte chunks", maxSize)
+		return
+	}
+
+	var piece strings.Builder
+	var pieceSize int
+	for index := 0; index < len(raw); {
+		_, width := utf8.DecodeRuneInString(raw[index:])
+		char := raw[index : index+width]
+		index += width
+
+		encodedChar, _ := json.Marshal(char)
+		charSize := len(encodedChar) - 2 // Without quotes
+
+		if pieceSize+charSize > room {
+			chunk := base
+			chunk.Raw = piece.String()
+			chunks = append(chunks, chunk)
+			piece.Reset()
+			pieceSize = 0
+		}
+		piece.WriteString(char)
+		pieceSize += charSize
+	}
+
+	chunk := base
+	chunk.Raw = piece.String()
+	chunks = append(chunks, chunk)
+	return
+}
+
+// SHA-256 of the event (without chunk metadata) as JSON, identical for every chunk of the event and for the reassembled event
+func eventDigest(log LogJSON) (digest string, err error) {
+	log.ChunkIndex = 0
+	log.ChunkTotal = 0
+	log.ChunkOf = ""
+	log.Incomplete = false
+
+	logJSON, err := json.Marshal(log)
+	if err != nil {
+		err = fmt.Errorf("invalid JSON: %v", err)
+		return
+	}
+
+	hash := sha256.Sum256(logJSON)
+	digest = hex.EncodeToString(hash[:])
+	return
+}
+
+// Adds the package lists and raw text of a chunk produced by splitLog back into the event it was split from
+// Per-package records (see --per-package) merge back into the whole event the same way
+func mergeLogChunk(base *LogJSON, chunk LogJSON) {
+	base.PackageIndex = 0
+	base.PackageTotal = 0
+	base.ChunkIndex = 0
+	base.ChunkTotal = 0
+	base.ChunkOf = ""
+	base.Raw += chunk.Raw
+
+	chunkLists := chunk.OperationLists()
+	for index, baseList := range base.OperationLists() {
+		*baseList.Packages = append(*baseList.Packages, *chunkLists[index].Packages...)
+		*baseList.Flag = *baseList.Flag || *chunkLists[index].Flag
+	}
+}
+
+// Reassembles the records of an event before passing on the whole event
+// Chunks with chunk metadata are reassembled by it, per-package records and chunks of older output by merging consecutive records sharing an event ID
+// Records written more than once (like an event emitted again after a restart) are only passed on once
+type chunkAssembler struct {
+	handleEvent    func(LogJSON) (bool, error)
+	reassembler    *chunkReassembler
+	pendingLog     LogJSON
+	pendingDigests []string // Digests of the records merged into the pending event
+	hasPending     bool
+}
+
+func (assembler *chunkAssembler) add(record LogJSON) (keepReading bool, err error) {
+	keepReading = true
+
+	if record.StartTimestamp == "" {
+		// Records of other types, like parse errors, are not events
+		printMessage(verbosityData, "Skipping JSON record without a start timestamp\n")
+		return
+	}
+
+	if record.ChunkTotal == 0 {
+		keepReading, err = assembler.merge(record)
+		return
+	}
+
+	if assembler.reassembler == nil {
+		assembler.reassembler = newChunkReassembler()
+	}
+	events, err := assembler.reassembler.add(record)
+	if err != nil {
+		return
+	}
+	for _, event := range events {
+		keepReading, err = assembler.merge(event)
+		if err != nil || !keepReading {
+			return
+		}
+	}
+	return
+}
+
+// Adds a whole event or a part of it without chunk metadata to the pending event
+func (assembler *chunkAssembler) merge(record LogJSON) (keepReading bool, err error) {
+	keepReading = true
+
+	digest, err := eventDigest(record)
+	if err != nil {
+		return
+	}
+
+	if assembler.hasPending && record.EventID == assembler.pendingLog.EventID {
+		if slices.Contains(assembler.pendingDigests, digest) {
+			printMessage(verbosityData, "Skipping duplicate record of event %s\n", record.EventID)
+			return
+		}
+		mergeLogChunk(&assembler.pendingLog, record)
+		assembler.pendingDigests = append(assembler.pendingDigests, digest)
+		return
+	}
+
+	if assembler.hasPending {
+		keepReading, err = assembler.handleEvent(assembler.pendingLog)
+		if err != nil || !keepReading {
+			return
+		}
+	}
+
+	assembler.pendingLog = record
+	assembler.pendingDigests = []string{digest}
+	assembler.hasPending = true
+	return
+}
+
+// Passes on events still missing chunks and the last held event
+func (assembler *chunkAssembler) flush() (err error) {
+	if assembler.reassembler != nil {
+		var events []LogJSON
+		events, err = assembler.reassembler.flush()
+		if err != nil {
+			return
+		}
+		for _, event := range events {
+			var keepReading bool
+			keepReading, err = assembler.merge(event)
+			if err != nil || !keepReading {
+				return
+			}
+		}
+	}
+
+	if !assembler.hasPending {
+		return
+	}
+
+	_, err = assembler.handleEvent(assembler.pendingLog)
+	assembler.hasPending = false
+	return
+}
+
+// Chunks of one split event collected so far, by chunk index
+type pendingChunks struct {
+	chunks   []LogJSON
+	received []bool
+	count    int
+}
+
+// Reassembles split events from their chunk metadata, regardless of the order chunks arrive in
+// Events that are not chunked are passed through unchanged
+type chunkReassembler struct {
+	pending   map[string]*pendingChunks
+	order     []string        // Digests of pending events in the order they were first seen
+	completed map[string]bool // Digests of events already passed on, to drop late duplicate chunks
+}
+
+func newChunkReassembler() (reassembler *chunkReassembler) {
+	reassembler = &chunkReassembler{
+		pending:   make(map[string]*pendingChunks),
+		completed: make(map[string]bool),
+	}
+	return
+}
+
+// Returns the events that are complete after adding this record
+func (reassembler *chunkReassembler) add(record LogJSON) (events []LogJSON, err error) {
+	if record.ChunkTotal == 0 {
+		events = []LogJSON{record}
+		return
+	}
+
+	if record.ChunkIndex < 1 || record.ChunkIndex > record.ChunkTotal || record.ChunkOf == "" {
+		err = fmt.Errorf("event %s has invalid chunk metadata (chunk %d of %d)", record.EventID, record.ChunkIndex, record.ChunkTotal)
+		return
+	}
+
+	if reassembler.completed[record.ChunkOf] {
+		printMessage(verbosityData, "Skipping duplicate chunk %d of event %s\n", record.ChunkIndex, record.EventID)
+		return
+	}
+
+	pending, exists := reassembler.pending[record.ChunkOf]
+	if !exists {
+		pending = &pendingChunks{
+			chunks:   make([]LogJSON, record.ChunkTotal),
+			received: make([]bool, record.ChunkTotal),
+		}
+		reassembler.pending[record.ChunkOf] = pending
+		reassembler.order = append(reassembler.order, record.ChunkOf)
+	}
+
+	position := record.ChunkIndex - 1
+	if position >= len(pending.chunks) || pending.received[position] {
+		printMessage(verbosityData, "Skipping duplicate chunk %d of event %s\n", record.ChunkIndex, record.EventID)
+		return
+	}
+	pending.chunks[position] = record
+	pending.received[position] = true
+	pending.count++
+
+	if pending.count < len(pending.chunks) {
+		return
+	}
+
+	event, err := pending.assemble()
+	if err != nil {
+		return
+	}
+	events = []LogJSON{event}
+
+	delete(reassembler.pending, record.ChunkOf)
+	reassembler.completed[record.ChunkOf] = true
+	for index, digest := range reassembler.order {
+		if digest == record.ChunkOf {
+			reassembler.order = append(reassembler.order[:index], reassembler.order[index+1:]...)
+			break
+		}
+	}
+	return
+}
+
+// Returns all events still missing chunks, merged from the chunks that were found and marked incomplete
+func (reassembler *chunkReassembler) flush() (events []LogJSON, err error) {
+	for _, digest := range reassembler.order {
+		var event LogJSON
+		event, err = reassembler.pending[digest].assemble()
+		if err != nil {
+			return
+		}
+		events = append(events, event)
+	}
+
+	reassembler.pending = make(map[string]*pendingChunks)
+	reassembler.order = nil
+	return
+}
+
+// Merges received chunks in chunk order, marking the event incomplete if chunks are missing or the result does not match its digest
+func (pending *pendingChunks) assemble() (event LogJSON, err error) {
+	var digest string
+	var started bool
+	for position, chunk := range pending.chunks {
+		if !pending.received[position] {
+			continue
+		}
+		if !started {
+			event = chunk
+			digest = chunk.ChunkOf
+			event.ChunkIndex = 0
+			event.ChunkTotal = 0
+			event.ChunkOf = ""
+			started = true
+			continue
+		}
+		mergeLogChunk(&event, chunk)
+	}
+
+	if pending.count < len(pending.chunks) {
+		event.Incomplete = true
+		return
+	}
+
+	assembledDigest, err := eventDigest(event)
+	if err != nil {
+		return
+	}
+	event.Incomplete = assembledDigest != digest
 	return
 }
@@ -0,0 +1,165 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChunkReassembly(t *testing.T) {
+	var upgrades []PackageInfo
+	var rawUpgrades []string
+	for index := range 200 {
+		upgrades = append(upgrades, PackageInfo{Name: fmt.Sprintf("package-%d", index), Arch: "amd64", OldVersion: "1.0-1", Version: "1.0-2"})
+		rawUpgrades = append(rawUpgrades, fmt.Sprintf("package-%d:amd64 (1.0-1, 1.0-2)", index))
+	}
+	event := LogJSON{
+		EventID:          "be15fb0b-7dff-cb97-8bf2-2bbada2040f4",
+		CommandLine:      "apt upgrade",
+		StartTimestamp:   "2025-06-01T10:00:00Z",
+		EndTimeStamp:     "2025-06-01T10:05:00Z",
+		ElapsedSeconds:   300,
+		TotalPackages:    len(upgrades) + 1,
+		Install:          []PackageInfo{{Name: "linux-image-6.1.0-22-amd64", Arch: "amd64", Version: "6.1.94-1"}},
+		Upgrade:          upgrades,
+		InstallOperation: true,
+		UpgradeOperation: true,
+		// Escaped characters take more room in the chunks than in the text
+		Raw: "Start-Date: 2025-06-01  10:00:00\nCommandline: apt upgrade <&> \"é\"\nUpgrade: " + strings.Join(rawUpgrades, ", ") + "\nEnd-Date: 2025-06-01  10:05:00\n",
+	}
+
+	// Chunks have to fit as written, version 2 records are larger than version 1
+	for _, schemaVersion := range apthistory.SchemaVersions {
+		versionChunks, err := splitLog(event, 2048, schemaVersion)
+		if err != nil {
+			t.Fatalf("splitLog() schema version %d unexpected error = %v", schemaVersion, err)
+		}
+		if len(versionChunks) < 3 {
+			t.Fatalf("splitLog() schema version %d returned %d chunks, want at least 3", schemaVersion, len(versionChunks))
+		}
+		for index, chunk := range versionChunks {
+			if chunk.ChunkIndex != index+1 || chunk.ChunkTotal != len(versionChunks) || chunk.ChunkOf != versionChunks[0].ChunkOf {
+				t.Errorf("schema version %d chunk %d has metadata %d/%d %s", schemaVersion, index, chunk.ChunkIndex, chunk.ChunkTotal, chunk.ChunkOf)
+			}
+			chunkJSON, _ := apthistory.MarshalEvent(chunk, schemaVersion)
+			if len(chunkJSON) > 2048 {
+				t.Errorf("schema version %d chunk %d is %d bytes, want at most 2048", schemaVersion, index, len(chunkJSON))
+			}
+		}
+	}
+
+	chunks, err := splitLog(event, 2048, apthistory.SchemaVersion1)
+	if err != nil {
+		t.Fatalf("splitLog() unexpected error = %v", err)
+	}
+
+	reversed := slices.Clone(chunks)
+	slices.Reverse(reversed)
+
+	tests := []struct {
+		name           string
+		records        []LogJSON
+		wantIncomplete bool
+	}{
+		{name: "In order", records: chunks},
+		{name: "Out of order", records: reversed},
+		{name: "Duplicate chunk", records: append(slices.Clone(chunks), chunks[1])},
+		{name: "Missing chunk", records: slices.Delete(slices.Clone(chunks), 1, 2), wantIncomplete: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reassembler := newChunkReassembler()
+
+			var events []LogJSON
+			for _, record := range test.records {
+				completed, err := reassembler.add(record)
+				if err != nil {
+					t.Fatalf("add() unexpected error = %v", err)
+				}
+				events = append(events, completed...)
+			}
+			remaining, err := reassembler.flush()
+			if err != nil {
+				t.Fatalf("flush() unexpected error = %v", err)
+			}
+			events = append(events, remaining...)
+
+			if len(events) != 1 {
+				t.Fatalf("reassembled %d events, want 1", len(events))
+			}
+			if events[0].Incomplete != test.wantIncomplete {
+				t.Errorf("reassembled event incomplete = %v, want %v", events[0].Incomplete, test.wantIncomplete)
+			}
+			if !test.wantIncomplete && (!reflect.DeepEqual(events[0].Upgrade, event.Upgrade) || events[0].Raw != event.Raw) {
+				t.Errorf("reassembled event does not match the original event")
+			}
+		})
+	}
+}
+
+func TestChunkAssembler(t *testing.T) {
+	var upgrades []PackageInfo
+	for index := range 100 {
+		upgrades = append(upgrades, PackageInfo{Name: fmt.Sprintf("package-%d", index), Arch: "amd64", OldVersion: "1.0-1", Version: "1.0-2"})
+	}
+	event := LogJSON{
+		EventID:          "be15fb0b-7dff-cb97-8bf2-2bbada2040f4",
+		CommandLine:      "apt upgrade",
+		StartTimestamp:   "2025-06-01T10:00:00Z",
+		EndTimeStamp:     "2025-06-01T10:05:00Z",
+		TotalPackages:    len(upgrades),
+		Upgrade:          upgrades,
+		UpgradeOperation: true,
+	}
+	chunks, err := splitLog(event, 2048, apthistory.SchemaVersion1)
+	if err != nil {
+		t.Fatalf("splitLog() unexpected error = %v", err)
+	}
+	reversed := slices.Clone(chunks)
+	slices.Reverse(reversed)
+	perPackage := event.PerPackage()
+
+	tests := []struct {
+		name    string
+		records []LogJSON
+	}{
+		{name: "Whole event", records: []LogJSON{event}},
+		{name: "Whole event written twice", records: []LogJSON{event, event}},
+		{name: "Chunks out of order", records: reversed},
+		{name: "Chunks written twice", records: append(slices.Clone(chunks), chunks...)},
+		{name: "Per-package records", records: perPackage},
+		{name: "Per-package records written twice", records: append(slices.Clone(perPackage), perPackage...)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var events []LogJSON
+			assembler := chunkAssembler{handleEvent: func(log LogJSON) (bool, error) {
+				events = append(events, log)
+				return true, nil
+			}}
+			for _, record := range test.records {
+				_, err := assembler.add(record)
+				if err != nil {
+					t.Fatalf("add() unexpected error = %v", err)
+				}
+			}
+			err := assembler.flush()
+			if err != nil {
+				t.Fatalf("flush() unexpected error = %v", err)
+			}
+
+			if len(events) != 1 {
+				t.Fatalf("assembled %d events, want 1", len(events))
+			}
+			if events[0].Incomplete || !reflect.DeepEqual(events[0].Upgrade, event.Upgrade) {
+				t.Errorf("assembled event has %d upgrades (incomplete %t), want %d", len(events[0].Upgrade), events[0].Incomplete, len(event.Upgrade))
+			}
+		})
+	}
+}
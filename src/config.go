@@ -0,0 +1,59 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// Daemon configuration file (JSON)
+type Config struct {
+	Alerts             AlertConfig               `json:"alerts"`
+	MaintenanceWindows []MaintenanceWindowConfig `json:"maintenance_windows"`
+	OriginPatterns     []OriginPatternConfig     `json:"origin_patterns"`
+}
+
+// Loads the configuration file
+// A missing file is only an error when the path was chosen by the user, the default location is optional
+func loadConfig(configPath string, required bool) (config Config, err error) {
+	loaded, err := readJSONFile(configPath, required, &config)
+	if err != nil {
+		err = fmt.Errorf("invalid configuration file %s: %v", configPath, err)
+		return
+	}
+
+	if loaded {
+		printMessage(verbosityProgress, "Loaded configuration from %s\n", configPath)
+	} else {
+		printMessage(verbosityProgress, "No configuration file at %s, using defaults\n", configPath)
+	}
+	return
+}
+
+// Decodes a JSON file into value, rejecting unknown fields
+// A missing file is not an error unless required, loaded reports if the file existed
+func readJSONFile(path string, required bool, value any) (loaded bool, err error) {
+	file, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		err = nil
+		return
+	} else if err != nil {
+		err = fmt.Errorf("failed to read file: %v", err)
+		return
+	}
+
+	// Typos in option names should not be silently ignored
+	decoder := json.NewDecoder(bytes.NewReader(file))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(value)
+	if err != nil {
+		return
+	}
+
+	loaded = true
+	return
+}
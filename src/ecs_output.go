@@ -0,0 +1,203 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Elastic Common Schema version the documents follow
+const ecsVersion string = "8.11.0"
+
+// ECS document describing one package change of an event
+// Custom fields without an ECS equivalent are kept under 'apthl'
+type ecsDocument struct {
+	Timestamp string      `json:"@timestamp"`
+	ECS       ecsMetadata `json:"ecs"`
+	Event     ecsEvent    `json:"event"`
+	Host      ecsHost     `json:"host"`
+	User      *ecsUser    `json:"user,omitempty"`
+	Process   *ecsProcess `json:"process,omitempty"`
+	Package   *ecsPackage `json:"package,omitempty"`
+	Error     *ecsError   `json:"error,omitempty"`
+	Log       *ecsLog     `json:"log,omitempty"`
+	Message   string      `json:"message"`
+	APTHL     ecsAPTHL    `json:"apthl"`
+}
+
+type ecsMetadata struct {
+	Version string `json:"version"`
+}
+
+type ecsEvent struct {
+	ID       string   `json:"id"` // Shared by all documents of the same APT event
+	Kind     string   `json:"kind"`
+	Category []string `json:"category"`
+	Type     []string `json:"type"`
+	Action   string   `json:"action"`
+	Outcome  string   `json:"outcome"`
+	Module   string   `json:"module"`
+	Dataset  string   `json:"dataset"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Duration int64    `json:"duration"`           // Nanoseconds
+	Original string   `json:"original,omitempty"` // Raw event lines (--raw)
+}
+
+type ecsHost struct {
+	Hostname     string `json:"hostname,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	OS           ecsOS  `json:"os"`
+}
+
+type ecsOS struct {
+	Family   string `json:"family,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Kernel   string `json:"kernel,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	Type     string `json:"type"`
+}
+
+type ecsUser struct {
+	Name string `json:"name,omitempty"`
+	ID   string `json:"id,omitempty"`
+}
+
+type ecsProcess struct {
+	CommandLine string `json:"command_line"`
+}
+
+type ecsPackage struct {
+	Name         string `json:"name"`
+	Version      string `json:"version,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	Type         string `json:"type"`
+}
+
+type ecsError struct {
+	Message string `json:"message"`
+}
+
+// Position of the event in the history log (--source)
+type ecsLog struct {
+	File   ecsLogFile `json:"file"`
+	Offset int64      `json:"offset"`
+}
+
+type ecsLogFile struct {
+	Path string `json:"path,omitempty"`
+}
+
+type ecsAPTHL struct {
+	EventID         string `json:"event_id"`
+	Operation       string `json:"operation,omitempty"`
+	PreviousVersion string `json:"previous_version,omitempty"`
+	TotalPackages   int    `json:"total_packages"`
+	PackageIndex    int    `json:"package_index,omitempty"`
+	PackageTotal    int    `json:"package_total,omitempty"`
+}
+
+// ECS event types for each APT operation
+var ecsEventTypes = map[string][]string{
+	"install":   {"installation"},
+	"reinstall": {"installation", "change"},
+	"upgrade":   {"change"},
+	"downgrade": {"change"},
+	"remove":    {"deletion"},
+	"purge":     {"deletion"},
+}
+
+func newECSHost(host hostInfo) (ecs ecsHost) {
+	ecs = ecsHost{
+		Hostname:     host.hostname,
+		Name:         host.hostname,
+		Architecture: host.architecture,
+		OS: ecsOS{
+			Family:   "debian",
+			Name:     host.osName,
+			Version:  host.osVersion,
+			Kernel:   host.kernel,
+			Platform: host.osID,
+			Type:     "linux",
+		},
+	}
+	return
+}
+
+// Maps an event to ECS documents, one per package
+// Events without packages still produce a single document
+func ecsDocuments(log LogJSON, host ecsHost) (documents []ecsDocument) {
+	base := ecsDocument{
+		Timestamp: log.StartTimestamp,
+		ECS:       ecsMetadata{Version: ecsVersion},
+		Event: ecsEvent{
+			ID:       log.EventID,
+			Kind:     "event",
+			Category: []string{"package"},
+			Type:     []string{"info"},
+			Action:   "apt",
+			Outcome:  "success",
+			Module:   "apthl",
+			Dataset:  "apthl.history",
+			Start:    log.StartTimestamp,
+			End:      log.EndTimeStamp,
+			Duration: int64(log.ElapsedSeconds) * int64(time.Second),
+			Original: log.Raw,
+		},
+		Host: host,
+		APTHL: ecsAPTHL{
+			EventID:       log.EventID,
+			TotalPackages: log.TotalPackages,
+			PackageIndex:  log.PackageIndex,
+			PackageTotal:  log.PackageTotal,
+		},
+	}
+
+	if log.RequestedBy != "" {
+		base.User = &ecsUser{Name: log.RequestedBy, ID: strconv.Itoa(log.RequestedByUID)}
+	}
+	if log.CommandLine != "" {
+		base.Process = &ecsProcess{CommandLine: log.CommandLine}
+	}
+	if log.Error != "" {
+		base.Event.Outcome = "failure"
+		base.Error = &ecsError{Message: log.Error}
+	}
+	if log.Source != nil {
+		base.Log = &ecsLog{File: ecsLogFile{Path: log.Source.File}, Offset: log.Source.StartOffset}
+	}
+
+	for _, opList := range log.OperationLists() {
+		for _, pkg := range *opList.Packages {
+			document := base
+			document.Event.Type = ecsEventTypes[opList.Name]
+			document.Event.Action = "package-" + opList.Name
+			document.Package = &ecsPackage{
+				Name:         pkg.Name,
+				Version:      pkg.Version,
+				Architecture: pkg.Arch,
+				Type:         "deb",
+			}
+			document.APTHL.Operation = opList.Name
+			document.APTHL.PreviousVersion = pkg.OldVersion
+
+			document.Message = fmt.Sprintf("%s %s %s", opList.Name, pkg.Name, pkg.Version)
+			if pkg.OldVersion != "" {
+				document.Message = fmt.Sprintf("%s %s %s -> %s", opList.Name, pkg.Name, pkg.OldVersion, pkg.Version)
+			}
+			documents = append(documents, document)
+		}
+	}
+
+	if len(documents) == 0 {
+		base.Message = "apt " + log.CommandLine
+		if log.Error != "" {
+			base.Message = "apt error: " + log.Error
+		}
+		documents = append(documents, base)
+	}
+	return
+}
@@ -0,0 +1,210 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// What the daemon does when the event hook fails
+//
+//	ignore - report the failure and move on
+//	retry  - run the hook again a few times with increasing delays, in the background
+//	block  - hold up all further events until the hook succeeds, hooks then run one at a time
+var hookFailurePolicies = []string{"ignore", "retry", "block"}
+
+const (
+	hookRetryAttempts = 3                // Total runs in retry mode
+	hookRetryDelay    = 5 * time.Second  // Delay before the first retry, doubled for each further retry
+	hookMaxRetryDelay = 60 * time.Second // Longest delay between runs in block mode
+)
+
+// Runs a command for each parsed event with the event JSON on stdin
+type eventHook struct {
+	command       []string
+	timeout       time.Duration
+	failurePolicy string
+	schemaVersion int
+	retryDelay    time.Duration   // Delay before the first retry
+	slots         chan struct{}   // Limits the number of hooks running at once
+	running       *sync.WaitGroup // Held by background hooks so shutdown waits for them
+	shutdown      <-chan struct{} // Closed when the daemon is stopping, ends retries
+}
+
+// Returns nil when no hook command was given
+func newEventHook(daemonOpts DaemonOptions, running *sync.WaitGroup, shutdown <-chan struct{}) (hook *eventHook, err error) {
+	if daemonOpts.onEventCommand == "" {
+		return
+	}
+
+	// Arguments are split on spaces, there is no shell quoting
+	command := strings.Fields(daemonOpts.onEventCommand)
+	if len(command) == 0 {
+		err = fmt.Errorf("event hook command is empty")
+		return
+	}
+	_, err = exec.LookPath(command[0])
+	if err != nil {
+		err = fmt.Errorf("event hook command: %v", err)
+		return
+	}
+	if !slices.Contains(hookFailurePolicies, daemonOpts.onEventFailure) {
+		err = fmt.Errorf("unknown failure policy '%s': must be one of %s", daemonOpts.onEventFailure, strings.Join(hookFailurePolicies, ", "))
+		return
+	}
+	if daemonOpts.onEventTimeout <= 0 {
+		err = fmt.Errorf("timeout must be positive")
+		return
+	}
+	if daemonOpts.onEventJobs < 1 {
+		err = fmt.Errorf("concurrency limit must be at least 1")
+		return
+	}
+
+	hook = &eventHook{
+		command:       command,
+		timeout:       daemonOpts.onEventTimeout,
+		failurePolicy: daemonOpts.onEventFailure,
+		schemaVersion: daemonOpts.schemaVersion,
+		retryDelay:    hookRetryDelay,
+		slots:         make(chan struct{}, daemonOpts.onEventJobs),
+		running:       running,
+		shutdown:      shutdown,
+	}
+	return
+}
+
+// Starts the hook for an event
+// In block mode this waits until the hook succeeds, handled is false if the daemon began stopping before it did
+func (hook *eventHook) handle(log LogJSON) (handled bool) {
+	handled = true
+	if hook == nil {
+		return
+	}
+
+	payload, err := apthistory.MarshalEvent(log, hook.schemaVersion)
+	if err != nil {
+		printMessage(verbosityNone, "Failed to encode event %s for event hook: %v\n", log.EventID, err)
+		return
+	}
+	environment := hookEnvironment(log)
+
+	if hook.failurePolicy == "block" {
+		delay := hook.retryDelay
+		for {
+			err = hook.run(payload, environment)
+			if err == nil {
+				return
+			}
+			printMessage(verbosityNone, "Event hook failed for event %s, retrying in %s: %v\n", log.EventID, delay, err)
+
+			if !hook.wait(delay) {
+				handled = false
+				return
+			}
+			delay = min(delay*2, hookMaxRetryDelay)
+		}
+	}
+
+	attempts := 1
+	if hook.failurePolicy == "retry" {
+		attempts = hookRetryAttempts
+	}
+
+	// Waits here while the concurrency limit is reached
+	hook.slots <- struct{}{}
+	hook.running.Add(1)
+	go func() {
+		defer hook.running.Done()
+		defer func() { <-hook.slots }()
+
+		delay := hook.retryDelay
+		for attempt := 1; ; attempt++ {
+			err := hook.run(payload, environment)
+			if err == nil {
+				return
+			}
+			if attempt >= attempts {
+				printMessage(verbosityNone, "Event hook failed for event %s: %v\n", log.EventID, err)
+				return
+			}
+
+			printMessage(verbosityNone, "Event hook failed for event %s, retrying in %s: %v\n", log.EventID, delay, err)
+			if !hook.wait(delay) {
+				return
+			}
+			delay *= 2
+		}
+	}()
+	return
+}
+
+// Sleeps between retries, returning false if the daemon is stopping
+func (hook *eventHook) wait(delay time.Duration) (keepRunning bool) {
+	select {
+	case <-time.After(delay):
+		keepRunning = true
+	case <-hook.shutdown:
+	}
+	return
+}
+
+func (hook *eventHook) run(payload []byte, environment []string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hook.timeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, hook.command[0], hook.command[1:]...)
+	command.Stdin = bytes.NewReader(payload)
+	command.Env = append(os.Environ(), environment...)
+
+	// Children of the hook hold its output open, the whole process group is killed on timeout
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	command.Cancel = func() error {
+		return syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+	}
+	command.WaitDelay = time.Second
+
+	output, err := command.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", hook.timeout)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+		return
+	}
+	return
+}
+
+// Key event fields for the hook command
+//
+//	APTHL_EVENT_ID   - event ID
+//	APTHL_OPERATIONS - operations in the event, comma separated (install,upgrade)
+//	APTHL_PACKAGES   - names of all packages in the event, space separated
+func hookEnvironment(log LogJSON) (environment []string) {
+	var operations, packages []string
+	for _, opList := range log.OperationLists() {
+		if len(*opList.Packages) > 0 {
+			operations = append(operations, opList.Name)
+		}
+		for _, pkg := range *opList.Packages {
+			packages = append(packages, pkg.Name)
+		}
+	}
+
+	environment = []string{
+		"APTHL_EVENT_ID=" + log.EventID,
+		"APTHL_OPERATIONS=" + strings.Join(operations, ","),
+		"APTHL_PACKAGES=" + strings.Join(packages, " "),
+	}
+	return
+}
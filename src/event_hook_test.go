@@ -0,0 +1,211 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHookEnvironment(t *testing.T) {
+	tests := []struct {
+		name string
+		log  LogJSON
+		want []string
+	}{
+		{
+			name: "Multiple operations",
+			log: LogJSON{
+				EventID: "dff93eca-68fc-4dd1-4150-965131c044f9",
+				Remove:  []PackageInfo{{Name: "inetutils-telnet", Arch: "amd64", Version: "2.4-2"}},
+				Purge:   []PackageInfo{{Name: "telnet", Arch: "all", Version: "0.17+2.4-2"}},
+			},
+			want: []string{"APTHL_EVENT_ID=dff93eca-68fc-4dd1-4150-965131c044f9", "APTHL_OPERATIONS=remove,purge", "APTHL_PACKAGES=inetutils-telnet telnet"},
+		},
+		{
+			name: "No packages",
+			log:  LogJSON{EventID: "be15fb0b-7dff-cb97-8bf2-2bbada2040f4", Error: "Sub-process returned an error code"},
+			want: []string{"APTHL_EVENT_ID=be15fb0b-7dff-cb97-8bf2-2bbada2040f4", "APTHL_OPERATIONS=", "APTHL_PACKAGES="},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := hookEnvironment(test.log)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("hookEnvironment() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// Builds a hook running a shell script, the script gets a file in the test directory as $1
+func newTestHook(t *testing.T, script string, failurePolicy string, jobs int, timeout time.Duration) (hook *eventHook, runFile string, shutdown chan struct{}) {
+	runFile = filepath.Join(t.TempDir(), "runs")
+	shutdown = make(chan struct{})
+	hook = &eventHook{
+		command:       []string{"/bin/sh", "-c", script, "hook", runFile},
+		timeout:       timeout,
+		failurePolicy: failurePolicy,
+		schemaVersion: 1,
+		retryDelay:    10 * time.Millisecond,
+		slots:         make(chan struct{}, jobs),
+		running:       &sync.WaitGroup{},
+		shutdown:      shutdown,
+	}
+	return
+}
+
+// Lines the hook script wrote to its run file
+func hookRuns(t *testing.T, runFile string) (lines []string) {
+	content, err := os.ReadFile(runFile)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("failed to read hook run file: %v", err)
+	}
+	lines = strings.Fields(string(content))
+	return
+}
+
+func TestEventHookFailurePolicies(t *testing.T) {
+	const failingScript = `echo run >> "$1"; exit 1`
+	// Fails on the first two runs, succeeds on the third
+	const flakyScript = `echo run >> "$1"; [ "$(wc -l < "$1")" -ge 3 ]`
+
+	tests := []struct {
+		name          string
+		script        string
+		failurePolicy string
+		wantHandled   bool
+		wantRuns      int
+	}{
+		{name: "Ignore runs once", script: failingScript, failurePolicy: "ignore", wantHandled: true, wantRuns: 1},
+		{name: "Retry gives up", script: failingScript, failurePolicy: "retry", wantHandled: true, wantRuns: hookRetryAttempts},
+		{name: "Retry stops on success", script: `echo run >> "$1"; [ "$(wc -l < "$1")" -ge 2 ]`, failurePolicy: "retry", wantHandled: true, wantRuns: 2},
+		{name: "Block waits for success", script: flakyScript, failurePolicy: "block", wantHandled: true, wantRuns: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hook, runFile, _ := newTestHook(t, test.script, test.failurePolicy, 1, 5*time.Second)
+
+			handled := hook.handle(LogJSON{EventID: "be15fb0b-7dff-cb97-8bf2-2bbada2040f4"})
+			hook.running.Wait()
+
+			if handled != test.wantHandled {
+				t.Errorf("handle() = %t, want %t", handled, test.wantHandled)
+			}
+			runs := hookRuns(t, runFile)
+			if len(runs) != test.wantRuns {
+				t.Errorf("hook ran %d times, want %d", len(runs), test.wantRuns)
+			}
+		})
+	}
+}
+
+func TestEventHookBlockShutdown(t *testing.T) {
+	hook, runFile, shutdown := newTestHook(t, `echo run >> "$1"; exit 1`, "block", 1, 5*time.Second)
+	hook.retryDelay = time.Minute
+
+	handled := make(chan bool)
+	go func() {
+		handled <- hook.handle(LogJSON{EventID: "be15fb0b-7dff-cb97-8bf2-2bbada2040f4"})
+	}()
+
+	// A failing blocking hook holds up the event until the daemon stops
+	select {
+	case <-handled:
+		t.Fatalf("handle() returned before shutdown")
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(shutdown)
+
+	select {
+	case got := <-handled:
+		if got {
+			t.Errorf("handle() = true after shutdown, want false")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("handle() did not return after shutdown")
+	}
+	runs := hookRuns(t, runFile)
+	if len(runs) != 1 {
+		t.Errorf("hook ran %d times, want 1", len(runs))
+	}
+}
+
+func TestEventHookTimeout(t *testing.T) {
+	hook, runFile, _ := newTestHook(t, `sleep 10; echo run >> "$1"`, "ignore", 1, 100*time.Millisecond)
+
+	startTime := time.Now()
+	err := hook.run(nil, nil)
+	elapsed := time.Since(startTime)
+
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("run() error = %v, want timeout", err)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("run() took %s, want it stopped at the timeout", elapsed)
+	}
+	runs := hookRuns(t, runFile)
+	if len(runs) != 0 {
+		t.Errorf("hook finished %d times, want it killed", len(runs))
+	}
+}
+
+func TestEventHookConcurrencyLimit(t *testing.T) {
+	const jobs = 2
+	// Records when each run starts and ends
+	hook, runFile, _ := newTestHook(t, `echo start >> "$1"; sleep 0.2; echo end >> "$1"`, "ignore", jobs, 5*time.Second)
+
+	for range 3 * jobs {
+		hook.handle(LogJSON{EventID: "be15fb0b-7dff-cb97-8bf2-2bbada2040f4"})
+	}
+	hook.running.Wait()
+
+	var active, maxActive int
+	runs := hookRuns(t, runFile)
+	for _, run := range runs {
+		if run == "start" {
+			active++
+			maxActive = max(maxActive, active)
+		} else {
+			active--
+		}
+	}
+	if len(runs) != 2*3*jobs {
+		t.Errorf("hook wrote %d lines, want %d", len(runs), 2*3*jobs)
+	}
+	if maxActive != jobs {
+		t.Errorf("%d hooks ran at once, want %d", maxActive, jobs)
+	}
+}
+
+func TestNewEventHookValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		daemonOpts DaemonOptions
+		wantHook   bool
+		wantErr    bool
+	}{
+		{name: "No command", daemonOpts: DaemonOptions{}},
+		{name: "Blank command", daemonOpts: DaemonOptions{onEventCommand: "  \t "}, wantErr: true},
+		{name: "Unknown policy", daemonOpts: DaemonOptions{onEventCommand: "/bin/true", onEventFailure: "later", onEventTimeout: time.Second, onEventJobs: 1}, wantErr: true},
+		{name: "Valid", daemonOpts: DaemonOptions{onEventCommand: "/bin/true --flag", onEventFailure: "ignore", onEventTimeout: time.Second, onEventJobs: 1}, wantHook: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hook, err := newEventHook(test.daemonOpts, &sync.WaitGroup{}, make(chan struct{}))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newEventHook() error = %v, want error %t", err, test.wantErr)
+			}
+			if (hook != nil) != test.wantHook {
+				t.Errorf("newEventHook() hook = %v, want hook %t", hook, test.wantHook)
+			}
+		})
+	}
+}
@@ -0,0 +1,563 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Local event store
+//
+// Events are appended as JSON lines to the data file, and every event gets one line in the index file:
+//
+//	<data offset> TAB <data length> TAB <start unix time> TAB <event id> TAB <user> TAB <operations,...> TAB <packages,...>
+//
+// The index file is small enough to load completely, secondary indexes are built from it in memory.
+// Data is always written before its index line, so a reader never sees an index entry for incomplete data.
+//
+// Writers hold the lock file next to the index directory, so a rebuild never replaces the directory in the middle of an append.
+const (
+	eventIndexDataFile  string = "events.ndjson"
+	eventIndexIndexFile string = "events.idx"
+	eventIndexLockFile  string = "index.lock"
+)
+
+type eventIndex struct {
+	directory   string
+	entries     []indexEntry
+	eventIDs    map[string]int   // Event ID to entry position
+	byPackage   map[string][]int // Package name to entry positions
+	byUser      map[string][]int // User name to entry positions
+	byOperation map[string][]int // Operation name to entry positions
+	byStart     []int            // Entry positions ordered by start time
+	indexInode  uint64           // Index file the entries were loaded from, to notice a rebuild replacing it
+	indexSize   int64            // Size of the index file including the loaded and appended entries
+}
+
+type indexEntry struct {
+	offset  int64
+	length  int64
+	start   time.Time
+	eventID string
+}
+
+// Set of entry positions
+type indexCandidates map[int]struct{}
+
+// Loads index from directory, an index that does not exist yet is empty
+func loadEventIndex(directory string) (index *eventIndex, err error) {
+	index = &eventIndex{
+		directory:   directory,
+		eventIDs:    make(map[string]int),
+		byPackage:   make(map[string][]int),
+		byUser:      make(map[string][]int),
+		byOperation: make(map[string][]int),
+	}
+
+	indexFile, err := os.Open(filepath.Join(directory, eventIndexIndexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = fmt.Errorf("failed to open index file: %v", err)
+		}
+		return
+	}
+	defer indexFile.Close()
+
+	index.indexInode, index.indexSize, err = fileIdentity(indexFile)
+	if err != nil {
+		return
+	}
+
+	indexReader := bufio.NewReader(indexFile)
+	for {
+		line, readErr := indexReader.ReadString('\n')
+		if readErr == io.EOF {
+			// Ignore partial line still being written
+			break
+		}
+		if readErr != nil {
+			err = fmt.Errorf("failed to read index file: %v", readErr)
+			return
+		}
+
+		err = index.loadLine(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			err = fmt.Errorf("corrupt index entry %d: %v", len(index.entries)+1, err)
+			return
+		}
+	}
+
+	index.sortByStart()
+	return
+}
+
+// Adds a single index file line to the in-memory indexes
+func (index *eventIndex) loadLine(line string) (err error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 7 {
+		err = fmt.Errorf("expected 7 fields, found %d", len(fields))
+		return
+	}
+
+	var entry indexEntry
+	entry.offset, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return
+	}
+	entry.length, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return
+	}
+	startUnix, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return
+	}
+	entry.start = time.Unix(startUnix, 0)
+	entry.eventID = fields[3]
+
+	position := len(index.entries)
+	index.entries = append(index.entries, entry)
+	index.eventIDs[entry.eventID] = position
+	index.byUser[fields[4]] = append(index.byUser[fields[4]], position)
+	for _, operation := range splitIndexList(fields[5]) {
+		index.byOperation[operation] = append(index.byOperation[operation], position)
+	}
+	for _, pkgName := range splitIndexList(fields[6]) {
+		index.byPackage[pkgName] = append(index.byPackage[pkgName], position)
+	}
+	return
+}
+
+func splitIndexList(field string) (list []string) {
+	if field == "" {
+		return
+	}
+	list = strings.Split(field, ",")
+	return
+}
+
+func (index *eventIndex) sortByStart() {
+	index.byStart = make([]int, len(index.entries))
+	for position := range index.entries {
+		index.byStart[position] = position
+	}
+
+	slices.SortStableFunc(index.byStart, func(a, b int) int {
+		return index.entries[a].start.Compare(index.entries[b].start)
+	})
+}
+
+// Stores event in the index, events already present are skipped
+func (index *eventIndex) appendEvent(log LogJSON) (err error) {
+	start, err := time.Parse(time.RFC3339, log.StartTimestamp)
+	if err != nil {
+		err = fmt.Errorf("failed parsing start time: %v", err)
+		return
+	}
+
+	unlockIndex, err := lockEventIndex(index.directory)
+	if err != nil {
+		return
+	}
+	defer unlockIndex()
+
+	err = index.reloadIfReplaced()
+	if err != nil {
+		return
+	}
+
+	if _, exists := index.eventIDs[log.EventID]; exists {
+		printMessage(verbosityData, "Event %s already in index\n", log.EventID)
+		return
+	}
+
+	err = os.MkdirAll(index.directory, 0755)
+	if err != nil {
+		err = fmt.Errorf("failed to create index directory: %v", err)
+		return
+	}
+
+	// Log positions go stale once the log rotates, indexed events are kept without them
+	log.Source = nil
+	log.Raw = ""
+
+	jsonLine, err := json.Marshal(log)
+	if err != nil {
+		err = fmt.Errorf("invalid JSON: %v", err)
+		return
+	}
+	jsonLine = append(jsonLine, '\n')
+
+	// Files are opened per event under the lock so a rebuild replacing them is picked up
+	dataFile, err := os.OpenFile(filepath.Join(index.directory, eventIndexDataFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		err = fmt.Errorf("failed to open index data file: %v", err)
+		return
+	}
+	defer dataFile.Close()
+
+	dataInfo, err := dataFile.Stat()
+	if err != nil {
+		err = fmt.Errorf("failed to stat index data file: %v", err)
+		return
+	}
+
+	_, err = dataFile.Write(jsonLine)
+	if err != nil {
+		err = fmt.Errorf("failed to write index data file: %v", err)
+		return
+	}
+
+	var operations []string
+	var packages []string
+	for _, opList := range log.OperationLists() {
+		if len(*opList.Packages) == 0 {
+			continue
+		}
+		operations = append(operations, opList.Name)
+		for _, pkg := range *opList.Packages {
+			if !slices.Contains(packages, pkg.Name) {
+				packages = append(packages, pkg.Name)
+			}
+		}
+	}
+
+	// Index file must never have separators inside fields
+	user := strings.NewReplacer("\t", " ", "\n", " ", ",", " ").Replace(log.RequestedBy)
+
+	indexLine := fmt.Sprintf("%d\t%d\t%d\t%s\t%s\t%s\t%s", dataInfo.Size(), len(jsonLine), start.Unix(), log.EventID, user, strings.Join(operations, ","), strings.Join(packages, ","))
+
+	indexFile, err := os.OpenFile(filepath.Join(index.directory, eventIndexIndexFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		err = fmt.Errorf("failed to open index file: %v", err)
+		return
+	}
+	defer indexFile.Close()
+
+	_, err = indexFile.WriteString(indexLine + "\n")
+	if err != nil {
+		err = fmt.Errorf("failed to write index file: %v", err)
+		return
+	}
+
+	index.indexInode, index.indexSize, err = fileIdentity(indexFile)
+	if err != nil {
+		return
+	}
+
+	err = index.loadLine(indexLine)
+	if err != nil {
+		return
+	}
+
+	// Events almost always arrive in time order, only resort when they do not
+	position := len(index.entries) - 1
+	if len(index.byStart) > 0 && index.entries[index.byStart[len(index.byStart)-1]].start.After(start) {
+		index.sortByStart()
+	} else {
+		index.byStart = append(index.byStart, position)
+	}
+	return
+}
+
+// Reloads the entries when the index file changed since they were loaded, like after --rebuild-index replaced it
+// Must be called with the index locked
+func (index *eventIndex) reloadIfReplaced() (err error) {
+	var inode uint64
+	var size int64
+	indexFile, err := os.Open(filepath.Join(index.directory, eventIndexIndexFile))
+	if err == nil {
+		inode, size, err = fileIdentity(indexFile)
+		indexFile.Close()
+		if err != nil {
+			return
+		}
+	} else if os.IsNotExist(err) {
+		// Removed by a rebuild that found no events
+		err = nil
+	} else {
+		err = fmt.Errorf("failed to open index file: %v", err)
+		return
+	}
+
+	if inode == index.indexInode && size == index.indexSize {
+		return
+	}
+
+	printMessage(verbosityProgress, "Index file changed, reloading index\n")
+	reloadedIndex, err := loadEventIndex(index.directory)
+	if err != nil {
+		return
+	}
+	*index = *reloadedIndex
+	return
+}
+
+// Inode and size of an open file
+func fileIdentity(file *os.File) (inode uint64, size int64, err error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		err = fmt.Errorf("failed to stat %s: %v", file.Name(), err)
+		return
+	}
+	inode = fileInfo.Sys().(*syscall.Stat_t).Ino
+	size = fileInfo.Size()
+	return
+}
+
+// Waits for exclusive use of the index directory, closing the lock file with unlock releases it
+func lockEventIndex(directory string) (unlock func(), err error) {
+	parentDirectory := filepath.Dir(directory)
+	err = os.MkdirAll(parentDirectory, 0755)
+	if err != nil {
+		err = fmt.Errorf("failed to create index parent directory: %v", err)
+		return
+	}
+
+	lockFile, err := os.OpenFile(filepath.Join(parentDirectory, eventIndexLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		err = fmt.Errorf("failed to open index lock file: %v", err)
+		return
+	}
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		lockFile.Close()
+		err = fmt.Errorf("failed to lock index: %v", err)
+		return
+	}
+
+	unlock = func() { lockFile.Close() }
+	return
+}
+
+// Answers a search from the index, passing matches to emit in the requested time order
+// Secondary indexes narrow down the candidate events, every candidate is still checked against the full search
+func (index *eventIndex) search(searchParams SearchParameters, order string, emit func(LogJSON) bool) (err error) {
+	if len(index.entries) == 0 {
+		err = fmt.Errorf("index is empty, build it with --rebuild-index")
+		return
+	}
+
+	candidates, narrowed := index.candidates(searchParams.matcher.Root)
+
+	dataFile, err := os.Open(filepath.Join(index.directory, eventIndexDataFile))
+	if err != nil {
+		err = fmt.Errorf("failed to open index data file: %v", err)
+		return
+	}
+	defer dataFile.Close()
+
+	// Time window from the ordered start times
+	firstPosition, _ := slices.BinarySearchFunc(index.byStart, searchParams.startTimestamp, func(position int, target time.Time) int {
+		return index.entries[position].start.Compare(target)
+	})
+	lastPosition, _ := slices.BinarySearchFunc(index.byStart, searchParams.endTimestamp, func(position int, target time.Time) int {
+		if index.entries[position].start.After(target) {
+			return 1
+		}
+		return -1
+	})
+	window := index.byStart[firstPosition:lastPosition]
+
+	printMessage(verbosityProgress, "Index has %d events, %d in time window\n", len(index.entries), len(window))
+
+	for step := range window {
+		position := window[step]
+		if order == "desc" {
+			position = window[len(window)-1-step]
+		}
+
+		if narrowed {
+			if _, isCandidate := candidates[position]; !isCandidate {
+				continue
+			}
+		}
+
+		var log LogJSON
+		log, err = index.readEvent(dataFile, position)
+		if err != nil {
+			return
+		}
+
+		var searchMatched bool
+		var matchedLog LogJSON
+		searchMatched, matchedLog, err = searchParams.matcher.Match(log)
+		if err != nil {
+			err = fmt.Errorf("failed to search in indexed event: %v", err)
+			return
+		}
+
+		if searchMatched && !emit(matchedLog) {
+			return
+		}
+	}
+	return
+}
+
+func (index *eventIndex) readEvent(dataFile *os.File, position int) (log LogJSON, err error) {
+	entry := index.entries[position]
+
+	record := make([]byte, entry.length)
+	_, err = dataFile.ReadAt(record, entry.offset)
+	if err != nil {
+		err = fmt.Errorf("failed to read event %s from index data file: %v", entry.eventID, err)
+		return
+	}
+
+	err = json.Unmarshal(record, &log)
+	if err != nil {
+		err = fmt.Errorf("corrupt event %s in index data file: %v", entry.eventID, err)
+		return
+	}
+	fillCommandFields(&log)
+	return
+}
+
+// Determines the entries that can possibly match the query using the secondary indexes
+// Narrowed is false when the query cannot be answered from the indexes and every entry needs checking
+func (index *eventIndex) candidates(node apthistory.Node) (candidates indexCandidates, narrowed bool) {
+	switch typedNode := node.(type) {
+	case apthistory.AndNode:
+		left, leftNarrowed := index.candidates(typedNode.Left)
+		right, rightNarrowed := index.candidates(typedNode.Right)
+		if leftNarrowed && rightNarrowed {
+			candidates = make(indexCandidates)
+			for position := range left {
+				if _, inBoth := right[position]; inBoth {
+					candidates[position] = struct{}{}
+				}
+			}
+			narrowed = true
+		} else if leftNarrowed {
+			candidates, narrowed = left, true
+		} else if rightNarrowed {
+			candidates, narrowed = right, true
+		}
+	case apthistory.OrNode:
+		left, leftNarrowed := index.candidates(typedNode.Left)
+		right, rightNarrowed := index.candidates(typedNode.Right)
+		if leftNarrowed && rightNarrowed {
+			candidates = left
+			for position := range right {
+				candidates[position] = struct{}{}
+			}
+			narrowed = true
+		}
+	case apthistory.CompareNode:
+		var postings map[string][]int
+		switch typedNode.Field {
+		case "pkg":
+			postings = index.byPackage
+		case "user":
+			postings = index.byUser
+		case "op":
+			postings = index.byOperation
+		default:
+			return
+		}
+
+		switch typedNode.Operator {
+		case "=":
+			candidates = make(indexCandidates)
+			for _, position := range postings[typedNode.Value] {
+				candidates[position] = struct{}{}
+			}
+			narrowed = true
+		case "~":
+			// Regexes are checked against each distinct key, which is far fewer than events
+			candidates = make(indexCandidates)
+			for key, positions := range postings {
+				if !typedNode.Regex.MatchString(key) {
+					continue
+				}
+				for _, position := range positions {
+					candidates[position] = struct{}{}
+				}
+			}
+			narrowed = true
+		}
+	}
+	return
+}
+
+// Replaces the index with all events found in the given log files
+func rebuildEventIndex(inputPath string, configPath string) {
+	// Events are indexed with the origins of the configured patterns
+	config, err := loadConfig(configPath, configPath != defaultConfigPath)
+	logError("Failed to load configuration", err)
+	err = configureHistoryParser(config.OriginPatterns, false, false)
+	logError("Invalid origin pattern configuration", err)
+
+	// Include rotated archives of a single log file
+	searchPaths, err := collectLogArchivePaths(inputPath)
+	logError("Failed to read input file choice", err)
+
+	temporaryDirectory := eventIndexDirectory + ".rebuild"
+	err = os.RemoveAll(temporaryDirectory)
+	logError("Failed to clear previous index rebuild", err)
+
+	newIndex, err := loadEventIndex(temporaryDirectory)
+	logError("Failed to create new index", err)
+
+	for _, searchPath := range searchPaths {
+		printMessage(verbosityProgress, "Indexing events from %s\n", searchPath)
+
+		err = readLogEvents(searchPath, func(log LogJSON) (keepReading bool, err error) {
+			err = newIndex.appendEvent(log)
+			keepReading = true
+			return
+		})
+		logError("Failed to index log file", err)
+	}
+
+	if dryRunRequested {
+		printMessage(verbosityStandard, "Dry-run requested, not replacing index. Found %d events\n", len(newIndex.entries))
+		err = os.RemoveAll(temporaryDirectory)
+		logError("Failed to remove rebuilt index", err)
+		return
+	}
+
+	// A running daemon waits to append until the directories are swapped
+	unlockIndex, err := lockEventIndex(eventIndexDirectory)
+	logError("Failed to lock index", err)
+
+	oldDirectory := eventIndexDirectory + ".old"
+	err = os.RemoveAll(oldDirectory)
+	logError("Failed to clear previous old index", err)
+
+	err = os.Rename(eventIndexDirectory, oldDirectory)
+	if err != nil && !os.IsNotExist(err) {
+		logError("Failed to move old index aside", err)
+	}
+
+	if len(newIndex.entries) > 0 {
+		err = os.Rename(temporaryDirectory, eventIndexDirectory)
+		logError("Failed to replace index", err)
+	}
+	unlockIndex()
+
+	err = os.RemoveAll(oldDirectory)
+	logError("Failed to remove old index", err)
+
+	if len(newIndex.entries) == 0 {
+		printMessage(verbosityStandard, "No events found to index\n")
+		err = os.RemoveAll(temporaryDirectory)
+		logError("Failed to remove rebuilt index", err)
+		return
+	}
+
+	printMessage(verbosityStandard, "Indexed %d events\n", len(newIndex.entries))
+}
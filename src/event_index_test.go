@@ -0,0 +1,114 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEventIndexAppendWaitsForLock(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "index")
+	index, err := loadEventIndex(directory)
+	if err != nil {
+		t.Fatalf("loadEventIndex() unexpected error = %v", err)
+	}
+
+	// Held like a rebuild swapping the index directories
+	unlockIndex, err := lockEventIndex(directory)
+	if err != nil {
+		t.Fatalf("lockEventIndex() unexpected error = %v", err)
+	}
+
+	appended := make(chan error)
+	go func() {
+		appended <- index.appendEvent(LogJSON{
+			EventID:        "be15fb0b-7dff-cb97-8bf2-2bbada2040f4",
+			StartTimestamp: "2025-06-01T10:00:00Z",
+			Install:        []PackageInfo{{Name: "nginx", Arch: "amd64", Version: "1.22.1-9"}},
+		})
+	}()
+
+	select {
+	case <-appended:
+		unlockIndex()
+		t.Fatalf("appendEvent() finished while the index was locked")
+	case <-time.After(200 * time.Millisecond):
+	}
+	unlockIndex()
+
+	select {
+	case err = <-appended:
+		if err != nil {
+			t.Fatalf("appendEvent() unexpected error = %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("appendEvent() did not finish after unlock")
+	}
+
+	reloaded, err := loadEventIndex(directory)
+	if err != nil {
+		t.Fatalf("loadEventIndex() unexpected error = %v", err)
+	}
+	if len(reloaded.entries) != 1 {
+		t.Errorf("index has %d entries, want 1", len(reloaded.entries))
+	}
+}
+
+func TestEventIndexReloadAfterRebuild(t *testing.T) {
+	parentDirectory := t.TempDir()
+	directory := filepath.Join(parentDirectory, "index")
+	firstEvent := LogJSON{EventID: "be15fb0b-7dff-cb97-8bf2-2bbada2040f4", StartTimestamp: "2025-06-01T10:00:00Z"}
+	secondEvent := LogJSON{EventID: "92cc42af-7d5a-e8ee-8245-1689698e0730", StartTimestamp: "2025-06-02T03:00:00Z"}
+
+	daemonIndex, err := loadEventIndex(directory)
+	if err != nil {
+		t.Fatalf("loadEventIndex() unexpected error = %v", err)
+	}
+	err = daemonIndex.appendEvent(firstEvent)
+	if err != nil {
+		t.Fatalf("appendEvent() unexpected error = %v", err)
+	}
+
+	// Rebuilt index only has the second event
+	rebuildDirectory := filepath.Join(parentDirectory, "index.rebuild")
+	rebuiltIndex, err := loadEventIndex(rebuildDirectory)
+	if err != nil {
+		t.Fatalf("loadEventIndex() unexpected error = %v", err)
+	}
+	err = rebuiltIndex.appendEvent(secondEvent)
+	if err != nil {
+		t.Fatalf("appendEvent() unexpected error = %v", err)
+	}
+	err = os.Rename(directory, filepath.Join(parentDirectory, "index.old"))
+	if err != nil {
+		t.Fatalf("failed to move index aside: %v", err)
+	}
+	err = os.Rename(rebuildDirectory, directory)
+	if err != nil {
+		t.Fatalf("failed to swap in rebuilt index: %v", err)
+	}
+
+	// The daemon has to notice the rebuilt index instead of deduplicating against what it loaded before
+	for _, event := range []LogJSON{firstEvent, secondEvent} {
+		err = daemonIndex.appendEvent(event)
+		if err != nil {
+			t.Fatalf("appendEvent() unexpected error = %v", err)
+		}
+	}
+
+	reloaded, err := loadEventIndex(directory)
+	if err != nil {
+		t.Fatalf("loadEventIndex() unexpected error = %v", err)
+	}
+	var eventIDs []string
+	for _, entry := range reloaded.entries {
+		eventIDs = append(eventIDs, entry.eventID)
+	}
+	want := []string{secondEvent.EventID, firstEvent.EventID}
+	if !slices.Equal(eventIDs, want) {
+		t.Errorf("index has events %v, want %v", eventIDs, want)
+	}
+}
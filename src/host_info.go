@@ -0,0 +1,72 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Details of the machine the events happened on, for output formats that describe the host
+type hostInfo struct {
+	hostname     string
+	osID         string // Short lowercase OS name, like 'debian'
+	osName       string
+	osVersion    string
+	kernel       string
+	architecture string
+}
+
+// Gathers host details from uname and os-release
+// Missing details are left empty, they are never required for output
+func loadHostInfo() (host hostInfo) {
+	host.hostname, _ = os.Hostname()
+
+	var uname syscall.Utsname
+	if syscall.Uname(&uname) == nil {
+		host.kernel = utsnameString(uname.Release[:])
+		host.architecture = utsnameString(uname.Machine[:])
+	}
+
+	for _, releasePath := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		releaseFile, err := os.Open(releasePath)
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(releaseFile)
+		for scanner.Scan() {
+			key, value, found := strings.Cut(scanner.Text(), "=")
+			if !found {
+				continue
+			}
+			value = strings.Trim(value, `"'`)
+
+			switch key {
+			case "ID":
+				host.osID = value
+			case "NAME":
+				host.osName = value
+			case "VERSION_ID":
+				host.osVersion = value
+			}
+		}
+		releaseFile.Close()
+		break
+	}
+	return
+}
+
+// Converts a null terminated uname field to a string
+// Field element type differs between architectures
+func utsnameString[T int8 | uint8](field []T) string {
+	var builder strings.Builder
+	for _, char := range field {
+		if char == 0 {
+			break
+		}
+		builder.WriteByte(byte(char))
+	}
+	return builder.String()
+}
@@ -0,0 +1,206 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+)
+
+// Header signature of binary journal files
+var journalFileMagic = []byte("LPKSHHRH")
+
+// Field line of the journal export format (KEY=value)
+var journalFieldRegex = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*=`)
+
+// Name journald records for apthl's stdout
+const journalIdentifier string = "apthl"
+
+// Parses `journalctl -o export` streams
+// Entries are separated by blank lines, fields are either KEY=value lines or binary-safe KEY\n<uint64 size><data>\n
+func readJournalExportEvents(logReader *bufio.Reader, handleEvent func(LogJSON) (bool, error)) (err error) {
+	assembler := chunkAssembler{handleEvent: handleEvent}
+	entry := make(map[string][]byte)
+
+	for {
+		line, readErr := logReader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			err = fmt.Errorf("encountered error while reading journal export: %v", readErr)
+			return
+		}
+
+		line = bytes.TrimSuffix(line, []byte("\n"))
+
+		if len(line) == 0 {
+			// End of entry
+			if len(entry) > 0 {
+				var keepReading bool
+				keepReading, err = addJournalEntry(&assembler, entry["SYSLOG_IDENTIFIER"], entry["MESSAGE"])
+				if err != nil || !keepReading {
+					return
+				}
+				entry = make(map[string][]byte)
+			}
+		} else if fieldName, fieldValue, isText := bytes.Cut(line, []byte("=")); isText {
+			entry[string(fieldName)] = fieldValue
+		} else {
+			// Binary field, size is little endian before the data
+			var fieldSize uint64
+			err = binary.Read(logReader, binary.LittleEndian, &fieldSize)
+			if err != nil {
+				err = fmt.Errorf("failed to read size of journal field '%s': %v", line, err)
+				return
+			}
+
+			fieldValue := make([]byte, fieldSize+1) // Includes trailing newline
+			_, err = io.ReadFull(logReader, fieldValue)
+			if err != nil {
+				err = fmt.Errorf("failed to read journal field '%s': %v", line, err)
+				return
+			}
+			entry[string(line)] = fieldValue[:fieldSize]
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	// Last entry might not have a trailing blank line
+	if len(entry) > 0 {
+		_, err = addJournalEntry(&assembler, entry["SYSLOG_IDENTIFIER"], entry["MESSAGE"])
+		if err != nil {
+			return
+		}
+	}
+
+	err = assembler.flush()
+	return
+}
+
+// Parses `journalctl -o json` streams, one JSON object per entry
+func readJournalJSONEvents(logReader *bufio.Reader, handleEvent func(LogJSON) (bool, error)) (err error) {
+	assembler := chunkAssembler{handleEvent: handleEvent}
+
+	for {
+		line, readErr := logReader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			err = fmt.Errorf("encountered error while reading journal JSON: %v", readErr)
+			return
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			var entry map[string]json.RawMessage
+			err = json.Unmarshal(line, &entry)
+			if err != nil {
+				err = fmt.Errorf("failed to parse journal JSON entry: %v", err)
+				return
+			}
+
+			var keepReading bool
+			keepReading, err = addJournalEntry(&assembler, journalJSONField(entry["SYSLOG_IDENTIFIER"]), journalJSONField(entry["MESSAGE"]))
+			if err != nil || !keepReading {
+				return
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	err = assembler.flush()
+	return
+}
+
+// Journal JSON fields are strings, or arrays of byte values when not valid UTF-8
+func journalJSONField(rawField json.RawMessage) (value []byte) {
+	if len(rawField) == 0 {
+		return
+	}
+
+	var text string
+	if json.Unmarshal(rawField, &text) == nil {
+		value = []byte(text)
+		return
+	}
+
+	var byteValues []byte
+	var numbers []int
+	if json.Unmarshal(rawField, &numbers) == nil {
+		for _, number := range numbers {
+			byteValues = append(byteValues, byte(number))
+		}
+		value = byteValues
+	}
+	return
+}
+
+// Reads binary journal files by having journalctl export them
+func readJournalFileEvents(journalFile string, handleEvent func(LogJSON) (bool, error)) (err error) {
+	command := exec.Command("journalctl", "--file", journalFile, "--output", "export", "--no-pager")
+
+	journalOutput, err := command.StdoutPipe()
+	if err != nil {
+		err = fmt.Errorf("failed to read journalctl output: %v", err)
+		return
+	}
+
+	err = command.Start()
+	if err != nil {
+		err = fmt.Errorf("failed to run journalctl for journal file: %v", err)
+		return
+	}
+
+	var stoppedEarly bool
+	err = readJournalExportEvents(bufio.NewReader(journalOutput), func(log LogJSON) (keepReading bool, err error) {
+		keepReading, err = handleEvent(log)
+		stoppedEarly = !keepReading
+		return
+	})
+	if err != nil || stoppedEarly {
+		// Output is no longer read, so journalctl would block on the full pipe forever
+		command.Process.Kill()
+		command.Wait()
+		return
+	}
+
+	err = command.Wait()
+	if err != nil {
+		err = fmt.Errorf("journalctl failed reading journal file: %v", err)
+		return
+	}
+	return
+}
+
+// Extracts apthl event records out of a journal entry's message
+// Entries from other programs or apthl progress messages are ignored
+func addJournalEntry(assembler *chunkAssembler, identifier []byte, message []byte) (keepReading bool, err error) {
+	keepReading = true
+
+	if len(identifier) > 0 && string(identifier) != journalIdentifier {
+		return
+	}
+
+	message = bytes.TrimSpace(message)
+	if len(message) == 0 || message[0] != '{' {
+		return
+	}
+
+	record, err := apthistory.UnmarshalEvent(message)
+	if err != nil {
+		printMessage(verbosityData, "Skipping journal message that is not an event record: %v\n", err)
+		err = nil
+		return
+	}
+
+	keepReading, err = assembler.add(record)
+	return
+}
@@ -0,0 +1,47 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadJournalFileEventsStopEarly(t *testing.T) {
+	// Stand-in journalctl writing far more than a pipe holds
+	binDirectory := t.TempDir()
+	fakeJournalctl := `#!/bin/sh
+i=0
+while [ $i -lt 20000 ]; do
+	printf 'SYSLOG_IDENTIFIER=apthl\nMESSAGE={"schema_version":2,"event_id":"event-%d","start_timestamp":"2025-06-01T10:00:00Z","command_line":"apt upgrade"}\n\n' $i
+	i=$((i+1))
+done
+`
+	err := os.WriteFile(filepath.Join(binDirectory, "journalctl"), []byte(fakeJournalctl), 0755)
+	if err != nil {
+		t.Fatalf("failed to write fake journalctl: %v", err)
+	}
+	t.Setenv("PATH", binDirectory+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var events []string
+	finished := make(chan error)
+	go func() {
+		finished <- readJournalFileEvents("system.journal", func(log LogJSON) (bool, error) {
+			events = append(events, log.EventID)
+			return false, nil
+		})
+	}()
+
+	select {
+	case err = <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("readJournalFileEvents() did not return after the first event")
+	}
+	if err != nil {
+		t.Fatalf("readJournalFileEvents() unexpected error = %v", err)
+	}
+	if len(events) != 1 || events[0] != "event-0" {
+		t.Errorf("readJournalFileEvents() handled %v, want only event-0", events)
+	}
+}
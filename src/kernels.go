@@ -0,0 +1,282 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// Versioned kernel packages, the ABI (6.1.0-40-amd64, 6.8.0-45-generic) always starts with a digit
+// Meta packages like linux-image-amd64 have no ABI and are not part of the report
+var kernelPackageRegex = regexp.MustCompile(`^linux-(image|headers|modules|modules-extra)-(?:unsigned-)?([0-9].*)$`)
+
+// Boot images of installed kernels, finds kernels installed before the oldest log
+const kernelImageGlob = "/boot/vmlinuz-*"
+
+// Number of newest installed kernels that are never cleanup candidates (as with APT's autoremove)
+const keptKernels = 2
+
+// Install and remove history of one kernel ABI
+type kernelRecord struct {
+	ABI              string   `json:"abi"`
+	Version          string   `json:"version,omitempty"` // Last version of the kernel image package
+	Packages         []string `json:"packages"`
+	Installed        string   `json:"installed,omitempty"` // Empty when installed before the oldest log
+	InstallEventID   string   `json:"install_event_id,omitempty"`
+	Removed          string   `json:"removed,omitempty"`
+	RemoveEventID    string   `json:"remove_event_id,omitempty"`
+	Status           string   `json:"status"` // installed or removed
+	Running          bool     `json:"running"`
+	CleanupCandidate bool     `json:"cleanup_candidate"`
+
+	hasImage          bool
+	installedPackages []string
+}
+
+// Reports kernel installs and removals from the log file and its rotated archives
+func kernelReport(inputPath string, outputFormat string) {
+	if !slices.Contains([]string{"json", "ndjson", "table"}, outputFormat) {
+		logError("Invalid output format", fmt.Errorf("kernel report format must be one of json, ndjson, table"))
+	}
+
+	// Include rotated archives of a single log file
+	searchPaths, err := collectLogArchivePaths(inputPath)
+	logError("Failed to read input file choice", err)
+
+	var events []LogJSON
+	for _, searchPath := range searchPaths {
+		printMessage(verbosityProgress, "Reading events from %s\n", searchPath)
+
+		err = readLogEvents(searchPath, func(log LogJSON) (keepReading bool, err error) {
+			keepReading = true
+			events = append(events, log)
+			return
+		})
+		logError("Failed to read log file", err)
+	}
+
+	// Archives are read in name order, kernel history has to be replayed in time order
+	slices.SortStableFunc(events, func(a, b LogJSON) int {
+		return compareStartTimestamps(a.StartTimestamp, b.StartTimestamp)
+	})
+
+	bootImages, _ := filepath.Glob(kernelImageGlob)
+	records := buildKernelRecords(events, bootImages, loadHostInfo().kernel)
+
+	err = writeKernelReport(records, outputFormat)
+	logError("Failed to write kernel report", err)
+}
+
+// Replays kernel package changes of the events (in time order) into one record per ABI, sorted by ABI version
+func buildKernelRecords(events []LogJSON, bootImages []string, runningKernel string) (records []*kernelRecord) {
+	byABI := make(map[string]*kernelRecord)
+	recordFor := func(abi string) *kernelRecord {
+		record, exists := byABI[abi]
+		if !exists {
+			record = &kernelRecord{ABI: abi}
+			byABI[abi] = record
+			records = append(records, record)
+		}
+		return record
+	}
+
+	for _, log := range events {
+		for _, opList := range log.OperationLists() {
+			for _, pkg := range *opList.Packages {
+				fields := kernelPackageRegex.FindStringSubmatch(pkg.Name)
+				if fields == nil {
+					continue
+				}
+				record := recordFor(fields[2])
+				if !slices.Contains(record.Packages, pkg.Name) {
+					record.Packages = append(record.Packages, pkg.Name)
+				}
+				if fields[1] == "image" {
+					record.hasImage = true
+					record.Version = pkg.Version
+				}
+				record.apply(log, opList.Name, pkg.Name)
+			}
+		}
+	}
+
+	// Kernels installed before the oldest log only show up in /boot
+	for _, bootImage := range bootImages {
+		abi := strings.TrimPrefix(filepath.Base(bootImage), "vmlinuz-")
+		_, inHistory := byABI[abi]
+		if !inHistory {
+			record := recordFor(abi)
+			record.hasImage = true
+			record.installedPackages = []string{"linux-image-" + abi}
+		}
+	}
+
+	records = mergeCommonKernelPackages(records)
+
+	slices.SortFunc(records, func(a, b *kernelRecord) int {
+		return compareKernelABIs(a.ABI, b.ABI)
+	})
+
+	// Newest installed kernels and the running one are kept
+	var installedCount int
+	for index := len(records) - 1; index >= 0; index-- {
+		record := records[index]
+		if len(record.installedPackages) > 0 {
+			record.Status = "installed"
+		} else {
+			record.Status = "removed"
+		}
+		record.Running = record.ABI == runningKernel
+		if record.Status != "installed" || !record.hasImage {
+			continue
+		}
+
+		installedCount++
+		record.CleanupCandidate = installedCount > keptKernels && !record.Running
+	}
+	return
+}
+
+// Tracks the installed packages of the ABI, the ABI counts as removed once none are left
+func (record *kernelRecord) apply(log LogJSON, operation string, packageName string) {
+	if slices.Contains(installingOperations, operation) {
+		if len(record.installedPackages) == 0 && operation == "install" {
+			record.Installed = log.StartTimestamp
+			record.InstallEventID = log.EventID
+			record.Removed = ""
+			record.RemoveEventID = ""
+		}
+		if !slices.Contains(record.installedPackages, packageName) {
+			record.installedPackages = append(record.installedPackages, packageName)
+		}
+		return
+	}
+
+	wasInstalled := len(record.installedPackages) > 0
+	record.installedPackages = slices.DeleteFunc(record.installedPackages, func(name string) bool {
+		return name == packageName
+	})
+
+	// Purges after the removal keep the removal time, packages installed before the oldest log were never tracked
+	if (wasInstalled || record.Removed == "") && len(record.installedPackages) == 0 {
+		record.Removed = log.StartTimestamp
+		record.RemoveEventID = log.EventID
+	}
+}
+
+// Flavour independent packages (linux-headers-6.1.0-40-common, linux-headers-6.8.0-45) get their own ABI
+// They are folded into the records of the kernel images they belong to
+func mergeCommonKernelPackages(records []*kernelRecord) (merged []*kernelRecord) {
+	for _, record := range records {
+		if record.hasImage {
+			merged = append(merged, record)
+		}
+	}
+
+	for _, record := range records {
+		if record.hasImage {
+			continue
+		}
+
+		base := strings.TrimSuffix(record.ABI, "-common")
+		var matched bool
+		for _, imageRecord := range merged {
+			if !strings.HasPrefix(imageRecord.ABI, base+"-") || !imageRecord.hasImage {
+				continue
+			}
+			matched = true
+			for _, name := range record.Packages {
+				if !slices.Contains(imageRecord.Packages, name) {
+					imageRecord.Packages = append(imageRecord.Packages, name)
+				}
+			}
+		}
+
+		// Headers without any matching image are reported on their own
+		if !matched {
+			merged = append(merged, record)
+		}
+	}
+	return
+}
+
+// Orders ABIs by Debian version rules, falling back to plain text order
+func compareKernelABIs(a string, b string) int {
+	comparison, err := apthistory.CompareVersions(a, b)
+	if err != nil {
+		return strings.Compare(a, b)
+	}
+	return comparison
+}
+
+func writeKernelReport(records []*kernelRecord, outputFormat string) (err error) {
+	switch outputFormat {
+	case "json":
+		var runningKernel string
+		var cleanupCandidates []string
+		for _, record := range records {
+			if record.Running {
+				runningKernel = record.ABI
+			}
+			if record.CleanupCandidate {
+				cleanupCandidates = append(cleanupCandidates, record.ABI)
+			}
+		}
+		report := struct {
+			RunningKernel     string          `json:"running_kernel"`
+			CleanupCandidates []string        `json:"cleanup_candidates"`
+			Kernels           []*kernelRecord `json:"kernels"`
+		}{runningKernel, cleanupCandidates, records}
+		if report.CleanupCandidates == nil {
+			report.CleanupCandidates = []string{}
+		}
+		if report.Kernels == nil {
+			report.Kernels = []*kernelRecord{}
+		}
+
+		var reportJSON []byte
+		reportJSON, err = json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			err = fmt.Errorf("invalid JSON: %v", err)
+			return
+		}
+		fmt.Println(string(reportJSON))
+	case "ndjson":
+		for _, record := range records {
+			var recordJSON []byte
+			recordJSON, err = json.Marshal(record)
+			if err != nil {
+				err = fmt.Errorf("invalid JSON: %v", err)
+				return
+			}
+			fmt.Println(string(recordJSON))
+		}
+	case "table":
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "ABI\tVERSION\tSTATUS\tINSTALLED\tREMOVED\tRUNNING\tCLEANUP")
+		for _, record := range records {
+			installed := record.Installed
+			if installed == "" && record.Status == "installed" {
+				installed = "before logs"
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", record.ABI, emptyAsDash(record.Version), record.Status,
+				emptyAsDash(installed), emptyAsDash(record.Removed), yesOrDash(record.Running), yesOrDash(record.CleanupCandidate))
+		}
+		err = table.Flush()
+	}
+	return
+}
+
+func yesOrDash(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "-"
+}
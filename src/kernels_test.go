@@ -0,0 +1,71 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBuildKernelRecords(t *testing.T) {
+	events := []LogJSON{
+		{
+			EventID:        "945e9b16-fa55-b4de-16df-117d2d6021c6",
+			StartTimestamp: "2025-01-10T10:00:00Z",
+			Install: []PackageInfo{
+				{Name: "linux-image-6.1.0-28-amd64", Arch: "amd64", Version: "6.1.119-1"},
+				{Name: "linux-headers-6.1.0-28-common", Arch: "all", Version: "6.1.119-1"},
+			},
+		},
+		{
+			EventID:        "5c0a7b4e-24c1-9c0e-4a55-1f7b2e0b9d61",
+			StartTimestamp: "2025-03-10T10:00:00Z",
+			Install:        []PackageInfo{{Name: "linux-image-6.1.0-31-amd64", Arch: "amd64", Version: "6.1.128-1"}},
+			Upgrade:        []PackageInfo{{Name: "linux-image-amd64", Arch: "amd64", OldVersion: "6.1.119-1", Version: "6.1.128-1"}},
+		},
+		{
+			EventID:        "0e0a1c5d-8f3b-2f0e-7d1a-6b9e4c2a3f10",
+			StartTimestamp: "2025-05-10T10:00:00Z",
+			Install:        []PackageInfo{{Name: "linux-image-6.1.0-34-amd64", Arch: "amd64", Version: "6.1.135-1"}},
+		},
+		{
+			EventID:        "998df3e3-585b-b80a-a0af-25d1cc19ea5d",
+			StartTimestamp: "2025-06-10T10:00:00Z",
+			Remove:         []PackageInfo{{Name: "linux-image-6.1.0-31-amd64", Arch: "amd64", Version: "6.1.128-1"}},
+		},
+		{
+			EventID:        "2b1f5a7c-3d9e-0c4b-8e6f-a1d2c3b4e5f6",
+			StartTimestamp: "2025-07-10T10:00:00Z",
+			Purge:          []PackageInfo{{Name: "linux-image-6.1.0-31-amd64", Arch: "amd64", Version: "6.1.128-1"}},
+		},
+	}
+
+	records := buildKernelRecords(events, []string{"/boot/vmlinuz-6.1.0-9-amd64", "/boot/vmlinuz-6.1.0-34-amd64"}, "6.1.0-28-amd64")
+
+	type kernelState struct {
+		abi       string
+		status    string
+		installed string
+		removed   string
+		running   bool
+		cleanup   bool
+	}
+	want := []kernelState{
+		{abi: "6.1.0-9-amd64", status: "installed", cleanup: true},
+		{abi: "6.1.0-28-amd64", status: "installed", installed: "2025-01-10T10:00:00Z", running: true},
+		{abi: "6.1.0-31-amd64", status: "removed", installed: "2025-03-10T10:00:00Z", removed: "2025-06-10T10:00:00Z"},
+		{abi: "6.1.0-34-amd64", status: "installed", installed: "2025-05-10T10:00:00Z"},
+	}
+
+	var got []kernelState
+	for _, record := range records {
+		got = append(got, kernelState{record.ABI, record.Status, record.Installed, record.Removed, record.Running, record.CleanupCandidate})
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("buildKernelRecords() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	wantPackages := []string{"linux-image-6.1.0-28-amd64", "linux-headers-6.1.0-28-common"}
+	if !slices.Equal(records[1].Packages, wantPackages) {
+		t.Errorf("Packages = %v, want %v", records[1].Packages, wantPackages)
+	}
+}
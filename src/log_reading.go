@@ -2,34 +2,61 @@
 package main
 
 import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
 	"bufio"
-	"compress/gzip"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"slices"
 	"strings"
 	"sync"
-	"syscall"
+	"time"
 )
 
-func logReaderContinuous(logFileInput string, logFileOutput string) {
+func logReaderContinuous(logFileInput string, logFileOutput string, daemonOpts DaemonOptions) {
 	if strings.HasSuffix(logFileInput, ".gz") {
 		logError("Unsupported file input", fmt.Errorf("compressed files are not supported in continous mode"))
 	}
+	if !slices.Contains(daemonOutputFormats, daemonOpts.outputFormat) {
+		logError("Invalid output format", fmt.Errorf("daemon output format must be one of %s", strings.Join(daemonOutputFormats, ", ")))
+	}
+	daemonOpts.host = loadHostInfo()
 
-	log, err := os.Open(logFileInput)
-	logError("Failed to read log file", err)
-	defer log.Close()
+	// Only a configuration file the user pointed to has to exist
+	config, err := loadConfig(daemonOpts.configPath, daemonOpts.configPath != defaultConfigPath)
+	logError("Failed to load configuration", err)
+
+	alerts, err := newAlerter(config.Alerts, daemonOpts.schemaVersion, daemonOpts.host)
+	logError("Invalid alert configuration", err)
+
+	windows, err := newMaintenanceWindows(config.MaintenanceWindows)
+	logError("Invalid maintenance window configuration", err)
+
+	err = configureHistoryParser(config.OriginPatterns, daemonOpts.recordSource, daemonOpts.keepRaw)
+	logError("Invalid origin pattern configuration", err)
+
+	restarts := newRestartDetector(daemonOpts.restartCheck)
+
+	policy, err := loadPolicy(daemonOpts.policyPath, daemonOpts.policyPath != defaultPolicyPath)
+	logError("Failed to load policy", err)
+	if !policy.empty() && daemonOpts.outputFormat != "json" {
+		printMessage(verbosityStandard, "Warning: policy violation records are only written in json output\n")
+	}
 
 	logFileInode, logFileOffset, err := getLastPosition(logFileInput)
 	logError("Failed to get position of last log read", err)
 
-	_, err = log.Seek(logFileOffset, io.SeekStart)
-	logError("Failed to resume in log", err)
-
 	printMessage(verbosityDebug, "Starting log file read at offset %d\n", logFileOffset)
 
+	// Follows the log file, including across rotations
+	tailer, err := apthistory.NewTailer(logFileInput, logFileOffset, historyParser)
+	logError("Failed to read log file", err)
+	defer tailer.Close()
+	logFileInode = tailer.Inode()
+
 	// User requested output go to file
 	var fileOutput *os.File
 	if logFileOutput != "" {
@@ -38,19 +65,32 @@ func logReaderContinuous(logFileInput string, logFileOutput string) {
 		defer fileOutput.Close()
 	}
 
+	// Each sink has its own record size limit
+	chunkSize := daemonOpts.chunkSize
+	if fileOutput != nil {
+		chunkSize = daemonOpts.fileChunkSize
+	}
+
+	// Local event store
+	var index *eventIndex
+	if daemonOpts.indexEvents {
+		index, err = loadEventIndex(eventIndexDirectory)
+		logError("Failed to load event index", err)
+	}
+
 	// Create background signal handler
 	var signalBlocker sync.WaitGroup // Blocker so log reads/writes can finish before program exits
-	go signalHandler(&signalBlocker, &logFileInode, &logFileOffset)
+	shutdown := make(chan struct{})
+	go signalHandler(&signalBlocker, shutdown, &logFileInode, &logFileOffset)
 
-	// Create inotify background watcher
-	fileHasChanged := make(chan bool, 1) // Main blocker for reading new lines
-	fileHasRotated := make(chan bool, 1) // Notify when to switch file inodes and reset offset
-	go changeWatcher(logFileInput, fileHasChanged, fileHasRotated)
+	// Background hook runs also hold up the exit
+	hook, err := newEventHook(daemonOpts, &signalBlocker, shutdown)
+	logError("Invalid event hook", err)
 
-	printMessage(verbosityProgress, "Starting log file watch\n")
+	// Queued alerts too, up to a deadline once stopping
+	alerts.startSending(&signalBlocker, shutdown)
 
-	// Create a scanner to read the file
-	scanner := bufio.NewScanner(log)
+	printMessage(verbosityProgress, "Starting log file watch\n")
 
 	if dryRunRequested {
 		printMessage(verbosityStandard, "Dry-run requested, not processing log file. Exiting...\n")
@@ -58,215 +98,327 @@ func logReaderContinuous(logFileInput string, logFileOutput string) {
 	}
 
 	// Continous watching of the file
-	var eventBlock string    // Buffer for the APT multi-line log entries
-	var blockHasStarted bool // Flag to track if the current lines being prcessed are within a block
 	for {
-		// Process all available lines
-		for scanner.Scan() {
-			line := scanner.Text()
-
-			logFileOffset, err = log.Seek(0, io.SeekCurrent)
-			logError("Failed to get current offset while scanning", err)
-
-			printMessage(verbosityDebug, "Read line, moved to new offset %d\n", logFileOffset)
-
-			if strings.HasPrefix(line, "Start-Date: ") {
-				// Always ensure block buffer is empty on new block
-				eventBlock = ""
-
-				// Marks all lines after this one as "to be added to block"
-				blockHasStarted = true
+		// Blocks until next event is written
+		newLog, err := tailer.Next()
+
+		// Block signals while handling event
+		signalBlocker.Add(1)
+
+		var parseErr *apthistory.ParseError
+		var matchedAlerts []alertRecord
+		var violations []policyViolation
+		if errors.As(err, &parseErr) {
+			printMessage(verbosityNone, "Failed to parse log entry: %v: (%s)\n", parseErr.Err, strings.ReplaceAll(parseErr.Block, "\n", ":"))
+		} else if err != nil {
+			logError("Error reading log", err)
+		} else {
+			err = windows.flag(&newLog)
+			if err != nil {
+				printMessage(verbosityNone, "Failed to check maintenance windows: %v\n", err)
 			}
 
-			// Add all lines within the block to the buffer
-			if blockHasStarted {
-				eventBlock += line + "\n"
+			err = restarts.flag(&newLog)
+			if err != nil {
+				printMessage(verbosityNone, "Failed to check for needed reboots and restarts: %v\n", err)
 			}
 
-			// Once at the end of block, parse the entries
-			if strings.HasPrefix(line, "End-Date: ") {
-				blockHasStarted = false
-
-				// Block signals while parsing block
-				signalBlocker.Add(1)
+			// Tags from alert rules are part of the written and indexed event
+			matchedAlerts, err = alerts.evaluate(&newLog)
+			if err != nil {
+				printMessage(verbosityNone, "Failed to evaluate alert rules: %v\n", err)
+			}
 
-				printMessage(verbosityProgress, "Parsing event fields\n")
+			violations, err = policy.evaluate(newLog)
+			if err != nil {
+				printMessage(verbosityNone, "Failed to check package policy: %v\n", err)
+			}
 
-				// Parse the log lines into single JSON
-				var newLog LogJSON
-				newLog, err = parseEvent(eventBlock)
+			// A blocking hook has to succeed before the event is indexed or written
+			if !hook.handle(newLog) {
+				// Stopping first, the position is saved before this event so it is handled again after restart
+				signalBlocker.Done()
+				signalBlocker.Wait()
+				err = savePosition(logFileInode, logFileOffset)
 				if err != nil {
-					printMessage(verbosityNone, "Failed to parse log entry: %v: (%s)\n", err, strings.ReplaceAll(eventBlock, "\n", ":"))
+					printMessage(verbosityNone, "Failed to save log position: %v\n", err)
 				}
+				return
+			}
 
-				if fileOutput != nil {
-					jsonLine, err := json.Marshal(newLog)
-					if err != nil {
-						printMessage(verbosityNone, "Invalid JSON: %v: (%v)\n", err, newLog)
-					}
-
-					// Add newline after each JSON line
-					jsonLine = append(jsonLine, '\n')
+			if index != nil {
+				err = index.appendEvent(newLog)
+				if err != nil {
+					printMessage(verbosityNone, "Failed to add event to index: %v\n", err)
+				}
+			}
+		}
 
-					fileOutput.Write(jsonLine)
+		var outputLines [][]byte
+		if parseErr != nil {
+			// Failed blocks are written as their own record type instead of an empty event
+			if daemonOpts.outputFormat == "json" {
+				parseErrorLine, err := json.Marshal(newParseErrorRecord(parseErr, logFileInput, tailer.Inode()))
+				if err != nil {
+					printMessage(verbosityNone, "Failed formatting parse error: %v\n", err)
 				} else {
-					// Handle journald max line size gracefully
-					chunkedLogs, err := splitLog(newLog)
-					if err != nil {
-						printMessage(verbosityNone, "Failed chunking JSON: %v: (%v)\n", err, newLog)
-					}
-
-					for _, chunkedLog := range chunkedLogs {
-						jsonLine, err := json.Marshal(chunkedLog)
-						if err != nil {
-							printMessage(verbosityNone, "Invalid JSON: %v: (%v)\n", err, newLog)
-						}
-
-						// Add newline after each JSON line
-						jsonLine = append(jsonLine, '\n')
-
-						// Output the formatted log
-						fmt.Println(string(jsonLine))
-					}
+					outputLines = append(outputLines, parseErrorLine)
 				}
+			}
+		} else {
+			outputLines, err = daemonEventLines(newLog, daemonOpts, chunkSize)
+			if err != nil {
+				printMessage(verbosityNone, "Failed formatting event: %v: (%v)\n", err, newLog)
+			}
+		}
 
-				// Save the end position of this block
-				logFileOffset, err = log.Seek(0, io.SeekCurrent)
-				logError("Failed to retrieve current position in log file", err)
-
-				printMessage(verbosityDebug, "Processed log, currently at offset %d\n", logFileOffset)
+		// Violations follow the event as their own record
+		if len(violations) > 0 && daemonOpts.outputFormat == "json" {
+			violationLine, err := json.Marshal(newPolicyViolationRecord(newLog, violations))
+			if err != nil {
+				printMessage(verbosityNone, "Failed formatting policy violations: %v\n", err)
+			} else {
+				outputLines = append(outputLines, violationLine)
+			}
+		}
 
-				// Unblock signals after block finishes
-				signalBlocker.Done()
+		for _, outputLine := range outputLines {
+			// Add newline after each JSON line
+			outputLine = append(outputLine, '\n')
 
-				// Always ensure block buffer is empty at end of block
-				eventBlock = ""
+			if fileOutput != nil {
+				fileOutput.Write(outputLine)
+			} else {
+				// Output the formatted log
+				fmt.Println(string(outputLine))
 			}
 		}
 
-		// Check for errors in the scanner
-		err = scanner.Err()
-		logError("Error reading log", err)
+		// Alerts go to their own sinks, separate from the event output
+		alerts.send(matchedAlerts)
 
-		printMessage(verbosityDebug, "Currently at offset %d\n", logFileOffset)
-		printMessage(verbosityProgress, "No more new lines, waiting for file changes\n")
+		// Save the end position of this event
+		logFileInode = tailer.Inode()
+		logFileOffset = tailer.Offset()
 
-		// Wait for inotify watcher to see that the log file has changed
-		<-fileHasChanged
+		printMessage(verbosityDebug, "Processed log, currently at offset %d\n", logFileOffset)
 
-		select {
-		case reopenLogFile := <-fileHasRotated:
-			if reopenLogFile {
-				// Reopen at file path
-				log.Close()
-				log, err = os.Open(logFileInput)
-				logError("Failed to reopen rotated log file", err)
+		// Unblock signals after event finishes
+		signalBlocker.Done()
+	}
+}
 
-				// Retrieve new file inode
-				fileInfo, err := os.Stat(logFileInput)
-				logError("unable to stat new log file", err)
-				stat := fileInfo.Sys().(*syscall.Stat_t)
+// Reads log file and passes every event matching the search parameters to handleMatch
+// Reading stops early when handleMatch returns false
+func logReaderSearch(logFileInput string, searchParams SearchParameters, handleMatch func(LogJSON) bool) (err error) {
+	err = readLogEvents(logFileInput, func(newLog LogJSON) (keepReading bool, err error) {
+		// Determine if this event matches any search criteria
+		searchMatched, matchedLog, err := searchParams.matcher.Match(newLog)
+		if err != nil {
+			err = fmt.Errorf("failed to search in log event: %v", err)
+			return
+		}
 
-				// Save new file inode to state var
-				logFileInode = stat.Ino
+		keepReading = true
+		if searchMatched {
+			keepReading = handleMatch(matchedLog)
+		}
+		return
+	})
+	return
+}
 
-				// Reset offset position for new file
-				logFileOffset = 0
-			}
-		default:
-			// No blocking if no rotation has occured
+// Retrieves the start time of the first event in the log file
+// Found is false when the file contains no events
+func logFirstEventTime(logFileInput string) (firstStart time.Time, found bool, err error) {
+	err = readLogEvents(logFileInput, func(newLog LogJSON) (keepReading bool, err error) {
+		firstStart, err = time.Parse(time.RFC3339, newLog.StartTimestamp)
+		if err != nil {
+			err = fmt.Errorf("failed parsing start time: %v", err)
+			return
 		}
+		found = true
+		return
+	})
+	return
+}
 
-		// Rescan for new lines after the last offset
-		_, err = log.Seek(logFileOffset, io.SeekStart)
-		logError("Failed to seek to last offset", err)
+// Orders two event start timestamps by the instant they refer to
+// RFC3339 text with differing UTC offsets does not sort chronologically
+func compareStartTimestamps(a string, b string) int {
+	aTime, _ := time.Parse(time.RFC3339, a)
+	bTime, _ := time.Parse(time.RFC3339, b)
+	return aTime.Compare(bTime)
+}
 
-		printMessage(verbosityDebug, "Scanning for new lines at offset %d\n", logFileOffset)
+// Parses every event in a log file, passing them in file order to handleEvent
+// APT history logs, apthl's own JSON output and systemd journal exports/files are supported
+func readLogEvents(logFileInput string, handleEvent func(LogJSON) (bool, error)) (err error) {
+	logReader, err := openLogFile(logFileInput)
+	if err != nil {
+		return
+	}
+	defer logReader.Close()
 
-		scanner = bufio.NewScanner(log) // Reset the scanner to continue scanning after the last offset
+	// JSON output of older versions has no origin or parsed command
+	handleParsed := handleEvent
+	handleEvent = func(log LogJSON) (bool, error) {
+		fillCommandFields(&log)
+		return handleParsed(log)
 	}
-}
 
-func logReaderSearch(logFileInput string, searchParams SearchParameters) (parsedBuffer []LogJSON, err error) {
-	log, err := os.Open(logFileInput)
+	// Compressed archives are detected by content
+	bufferedLog, err := apthistory.Decompress(logReader)
 	if err != nil {
-		err = fmt.Errorf("failed to open log file: %v", err)
 		return
 	}
-	defer log.Close()
 
-	var logReader io.Reader
+	logFormat, err := detectLogFormat(bufferedLog)
+	if err != nil {
+		return
+	}
 
-	if strings.HasSuffix(logFileInput, ".gz") {
-		var gzReader *gzip.Reader
-		gzReader, err = gzip.NewReader(log)
-		if err != nil {
-			err = fmt.Errorf("failed to open gz log file: %v", err)
+	switch logFormat {
+	case logFormatJSON:
+		printMessage(verbosityData, "Reading %s as apthl JSON output\n", logFileInput)
+		err = readJSONEvents(bufferedLog, handleEvent)
+	case logFormatJournalExport:
+		printMessage(verbosityData, "Reading %s as journal export\n", logFileInput)
+		err = readJournalExportEvents(bufferedLog, handleEvent)
+	case logFormatJournalJSON:
+		printMessage(verbosityData, "Reading %s as journal JSON\n", logFileInput)
+		err = readJournalJSONEvents(bufferedLog, handleEvent)
+	case logFormatJournalFile:
+		printMessage(verbosityData, "Reading %s as journal file\n", logFileInput)
+		err = readJournalFileEvents(logFileInput, handleEvent)
+	default:
+		err = readHistoryEvents(bufferedLog, logFileSource(logFileInput, logReader), handleEvent)
+	}
+	return
+}
+
+// Determines log format from the start of the file
+func detectLogFormat(bufferedLog *bufio.Reader) (logFormat int, err error) {
+	logFormat = logFormatHistory
+
+	var firstLine []byte
+	for peekSize := 512; ; peekSize *= 2 {
+		var peeked []byte
+		peeked, err = bufferedLog.Peek(peekSize)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			err = fmt.Errorf("failed to read log file: %v", err)
+			return
+		}
+		readAll := err != nil
+		err = nil
+
+		if bytes.HasPrefix(peeked, journalFileMagic) {
+			logFormat = logFormatJournalFile
 			return
 		}
-		defer gzReader.Close()
 
-		logReader = gzReader
-	} else {
-		logReader = log
+		// Need the whole first non-empty line
+		trimmed := bytes.TrimLeft(peeked, " \t\r\n")
+		lineEnd := bytes.IndexByte(trimmed, '\n')
+		if lineEnd >= 0 {
+			firstLine = trimmed[:lineEnd]
+			break
+		}
+		if readAll {
+			firstLine = trimmed
+			break
+		}
+	}
+
+	if len(firstLine) == 0 {
+		return
+	}
+
+	if firstLine[0] == '{' {
+		logFormat = logFormatJSON
+
+		// Journal JSON entries always carry journal metadata fields
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(firstLine, &fields) == nil {
+			_, hasCursor := fields["__CURSOR"]
+			_, hasEventID := fields["EventID"]
+			_, hasEventIDV2 := fields["event_id"]
+			if hasCursor && !hasEventID && !hasEventIDV2 {
+				logFormat = logFormatJournalJSON
+			}
+		}
+		return
+	}
+
+	if journalFieldRegex.Match(firstLine) {
+		logFormat = logFormatJournalExport
 	}
+	return
+}
 
-	scanner := bufio.NewScanner(logReader)
+// Parses multi-line APT history events
+// File and inode of source are added to the offsets the parser records
+func readHistoryEvents(logReader io.Reader, source apthistory.EventSource, handleEvent func(LogJSON) (bool, error)) (err error) {
+	historyReader, err := apthistory.NewReader(logReader, historyParser)
+	if err != nil {
+		return
+	}
 
-	var eventBlock string    // Buffer for the APT multi-line log entries
-	var blockHasStarted bool // Flag to track if the current lines being prcessed are within a block
-	for scanner.Scan() {
-		line := scanner.Text()
+	for newLog, readErr := range historyReader.All() {
+		if readErr != nil {
+			err = readErr
+			return
+		}
 
-		if strings.HasPrefix(line, "Start-Date: ") {
-			// Always ensure block buffer is empty on new block
-			eventBlock = ""
+		printMessage(verbosityProgress, "Parsing event fields\n")
 
-			// Marks all lines after this one as "to be added to block"
-			blockHasStarted = true
+		if newLog.Source != nil {
+			newLog.Source.File = source.File
+			newLog.Source.Inode = source.Inode
 		}
 
-		// Add all lines within the block to the buffer
-		if blockHasStarted {
-			eventBlock += line + "\n"
+		var keepReading bool
+		keepReading, err = handleEvent(newLog)
+		if err != nil || !keepReading {
+			return
 		}
+	}
+	return
+}
 
-		// Once at the end of block, parse the entries
-		if strings.HasPrefix(line, "End-Date: ") {
-			blockHasStarted = false
+// Parses NDJSON event records written by the daemon
+func readJSONEvents(logReader *bufio.Reader, handleEvent func(LogJSON) (bool, error)) (err error) {
+	assembler := chunkAssembler{handleEvent: handleEvent}
 
-			printMessage(verbosityProgress, "Parsing event fields\n")
+	for {
+		line, readErr := logReader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			err = fmt.Errorf("encountered error while reading log lines: %v", readErr)
+			return
+		}
 
-			// Parse the log lines into single JSON
-			var newLog LogJSON
-			newLog, err = parseEvent(eventBlock)
+		// Skip blank lines and any non-JSON messages mixed into the output
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && line[0] == '{' {
+			var record LogJSON
+			record, err = apthistory.UnmarshalEvent(line)
 			if err != nil {
-				err = fmt.Errorf("failed to parse log entry: %v", err)
+				err = fmt.Errorf("failed to parse JSON record: %v", err)
 				return
 			}
 
-			// Determine if this block matches any search criteria
-			var searchMatched bool
-			var matchedLog LogJSON
-			searchMatched, matchedLog, err = newLog.findMatches(searchParams)
-			if err != nil {
-				err = fmt.Errorf("failed to search in log event: %v", err)
+			var keepReading bool
+			keepReading, err = assembler.add(record)
+			if err != nil || !keepReading {
 				return
 			}
+		}
 
-			if searchMatched {
-				parsedBuffer = append(parsedBuffer, matchedLog)
-			}
-
-			// Always ensure block buffer is empty at end of block
-			eventBlock = ""
+		if readErr == io.EOF {
+			break
 		}
 	}
-	err = scanner.Err()
-	if err != nil {
-		err = fmt.Errorf("encountered error while reading log lines: %v", err)
-		return
-	}
 
+	err = assembler.flush()
 	return
 }
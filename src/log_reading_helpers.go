@@ -2,19 +2,18 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"sync"
 	"syscall"
-	"time"
 )
 
 // Separate thread to listen for signals and ensure cleanup prior to exit
-func signalHandler(signalBlocker *sync.WaitGroup, fileInode *uint64, fileOffsetPosition *int64) {
+// Shutdown is closed once a signal arrives, so waiting work (like hook retries) can give up
+func signalHandler(signalBlocker *sync.WaitGroup, shutdown chan struct{}, fileInode *uint64, fileOffsetPosition *int64) {
 	printMessage(verbosityDebug, "Starting signal handling thread\n")
 
 	// Channel for handling interrupt signals (to ensure we save the position on exit)
@@ -24,6 +23,7 @@ func signalHandler(signalBlocker *sync.WaitGroup, fileInode *uint64, fileOffsetP
 	sig := <-sigChan
 
 	printMessage(verbosityStandard, "Received signal: %v\n", sig)
+	close(shutdown)
 
 	// Wait for current block parsing to complete before exiting
 	signalBlocker.Wait()
@@ -36,91 +36,73 @@ func signalHandler(signalBlocker *sync.WaitGroup, fileInode *uint64, fileOffsetP
 	os.Exit(0)
 }
 
-func changeWatcher(logFileInput string, fileHasChanged chan bool, fileHasRotated chan bool) {
-	printMessage(verbosityProgress, "Starting inotify thread to watch for file/directory changes\n")
-
-	// Open the inotify instance
-	fd, err := syscall.InotifyInit()
-	logError("Failed to initialize inotify", err)
-	defer syscall.Close(fd)
-
-	// Track active watcher fd's for dynamic cleanup
-	watchDescriptors := make(map[string]int)
-	defer func() {
-		for descName, descriptor := range watchDescriptors {
-			printMessage(verbosityDebug, "Cleaning up Inotify %s descriptor %d", descName, descriptor)
-			syscall.InotifyRmWatch(fd, uint32(descriptor))
-		}
-	}()
-
-	// Add watcher for the log file
-	watchDescriptorFile, err := syscall.InotifyAddWatch(fd, logFileInput, syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE)
-	logError("Failed to add log file to inotify watcher", err)
-	watchDescriptors["file"] = watchDescriptorFile
-
-	// Add watcher for the log dir
-	logDirectory := filepath.Dir(logFileInput)
-	watchDescriptorDir, err := syscall.InotifyAddWatch(fd, logDirectory, syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO|syscall.IN_DELETE|syscall.IN_CREATE)
-	logError("Failed to add directory to inotify watcher", err)
-	watchDescriptors["dir"] = watchDescriptorDir
-
-	// Create a buffer to read the events
-	buf := make([]byte, syscall.SizeofInotifyEvent+8192)
-	logFileName := filepath.Base(logFileInput)
-
-	for {
-		// Read the event
-		n, err := syscall.Read(fd, buf)
-		logError("Error reading inotify event", err)
-
-		var offset uint32
-		for offset <= uint32(n)-syscall.SizeofInotifyEvent {
-			var event syscall.InotifyEvent
-
-			// Retrieve the event
-			eventBytes := buf[offset : offset+syscall.SizeofInotifyEvent]
-			reader := bytes.NewReader(eventBytes)
-			err = binary.Read(reader, binary.LittleEndian, &event)
-			logError("Failed to read event content", err)
-
-			// Name field has the filename for dir events (null-terminated)
-			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+uint32(event.Len)]
-			name := string(nameBytes)
-			name = strings.TrimRight(name, "\x00")
-
-			// File modified
-			if event.Mask&syscall.IN_MODIFY != 0 && event.Wd == int32(watchDescriptorFile) {
-				printMessage(verbosityProgress, "File modified: %s\n", logFileInput)
-				fileHasChanged <- true
-			}
-
-			// Directory events - only look for our file
-			if event.Wd == int32(watchDescriptorDir) && name == logFileName {
-				if (event.Mask & (syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_CREATE)) != 0 {
-					printMessage(verbosityProgress, "Log file rotated: %s\n", logFileInput)
-					// Ensure new file is created before adding watcher for new inode
-					for {
-						if _, err := os.Stat(logFileInput); err == nil {
-							break
-						}
-						time.Sleep(100 * time.Millisecond)
-					}
-
-					// Cleanup watcher for old inode
-					syscall.InotifyRmWatch(fd, uint32(watchDescriptorFile))
-
-					// Add watcher for new inode
-					watchDescriptorFile, err = syscall.InotifyAddWatch(fd, logFileInput, syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE)
-					logError("Failed to add rotated log file to inotify watcher", err)
-					watchDescriptors["file"] = watchDescriptorFile
-
-					fileHasRotated <- true // send value to buffer so its available after main thread is unblocked
-					fileHasChanged <- true // unblock main thread
-				}
-			}
-
-			// Move the offset forward to the next event
-			offset += syscall.SizeofInotifyEvent + uint32(event.Len)
-		}
+// Opens log file for reading
+// A path of '-' reads from stdin
+func openLogFile(logFileInput string) (log *os.File, err error) {
+	if logFileInput == "-" {
+		log = os.Stdin
+		return
 	}
+
+	log, err = os.Open(logFileInput)
+	if err != nil {
+		err = fmt.Errorf("failed to open log file: %v", err)
+		return
+	}
+	return
+}
+
+// File and inode for the source location of events read from a log file
+// Stdin has neither
+func logFileSource(logFileInput string, logFile *os.File) (source apthistory.EventSource) {
+	if logFileInput == "-" {
+		return
+	}
+
+	source.File = logFileInput
+	absolutePath, err := filepath.Abs(logFileInput)
+	if err == nil {
+		source.File = absolutePath
+	}
+
+	fileInfo, err := logFile.Stat()
+	if err == nil {
+		source.Inode = fileInfo.Sys().(*syscall.Stat_t).Ino
+	}
+	return
+}
+
+// History block the daemon failed to parse, written in place of the event
+type parseErrorRecord struct {
+	RecordType string                 `json:"record_type"`
+	Error      string                 `json:"error"`
+	Raw        string                 `json:"raw"`
+	Source     apthistory.EventSource `json:"source"`
+}
+
+var parseErrorRecordSchema = apthistory.RecordSchema{
+	RecordType:  "parse_error",
+	Description: "History block the daemon failed to parse, written in place of the event",
+	Record:      parseErrorRecord{},
+	Descriptions: map[string]string{
+		"RecordType": "Kind of record",
+		"Error":      "Reason the block could not be parsed",
+		"Raw":        "Block as written in the log",
+		"Source":     "Location of the block in the log it was read from",
+	},
+}
+
+func newParseErrorRecord(parseErr *apthistory.ParseError, logFileInput string, inode uint64) (record parseErrorRecord) {
+	record = parseErrorRecord{
+		RecordType: "parse_error",
+		Error:      parseErr.Err.Error(),
+		Raw:        parseErr.Block,
+		Source: apthistory.EventSource{
+			File:        logFileInput,
+			Inode:       inode,
+			StartOffset: parseErr.Offset,
+			EndOffset:   parseErr.EndOffset,
+		},
+	}
+	return
 }
@@ -2,11 +2,12 @@
 package main
 
 import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
 	"flag"
 	"fmt"
 	"os"
-	"regexp"
 	"runtime"
+	"slices"
 	"time"
 )
 
@@ -15,9 +16,12 @@ import (
 // ###################################
 
 const (
-	stateDirectory   string = "/var/lib/APTHistoryLogger"
-	logStateFilePath string = "/var/lib/APTHistoryLogger/log.state"
-	journalDMaxSize         = 16 * 999 // Try to stay well below journald max log entry
+	stateDirectory      string = "/var/lib/APTHistoryLogger"
+	logStateFilePath    string = "/var/lib/APTHistoryLogger/log.state"
+	eventIndexDirectory string = "/var/lib/APTHistoryLogger/index"
+	defaultConfigPath   string = "/etc/apthl/apthl.json"
+	defaultPolicyPath   string = "/etc/apthl/policy.json"
+	journalDMaxSize            = 16 * 999 // Try to stay well below journald max log entry
 )
 const ( // Descriptive Names for available verbosity levels
 	verbosityNone int = iota
@@ -27,39 +31,21 @@ const ( // Descriptive Names for available verbosity levels
 	verbosityFullData
 	verbosityDebug
 )
+const ( // Input log formats recognized by search
+	logFormatHistory int = iota
+	logFormatJSON
+	logFormatJournalExport
+	logFormatJournalJSON
+	logFormatJournalFile
+)
 
 // ###################################
 //  GLOBAL VARIABLES
 // ###################################
 
-type LogJSON struct {
-	EventID            string        `json:"EventID"`
-	CommandLine        string        `json:"CommandLine"`
-	StartTimestamp     string        `json:"StartTimestamp"`
-	EndTimeStamp       string        `json:"EndTimeStamp"`
-	ElapsedSeconds     int           `json:"ElapsedSeconds"`
-	RequestedBy        string        `json:"RequestedBy,omitempty"`
-	RequestedByUID     int           `json:"RequestedByUID,omitempty"`
-	TotalPackages      int           `json:"TotalPackages,omitempty"`
-	Install            []PackageInfo `json:"Install,omitempty"`
-	Reinstall          []PackageInfo `json:"Reinstall,omitempty"`
-	Upgrade            []PackageInfo `json:"Upgrade,omitempty"`
-	Remove             []PackageInfo `json:"Remove,omitempty"`
-	Purge              []PackageInfo `json:"Purge,omitempty"`
-	InstallOperation   bool          `json:"InstallOperation,omitempty"`
-	ReinstallOperation bool          `json:"ReinstallOperation,omitempty"`
-	UpgradeOperation   bool          `json:"UpgradeOperation,omitempty"`
-	RemoveOperation    bool          `json:"RemoveOperation,omitempty"`
-	PurgeOperation     bool          `json:"PurgeOperation,omitempty"`
-	Error              string        `json:"Error,omitempty"`
-}
-
-type PackageInfo struct {
-	Name       string `json:"package"`
-	Arch       string `json:"archiecture"`
-	OldVersion string `json:"oldversion,omitempty"`
-	Version    string `json:"version"`
-}
+// Parsed APT history event (see pkg/apthistory)
+type LogJSON = apthistory.Event
+type PackageInfo = apthistory.PackageInfo
 
 // User chosen search parameters
 type SearchOptions struct {
@@ -73,19 +59,54 @@ type SearchOptions struct {
 	cmdLine        string
 	userName       string
 	userID         string
+	query          string
+	versionLT      string
+	versionLE      string
+	versionGT      string
+	versionGE      string
+	outputFormat   string
+	limit          int
+	offset         int
+	jobs           int
+	timezone       string
+	useIndex       bool
+	schemaVersion  int
+	perPackage     bool
+	chunkSize      int
+	outOfWindow    bool
+	origin         string
+	explicit       bool
+	recordSource   bool
+	keepRaw        bool
+	configPath     string
+}
+
+// User chosen daemon behavior
+type DaemonOptions struct {
+	indexEvents   bool
+	schemaVersion int
+	outputFormat  string
+	perPackage    bool
+	chunkSize     int // Maximum record size on stdout (journald)
+	fileChunkSize int // Maximum record size in the output file
+	configPath    string
+	policyPath    string
+	// Event hook
+	onEventCommand string
+	onEventTimeout time.Duration
+	onEventJobs    int
+	onEventFailure string
+	restartCheck   bool     // Flag events needing a reboot or service restarts
+	recordSource   bool     // Add log file, inode and byte offsets to events
+	keepRaw        bool     // Add raw event lines to events
+	host           hostInfo // Host details for schema mapped output
 }
 
 // Parsed search parameters
 type SearchParameters struct {
-	eventID        string
 	startTimestamp time.Time
 	endTimestamp   time.Time
-	pkgName        *regexp.Regexp
-	pkgVersion     *regexp.Regexp
-	operation      *regexp.Regexp
-	cmdLine        *regexp.Regexp
-	userName       *regexp.Regexp
-	userID         int
+	matcher        apthistory.Matcher // All filters combined
 }
 
 type SearchOutput struct {
@@ -93,10 +114,18 @@ type SearchOutput struct {
 	Results      []LogJSON `json:"results"`
 }
 
+type SearchOutputV2 struct {
+	SchemaVersion int                  `json:"schema_version"`
+	TotalResults  int                  `json:"total_results"`
+	Results       []apthistory.EventV2 `json:"results"`
+}
+
 // #### Written to only from main
 
 var dryRunRequested bool // for printing relevant information and bailing out before processing
 
+var programVersion string // for output formats that identify the producing program
+
 // Integer for printing increasingly detailed information as program progresses
 //
 //	0 - None: quiet (prints nothing but errors)
@@ -114,8 +143,19 @@ var globalVerbosityLevel int
 func main() {
 	// Program Argument Variables
 	var daemonMode bool
+	var daemonOpts DaemonOptions
 	var logFileInput string
 	var outputFile string
+	var chunkSize int
+	var perPackage bool
+	var recordSource bool
+	var keepRaw bool
+	var policyCheckRequested bool
+	var kernelsRequested bool
+	var printSchema bool
+	var schemaVersion int
+	var reassemble bool
+	var rebuildIndex bool
 	var searchMode bool
 	var searchOpts SearchOptions
 	var versionInfoRequested bool
@@ -127,19 +167,56 @@ APT History Logger (APTHL)
 
   Options:
     -d, --daemon                                   Run continously
-    -l, --log-file <path/to/log>                   Input log file [default: /var/log/apt/history.log]
+    -l, --log-file <path/to/log>                   Input log file, directory, glob or '-' for stdin [default: /var/log/apt/history.log]
     -o, --out-file <path/to/file>                  Output to a file instead of stdout
+        --on-event <command>                       Run command for each event with the event JSON on stdin (daemon)
+        --on-event-timeout <duration>              Time limit for each run of the event command [default: 30s]
+        --on-event-jobs <num>                      Number of event commands running at once, except in block mode [default: 1]
+        --on-event-failure <ignore|retry|block>    What to do when the event command fails [default: ignore]
+    -c, --config <path/to/file>                    Configuration file (alert rules, maintenance windows, origin patterns) [default: /etc/apthl/apthl.json]
+        --policy <path/to/file>                    Package policy file (denied, required and pinned packages) [default: /etc/apthl/policy.json]
+        --policy-check                             Check all events in the log file and its archives against the package policy
+                                                     Exits with 2 if any event violates the policy (--format json|ndjson|table)
+        --kernels                                  Report kernel installs and removals from the log file and its archives
+                                                     with the running kernel and cleanup candidates (--format json|ndjson|table)
+        --schema-version <1|2>                     JSON output schema version [default: 1]
+        --print-schema                             Print the JSON Schema of the output for the chosen schema version
+        --per-package                              Output one record per package change instead of one per event (daemon and search)
+        --source                                   Add the log file, inode and byte offsets of each event to the output (daemon and search)
+        --raw                                      Add the raw event lines from the log to the output (daemon and search)
+        --chunk-size      <bytes>                  Split events larger than this into chunks on stdout (JSON, CEF, LEEF) [default: 15984, 0 for never]
+        --file-chunk-size <bytes>                  Split events larger than this into chunks in the output file [default: 0 (never)]
+        --reassemble                               Read NDJSON output and write whole events, joining chunks and flagging incomplete events
+        --index                                    Also store parsed events in the local event index (daemon)
+        --restart-check                            Flag events that need a reboot or leave services running replaced files (daemon)
+        --rebuild-index                            Rebuild local event index from log file and its rotated archives
     -s, --search                                   Search through log file for given search parameters
         --time-order      <asc|desc>               Order search output ascending/descending by start timestamp [default: asc]
-        --start-timestamp <2010-12-31T23:59:59>    Filter start time of search [default: 1 week ago]
-        --end-timestamp   <2011-12-31T23:59:59>    Filter end time of search [default: now]
+        --format          <fmt>                    Output format [default: json]
+                                                     search: json|ndjson|csv|tsv|table|markdown|flat|ecs|ocsf|cef|leef, daemon: json|ecs|ocsf|cef|leef
+        --limit           <num>                    Stop after this many search results [default: 0 (unlimited)]
+        --offset          <num>                    Skip this many search results before output [default: 0]
+        --jobs            <num>                    Number of log files to search concurrently [default: number of CPUs]
+        --start-timestamp <time>                   Filter start time of search [default: 1 week ago]
+        --end-timestamp   <time>                   Filter end time of search [default: now]
+                                                     (2010-12-31[T23:59:59], RFC3339, -3d, 2h ago, yesterday, last monday)
+        --tz              <zone>                   Timezone for search times without an offset [default: Local]
         --event-id        <uuid>                   Filter by specific event id
         --command-line    <text>                   Filter command line
         --package-name    <pkg>                    Filter package name
         --package-version <ver>                    Filter package version
-        --operation <op>                           Filter APT operation (install|reinstall|upgrade|remove|purge)
+        --version-lt <ver>                         Filter packages with new or old version lower than given Debian version
+        --version-le <ver>                         Filter packages with new or old version lower than or equal to given Debian version
+        --version-gt <ver>                         Filter packages with new or old version higher than given Debian version
+        --version-ge <ver>                         Filter packages with new or old version higher than or equal to given Debian version
+        --operation <op>                           Filter APT operation (install|reinstall|upgrade|downgrade|remove|purge)
         --user-name <name>                         Filter user that initiated operation by name
         --user-uid  <num>                          Filter user that initiated operation by ID
+        --origin <origin>                          Filter how the APT run was started (interactive|unattended|config_management|gui|unknown)
+        --explicit                                 Only show packages named on the APT command line, not pulled in as dependencies
+        --query <expr>                             Filter using a boolean query expression (see README)
+        --use-index                                Search the local event index instead of log files
+        --out-of-window                            Only show events outside of the maintenance windows in the configuration file
     -T, --dry-run                                  Does all startups except process the log file
     -h, --help                                     Show this help menu
     -v, --verbose <0...5>                          Increase details and frequency of progress messages [default: 1]
@@ -157,18 +234,52 @@ General help using GNU software: <https://www.gnu.org/gethelp/>
 	flag.StringVar(&logFileInput, "log-file", "/var/log/apt/history.log", "")
 	flag.StringVar(&outputFile, "o", "", "")
 	flag.StringVar(&outputFile, "out-file", "", "")
+	flag.StringVar(&daemonOpts.configPath, "c", defaultConfigPath, "")
+	flag.StringVar(&daemonOpts.configPath, "config", defaultConfigPath, "")
+	flag.StringVar(&daemonOpts.policyPath, "policy", defaultPolicyPath, "")
+	flag.StringVar(&daemonOpts.onEventCommand, "on-event", "", "")
+	flag.DurationVar(&daemonOpts.onEventTimeout, "on-event-timeout", 30*time.Second, "")
+	flag.IntVar(&daemonOpts.onEventJobs, "on-event-jobs", 1, "")
+	flag.StringVar(&daemonOpts.onEventFailure, "on-event-failure", "ignore", "")
+	flag.BoolVar(&policyCheckRequested, "policy-check", false, "")
+	flag.BoolVar(&kernelsRequested, "kernels", false, "")
+	flag.IntVar(&schemaVersion, "schema-version", apthistory.SchemaVersion1, "")
+	flag.BoolVar(&printSchema, "print-schema", false, "")
+	flag.BoolVar(&perPackage, "per-package", false, "")
+	flag.BoolVar(&recordSource, "source", false, "")
+	flag.BoolVar(&keepRaw, "raw", false, "")
+	flag.IntVar(&chunkSize, "chunk-size", journalDMaxSize, "")
+	flag.IntVar(&daemonOpts.fileChunkSize, "file-chunk-size", 0, "")
+	flag.BoolVar(&reassemble, "reassemble", false, "")
+	flag.BoolVar(&daemonOpts.indexEvents, "index", false, "")
+	flag.BoolVar(&daemonOpts.restartCheck, "restart-check", false, "")
+	flag.BoolVar(&rebuildIndex, "rebuild-index", false, "")
 	flag.BoolVar(&searchMode, "s", false, "")
 	flag.BoolVar(&searchMode, "search", false, "")
 	flag.StringVar(&searchOpts.outputOrder, "time-order", "asc", "")
+	flag.StringVar(&searchOpts.outputFormat, "format", "json", "")
+	flag.IntVar(&searchOpts.limit, "limit", 0, "")
+	flag.IntVar(&searchOpts.offset, "offset", 0, "")
+	flag.IntVar(&searchOpts.jobs, "jobs", runtime.NumCPU(), "")
 	flag.StringVar(&searchOpts.startTimestamp, "start-timestamp", "", "")
 	flag.StringVar(&searchOpts.endTimestamp, "end-timestamp", "", "")
+	flag.StringVar(&searchOpts.timezone, "tz", "", "")
 	flag.StringVar(&searchOpts.eventID, "event-id", "", "")
 	flag.StringVar(&searchOpts.cmdLine, "command-line", "", "")
 	flag.StringVar(&searchOpts.pkgName, "package-name", "", "")
 	flag.StringVar(&searchOpts.pkgVersion, "package-version", "", "")
+	flag.StringVar(&searchOpts.versionLT, "version-lt", "", "")
+	flag.StringVar(&searchOpts.versionLE, "version-le", "", "")
+	flag.StringVar(&searchOpts.versionGT, "version-gt", "", "")
+	flag.StringVar(&searchOpts.versionGE, "version-ge", "", "")
 	flag.StringVar(&searchOpts.operation, "operation", "", "")
 	flag.StringVar(&searchOpts.userName, "user-name", "", "")
 	flag.StringVar(&searchOpts.userID, "user-uid", "", "")
+	flag.StringVar(&searchOpts.query, "query", "", "")
+	flag.BoolVar(&searchOpts.useIndex, "use-index", false, "")
+	flag.BoolVar(&searchOpts.outOfWindow, "out-of-window", false, "")
+	flag.StringVar(&searchOpts.origin, "origin", "", "")
+	flag.BoolVar(&searchOpts.explicit, "explicit", false, "")
 	flag.BoolVar(&dryRunRequested, "T", false, "")
 	flag.BoolVar(&dryRunRequested, "dry-run", false, "")
 	flag.IntVar(&globalVerbosityLevel, "v", 1, "")
@@ -181,22 +292,58 @@ General help using GNU software: <https://www.gnu.org/gethelp/>
 	flag.Parse()
 
 	const progVersion string = "v1.0.0"
+	programVersion = progVersion
 	if versionInfoRequested {
 		fmt.Printf("APTHistoryLogger %s\n", progVersion)
 		fmt.Printf("Built using %s(%s) for %s on %s\n", runtime.Version(), runtime.Compiler, runtime.GOOS, runtime.GOARCH)
 		fmt.Print("License GPLv3+: GNU GPL version 3 or later <https://gnu.org/licenses/gpl.html>\n")
-		fmt.Print("Direct Package Imports: runtime strings compress/gzip strconv io bufio slices encoding/json flag os/signal reflect fmt time syscall regexp os bytes crypto/sha256 sync path/filepath encoding/binary\n")
+		fmt.Print("Direct Package Imports: runtime strings compress/gzip strconv io bufio slices encoding/json flag os/signal reflect fmt time syscall regexp os bytes crypto/sha256 sync path/filepath encoding/binary encoding/csv text/tabwriter os/exec errors iter encoding/hex context io/fs log/syslog net/http path unicode/utf8\n")
 		return
 	} else if versionRequested {
 		fmt.Println(progVersion)
 		return
 	}
 
+	// Output schema and record layout apply to every mode
+	if !slices.Contains(apthistory.SchemaVersions, schemaVersion) {
+		logError("Invalid schema version", fmt.Errorf("must be 1 or 2, got %d", schemaVersion))
+	}
+	daemonOpts.schemaVersion = schemaVersion
+	daemonOpts.outputFormat = searchOpts.outputFormat
+	searchOpts.schemaVersion = schemaVersion
+	daemonOpts.perPackage = perPackage
+	searchOpts.perPackage = perPackage
+	daemonOpts.recordSource = recordSource
+	searchOpts.recordSource = recordSource
+	daemonOpts.keepRaw = keepRaw
+	searchOpts.keepRaw = keepRaw
+
+	for _, size := range []int{chunkSize, daemonOpts.fileChunkSize} {
+		if size != 0 && size < minimumChunkSize {
+			logError("Invalid chunk size", fmt.Errorf("must be 0 (never split) or at least %d bytes, got %d", minimumChunkSize, size))
+		}
+	}
+	daemonOpts.chunkSize = chunkSize
+	searchOpts.chunkSize = chunkSize
+	searchOpts.configPath = daemonOpts.configPath
+
 	// Act on User Choices
-	if daemonMode {
-		logReaderContinuous(logFileInput, outputFile)
+	if printSchema {
+		schema, err := apthistory.JSONSchema(schemaVersion, parseErrorRecordSchema, policyViolationRecordSchema)
+		logError("Failed to generate JSON schema", err)
+		fmt.Println(string(schema))
+	} else if daemonMode {
+		logReaderContinuous(logFileInput, outputFile, daemonOpts)
 	} else if searchMode {
 		search(logFileInput, searchOpts)
+	} else if reassemble {
+		reassembleEvents(logFileInput, schemaVersion)
+	} else if policyCheckRequested {
+		policyCheck(logFileInput, daemonOpts.policyPath, searchOpts.outputFormat)
+	} else if kernelsRequested {
+		kernelReport(logFileInput, searchOpts.outputFormat)
+	} else if rebuildIndex {
+		rebuildEventIndex(logFileInput, daemonOpts.configPath)
 	} else {
 		printMessage(verbosityStandard, "No arguments specified or incorrect argument combination. Use '-h' or '--help' to guide your way.\n")
 	}
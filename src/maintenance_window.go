@@ -0,0 +1,338 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Period in which package changes are allowed
+// Defined either by weekdays with a time range, or by a cron schedule for the start of the window and its duration
+type MaintenanceWindowConfig struct {
+	Name     string   `json:"name"`
+	Days     []string `json:"days"`     // Weekdays (mon, tue-thu, ...) the window starts on [default: every day]
+	Start    string   `json:"start"`    // Start time of day (HH:MM)
+	End      string   `json:"end"`      // End time of day (HH:MM, up to 24:00), before start for windows past midnight
+	Schedule string   `json:"schedule"` // Cron expression (minute hour day-of-month month day-of-week) for the window start
+	Duration string   `json:"duration"` // Length of scheduled windows (Go duration, at most 7 days)
+	Timezone string   `json:"timezone"` // IANA timezone of the window [default: Local]
+}
+
+// Longest supported scheduled window, bounds the backwards search for a schedule start
+const maxWindowDuration = 7 * 24 * time.Hour
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type maintenanceWindow struct {
+	name     string
+	location *time.Location
+	days     [7]bool // By time.Weekday
+	start    int     // Seconds into the day
+	end      int
+	schedule *cronSchedule
+	duration time.Duration
+}
+
+type maintenanceWindows []maintenanceWindow
+
+func newMaintenanceWindows(configs []MaintenanceWindowConfig) (windows maintenanceWindows, err error) {
+	var names []string
+	for index, config := range configs {
+		if config.Name == "" {
+			err = fmt.Errorf("maintenance window %d: missing name", index+1)
+			return
+		}
+		if slices.Contains(names, config.Name) {
+			err = fmt.Errorf("maintenance window %s: name is used by another window", config.Name)
+			return
+		}
+		names = append(names, config.Name)
+
+		var window maintenanceWindow
+		window, err = newMaintenanceWindow(config)
+		if err != nil {
+			err = fmt.Errorf("maintenance window %s: %v", config.Name, err)
+			return
+		}
+		windows = append(windows, window)
+	}
+	return
+}
+
+func newMaintenanceWindow(config MaintenanceWindowConfig) (window maintenanceWindow, err error) {
+	window.name = config.Name
+
+	window.location = time.Local
+	if config.Timezone != "" {
+		window.location, err = time.LoadLocation(config.Timezone)
+		if err != nil {
+			err = fmt.Errorf("invalid timezone: %v", err)
+			return
+		}
+	}
+
+	if config.Schedule != "" {
+		if len(config.Days) > 0 || config.Start != "" || config.End != "" {
+			err = fmt.Errorf("schedule cannot be combined with days, start or end")
+			return
+		}
+
+		window.schedule, err = parseCronSchedule(config.Schedule)
+		if err != nil {
+			err = fmt.Errorf("invalid schedule: %v", err)
+			return
+		}
+
+		window.duration, err = time.ParseDuration(config.Duration)
+		if err != nil || window.duration <= 0 || window.duration > maxWindowDuration {
+			err = fmt.Errorf("invalid duration '%s': must be a positive duration of at most 168h", config.Duration)
+			return
+		}
+		return
+	}
+
+	if config.Duration != "" {
+		err = fmt.Errorf("duration is only used with a schedule")
+		return
+	}
+
+	window.start, err = parseTimeOfDay(config.Start)
+	if err != nil {
+		err = fmt.Errorf("invalid start: %v", err)
+		return
+	}
+	window.end, err = parseTimeOfDay(config.End)
+	if err != nil {
+		err = fmt.Errorf("invalid end: %v", err)
+		return
+	}
+	if window.start == window.end {
+		err = fmt.Errorf("start and end must differ")
+		return
+	}
+
+	if len(config.Days) == 0 {
+		window.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, day := range config.Days {
+		err = setWeekdays(&window.days, day)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Parses HH:MM into seconds since midnight, allowing 24:00 for the end of the day
+func parseTimeOfDay(value string) (seconds int, err error) {
+	hourText, minuteText, found := strings.Cut(value, ":")
+	hour, hourErr := strconv.Atoi(hourText)
+	minute, minuteErr := strconv.Atoi(minuteText)
+	if !found || hourErr != nil || minuteErr != nil || hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		err = fmt.Errorf("'%s' is not a time of day (HH:MM)", value)
+		return
+	}
+
+	seconds = hour*3600 + minute*60
+	return
+}
+
+// Enables a single weekday (mon) or an inclusive range of weekdays (fri-mon)
+func setWeekdays(days *[7]bool, value string) (err error) {
+	firstName, lastName, isRange := strings.Cut(strings.ToLower(value), "-")
+	if !isRange {
+		lastName = firstName
+	}
+
+	first := slices.Index(weekdayNames, firstName)
+	last := slices.Index(weekdayNames, lastName)
+	if first == -1 || last == -1 {
+		err = fmt.Errorf("unknown weekday '%s': must be one of %s or a range like mon-fri", value, strings.Join(weekdayNames, ", "))
+		return
+	}
+
+	for day := first; ; day = (day + 1) % 7 {
+		days[day] = true
+		if day == last {
+			break
+		}
+	}
+	return
+}
+
+// Reports if the time is inside any occurrence of the window
+func (window maintenanceWindow) contains(moment time.Time) bool {
+	moment = moment.In(window.location)
+
+	if window.schedule != nil {
+		// Window is open if a scheduled start lies within the duration before this moment
+		scheduledStart := moment.Truncate(time.Minute)
+		for moment.Sub(scheduledStart) < window.duration {
+			if window.schedule.matches(scheduledStart) {
+				return true
+			}
+			scheduledStart = scheduledStart.Add(-time.Minute)
+		}
+		return false
+	}
+
+	secondOfDay := moment.Hour()*3600 + moment.Minute()*60 + moment.Second()
+	weekday := moment.Weekday()
+	if window.start < window.end {
+		return window.days[weekday] && secondOfDay >= window.start && secondOfDay < window.end
+	}
+
+	// Window runs past midnight into the next day
+	previousDay := (weekday + 6) % 7
+	return (window.days[weekday] && secondOfDay >= window.start) || (window.days[previousDay] && secondOfDay < window.end)
+}
+
+// Returns the name of the first window the whole event (start and end) ran in, empty if the event ran outside of all windows
+func (windows maintenanceWindows) classify(log LogJSON) (windowName string, err error) {
+	start, err := time.Parse(time.RFC3339, log.StartTimestamp)
+	if err != nil {
+		err = fmt.Errorf("failed parsing start time: %v", err)
+		return
+	}
+	end, err := time.Parse(time.RFC3339, log.EndTimeStamp)
+	if err != nil {
+		err = fmt.Errorf("failed parsing end time: %v", err)
+		return
+	}
+
+	for _, window := range windows {
+		if window.contains(start) && window.contains(end) {
+			windowName = window.name
+			return
+		}
+	}
+	return
+}
+
+// Marks the event as in or out of window, events are left unmarked when no windows are defined
+func (windows maintenanceWindows) flag(log *LogJSON) (err error) {
+	if len(windows) == 0 {
+		return
+	}
+
+	log.MaintenanceWindow, err = windows.classify(*log)
+	if err != nil {
+		return
+	}
+	log.OutOfWindow = log.MaintenanceWindow == ""
+	return
+}
+
+// ###################################
+//      CRON SCHEDULES
+// ###################################
+
+// Standard five field cron expression
+type cronSchedule struct {
+	minutes     []bool
+	hours       []bool
+	daysOfMonth []bool
+	months      []bool
+	daysOfWeek  []bool
+	anyDay      [2]bool // Day of month and day of week were '*'
+}
+
+func parseCronSchedule(expression string) (schedule *cronSchedule, err error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		err = fmt.Errorf("'%s' must have five fields (minute hour day-of-month month day-of-week)", expression)
+		return
+	}
+
+	schedule = &cronSchedule{}
+	bounds := []struct {
+		values   *[]bool
+		min, max int
+	}{
+		{&schedule.minutes, 0, 59},
+		{&schedule.hours, 0, 23},
+		{&schedule.daysOfMonth, 1, 31},
+		{&schedule.months, 1, 12},
+		{&schedule.daysOfWeek, 0, 7},
+	}
+	for index, bound := range bounds {
+		*bound.values, err = parseCronField(fields[index], bound.min, bound.max)
+		if err != nil {
+			return
+		}
+	}
+
+	// Sunday can be written as 0 or 7
+	schedule.daysOfWeek[0] = schedule.daysOfWeek[0] || schedule.daysOfWeek[7]
+	schedule.anyDay = [2]bool{fields[2] == "*", fields[4] == "*"}
+	return
+}
+
+// Parses a cron field of comma separated values, ranges (a-b) and steps (*/n, a-b/n)
+func parseCronField(field string, min int, max int) (values []bool, err error) {
+	values = make([]bool, max+1)
+
+	for part := range strings.SplitSeq(field, ",") {
+		valueRange, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			step, err = strconv.Atoi(stepText)
+			if err != nil || step < 1 {
+				err = fmt.Errorf("invalid step in '%s'", part)
+				return
+			}
+		}
+
+		first, last := min, max
+		if valueRange != "*" {
+			firstText, lastText, isRange := strings.Cut(valueRange, "-")
+			first, err = strconv.Atoi(firstText)
+			if err != nil {
+				err = fmt.Errorf("invalid value in '%s'", part)
+				return
+			}
+			last = first
+			if isRange {
+				last, err = strconv.Atoi(lastText)
+				if err != nil {
+					err = fmt.Errorf("invalid value in '%s'", part)
+					return
+				}
+			} else if hasStep {
+				last = max
+			}
+		}
+		if first < min || last > max || first > last {
+			err = fmt.Errorf("'%s' is outside of %d-%d", part, min, max)
+			return
+		}
+
+		for value := first; value <= last; value += step {
+			values[value] = true
+		}
+	}
+	return
+}
+
+func (schedule *cronSchedule) matches(moment time.Time) bool {
+	if !schedule.minutes[moment.Minute()] || !schedule.hours[moment.Hour()] || !schedule.months[moment.Month()] {
+		return false
+	}
+
+	// Like cron, a restricted day of month and day of week match if either one does
+	dayOfMonth := schedule.daysOfMonth[moment.Day()]
+	dayOfWeek := schedule.daysOfWeek[moment.Weekday()]
+	switch {
+	case schedule.anyDay[0] && schedule.anyDay[1]:
+		return true
+	case schedule.anyDay[0]:
+		return dayOfWeek
+	case schedule.anyDay[1]:
+		return dayOfMonth
+	default:
+		return dayOfMonth || dayOfWeek
+	}
+}
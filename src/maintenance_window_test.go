@@ -0,0 +1,54 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowContains(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    MaintenanceWindowConfig
+		moment    string
+		want      bool
+		wantError bool
+	}{
+		{name: "Inside weekday range", config: MaintenanceWindowConfig{Days: []string{"sun"}, Start: "02:00", End: "06:00", Timezone: "UTC"}, moment: "2025-06-01T03:15:00Z", want: true},
+		{name: "End is exclusive", config: MaintenanceWindowConfig{Days: []string{"sun"}, Start: "02:00", End: "06:00", Timezone: "UTC"}, moment: "2025-06-01T06:00:00Z", want: false},
+		{name: "Wrong weekday", config: MaintenanceWindowConfig{Days: []string{"sun"}, Start: "02:00", End: "06:00", Timezone: "UTC"}, moment: "2025-06-02T03:15:00Z", want: false},
+		{name: "Window timezone", config: MaintenanceWindowConfig{Days: []string{"sun"}, Start: "02:00", End: "06:00", Timezone: "Europe/Berlin"}, moment: "2025-06-01T00:30:00Z", want: true},
+		{name: "Weekday range wraps", config: MaintenanceWindowConfig{Days: []string{"fri-mon"}, Start: "00:00", End: "24:00", Timezone: "UTC"}, moment: "2025-06-02T23:59:59Z", want: true},
+		{name: "Past midnight next day", config: MaintenanceWindowConfig{Days: []string{"sat"}, Start: "22:00", End: "02:00", Timezone: "UTC"}, moment: "2025-06-01T01:00:00Z", want: true},
+		{name: "Past midnight wrong start day", config: MaintenanceWindowConfig{Days: []string{"sat"}, Start: "22:00", End: "02:00", Timezone: "UTC"}, moment: "2025-06-02T01:00:00Z", want: false},
+		{name: "Schedule inside duration", config: MaintenanceWindowConfig{Schedule: "30 2 * * 0", Duration: "4h", Timezone: "UTC"}, moment: "2025-06-01T06:29:00Z", want: true},
+		{name: "Schedule after duration", config: MaintenanceWindowConfig{Schedule: "30 2 * * 0", Duration: "4h", Timezone: "UTC"}, moment: "2025-06-01T06:30:00Z", want: false},
+		{name: "Schedule with steps and lists", config: MaintenanceWindowConfig{Schedule: "*/15 1,3 1-7 * *", Duration: "10m", Timezone: "UTC"}, moment: "2025-06-03T03:50:00Z", want: true},
+		{name: "Invalid weekday", config: MaintenanceWindowConfig{Days: []string{"someday"}, Start: "02:00", End: "06:00"}, wantError: true},
+		{name: "Invalid time", config: MaintenanceWindowConfig{Start: "25:00", End: "06:00"}, wantError: true},
+		{name: "Schedule without duration", config: MaintenanceWindowConfig{Schedule: "0 2 * * 0"}, wantError: true},
+		{name: "Schedule with days", config: MaintenanceWindowConfig{Schedule: "0 2 * * 0", Duration: "1h", Days: []string{"sun"}}, wantError: true},
+		{name: "Invalid schedule", config: MaintenanceWindowConfig{Schedule: "0 2 * *", Duration: "1h"}, wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Name = "test"
+			window, err := newMaintenanceWindow(test.config)
+			if (err != nil) != test.wantError {
+				t.Fatalf("newMaintenanceWindow() error = %v, wantError %v", err, test.wantError)
+			}
+			if err != nil {
+				return
+			}
+
+			moment, err := time.Parse(time.RFC3339, test.moment)
+			if err != nil {
+				t.Fatalf("invalid test time: %v", err)
+			}
+			if got := window.contains(moment); got != test.want {
+				t.Errorf("contains(%s) = %v, want %v", test.moment, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OCSF schema version the events follow
+const ocsfVersion string = "1.3.0"
+
+// OCSF Application Lifecycle (class 6002) activities
+const (
+	ocsfActivityInstall int = 1
+	ocsfActivityRemove  int = 2
+	ocsfActivityUpdate  int = 8
+	ocsfActivityOther   int = 99
+)
+
+const (
+	ocsfCategoryApplication int = 6
+	ocsfClassAppLifecycle   int = 6002
+)
+
+// OCSF event for one operation of an APT event, listing every package the operation changed
+type ocsfEvent struct {
+	ActivityID   int            `json:"activity_id"`
+	ActivityName string         `json:"activity_name"`
+	CategoryUID  int            `json:"category_uid"`
+	CategoryName string         `json:"category_name"`
+	ClassUID     int            `json:"class_uid"`
+	ClassName    string         `json:"class_name"`
+	TypeUID      int            `json:"type_uid"`
+	TypeName     string         `json:"type_name"`
+	SeverityID   int            `json:"severity_id"`
+	Severity     string         `json:"severity"`
+	StatusID     int            `json:"status_id"`
+	Status       string         `json:"status"`
+	StatusDetail string         `json:"status_detail,omitempty"`
+	Time         int64          `json:"time"` // Milliseconds since epoch
+	StartTime    int64          `json:"start_time"`
+	EndTime      int64          `json:"end_time"`
+	Duration     int64          `json:"duration"` // Milliseconds
+	Message      string         `json:"message"`
+	Metadata     ocsfMetadata   `json:"metadata"`
+	Actor        *ocsfActor     `json:"actor,omitempty"`
+	Device       ocsfDevice     `json:"device"`
+	App          ocsfProduct    `json:"app"`
+	Packages     []ocsfPackage  `json:"packages"`
+	RawData      string         `json:"raw_data,omitempty"` // Raw event lines (--raw)
+	Unmapped     map[string]any `json:"unmapped,omitempty"`
+}
+
+type ocsfMetadata struct {
+	Version        string      `json:"version"`
+	Product        ocsfProduct `json:"product"`
+	UID            string      `json:"uid"`
+	CorrelationUID string      `json:"correlation_uid"` // Event ID, shared by all operations of the same APT event
+	OriginalTime   string      `json:"original_time"`
+	LogName        string      `json:"log_name"`
+}
+
+type ocsfProduct struct {
+	Name       string `json:"name"`
+	VendorName string `json:"vendor_name"`
+}
+
+type ocsfActor struct {
+	User    *ocsfUser    `json:"user,omitempty"`
+	Process *ocsfProcess `json:"process,omitempty"`
+}
+
+type ocsfUser struct {
+	Name string `json:"name,omitempty"`
+	UID  string `json:"uid"`
+}
+
+type ocsfProcess struct {
+	CmdLine string `json:"cmd_line"`
+}
+
+type ocsfDevice struct {
+	Hostname string `json:"hostname,omitempty"`
+	Name     string `json:"name,omitempty"`
+	TypeID   int    `json:"type_id"`
+	Type     string `json:"type"`
+	OS       ocsfOS `json:"os"`
+}
+
+type ocsfOS struct {
+	Name          string `json:"name"`
+	TypeID        int    `json:"type_id"`
+	Type          string `json:"type"`
+	Version       string `json:"version,omitempty"`
+	KernelRelease string `json:"kernel_release,omitempty"`
+}
+
+type ocsfPackage struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture,omitempty"`
+	Epoch        int    `json:"epoch,omitempty"`
+	Release      string `json:"release,omitempty"`
+	Purl         string `json:"purl"`
+}
+
+// Activity of each APT operation
+// Reinstalls have no matching activity and are reported as Other
+var ocsfActivities = map[string]struct {
+	id   int
+	name string
+}{
+	"install":   {ocsfActivityInstall, "Install"},
+	"reinstall": {ocsfActivityOther, "Reinstall"},
+	"upgrade":   {ocsfActivityUpdate, "Update"},
+	"downgrade": {ocsfActivityUpdate, "Update"},
+	"remove":    {ocsfActivityRemove, "Remove"},
+	"purge":     {ocsfActivityRemove, "Remove"},
+}
+
+func newOCSFDevice(host hostInfo) (device ocsfDevice) {
+	osName := host.osName
+	if osName == "" {
+		osName = "Linux"
+	}
+
+	device = ocsfDevice{
+		Hostname: host.hostname,
+		Name:     host.hostname,
+		TypeID:   0,
+		Type:     "Unknown",
+		OS: ocsfOS{
+			Name:          osName,
+			TypeID:        200,
+			Type:          "Linux",
+			Version:       host.osVersion,
+			KernelRelease: host.kernel,
+		},
+	}
+	return
+}
+
+// Maps an event to OCSF Application Lifecycle events, one per operation
+// Operations whose event would be larger than maxSize (0 for no limit) are split over several events
+// Events without packages produce a single Other activity event
+func ocsfEvents(log LogJSON, device ocsfDevice, maxSize int) (events []ocsfEvent, err error) {
+	start, _ := time.Parse(time.RFC3339, log.StartTimestamp)
+	end, _ := time.Parse(time.RFC3339, log.EndTimeStamp)
+
+	base := ocsfEvent{
+		ActivityID:   ocsfActivityOther,
+		ActivityName: "Other",
+		CategoryUID:  ocsfCategoryApplication,
+		CategoryName: "Application Activity",
+		ClassUID:     ocsfClassAppLifecycle,
+		ClassName:    "Application Lifecycle",
+		SeverityID:   1,
+		Severity:     "Informational",
+		StatusID:     1,
+		Status:       "Success",
+		Time:         start.UnixMilli(),
+		StartTime:    start.UnixMilli(),
+		EndTime:      end.UnixMilli(),
+		Duration:     int64(log.ElapsedSeconds) * 1000,
+		Metadata: ocsfMetadata{
+			Version:        ocsfVersion,
+			Product:        ocsfProduct{Name: "APT History Logger", VendorName: "EvSecDev"},
+			UID:            log.EventID,
+			CorrelationUID: log.EventID,
+			OriginalTime:   log.StartTimestamp,
+			LogName:        "apt history",
+		},
+		Device:   device,
+		App:      ocsfProduct{Name: "APT", VendorName: "Debian"},
+		Packages: []ocsfPackage{},
+		RawData:  log.Raw,
+	}
+
+	if log.RequestedBy != "" || log.CommandLine != "" {
+		base.Actor = &ocsfActor{}
+		if log.RequestedBy != "" {
+			base.Actor.User = &ocsfUser{Name: log.RequestedBy, UID: strconv.Itoa(log.RequestedByUID)}
+		}
+		if log.CommandLine != "" {
+			base.Actor.Process = &ocsfProcess{CmdLine: log.CommandLine}
+		}
+	}
+
+	if log.Error != "" {
+		base.SeverityID = 3
+		base.Severity = "Medium"
+		base.StatusID = 2
+		base.Status = "Failure"
+		base.StatusDetail = log.Error
+	}
+
+	if maxSize > 0 {
+		maxSize -= chunkMetadataSize
+	}
+
+	for _, opList := range log.OperationLists() {
+		if len(*opList.Packages) == 0 {
+			continue
+		}
+
+		var parts []ocsfEvent
+		parts, err = splitOCSFOperation(base, log, opList.Name, *opList.Packages, maxSize)
+		if err != nil {
+			return
+		}
+
+		// Parts share the correlation UID but each needs its own event UID
+		if len(parts) > 1 {
+			for index := range parts {
+				parts[index].Metadata.UID += "-part-" + strconv.Itoa(index+1)
+				parts[index].Unmapped["part_index"] = index + 1
+				parts[index].Unmapped["part_total"] = len(parts)
+			}
+		}
+		events = append(events, parts...)
+	}
+
+	if len(events) == 0 {
+		base.Message = "apt " + log.CommandLine
+		if log.Error != "" {
+			base.Message = "apt error: " + log.Error
+		}
+		events = append(events, base)
+	}
+
+	for index := range events {
+		events[index].TypeUID = events[index].ClassUID*100 + events[index].ActivityID
+		events[index].TypeName = events[index].ClassName + ": " + events[index].ActivityName
+	}
+	return
+}
+
+// Divides the packages of an operation over as many events as needed for each to fit maxSize bytes (0 for no limit)
+// Raw event text cannot be divided between packages, so it is left out of split events
+func splitOCSFOperation(base ocsfEvent, log LogJSON, operation string, packages []PackageInfo, maxSize int) (events []ocsfEvent, err error) {
+	event := newOCSFOperationEvent(base, log, operation, packages)
+	if maxSize <= 0 {
+		events = []ocsfEvent{event}
+		return
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		err = fmt.Errorf("invalid JSON: %v", err)
+		return
+	}
+
+	// A single package cannot be split any further
+	if len(eventJSON) <= maxSize || (len(packages) <= 1 && base.RawData == "") {
+		events = []ocsfEvent{event}
+		return
+	}
+
+	if base.RawData != "" {
+		base.RawData = ""
+		events, err = splitOCSFOperation(base, log, operation, packages, maxSize)
+		return
+	}
+
+	middle := len(packages) / 2
+	leftEvents, err := splitOCSFOperation(base, log, operation, packages[:middle], maxSize)
+	if err != nil {
+		return
+	}
+	rightEvents, err := splitOCSFOperation(base, log, operation, packages[middle:], maxSize)
+	if err != nil {
+		return
+	}
+	events = append(leftEvents, rightEvents...)
+	return
+}
+
+// OCSF event of one operation listing the given packages
+func newOCSFOperationEvent(base ocsfEvent, log LogJSON, operation string, packages []PackageInfo) (event ocsfEvent) {
+	event = base
+	activity := ocsfActivities[operation]
+	event.ActivityID = activity.id
+	event.ActivityName = activity.name
+	event.Metadata.UID = log.EventID + "-" + operation
+	if log.PackageIndex > 0 {
+		// Per-package records of the same operation need their own ID
+		event.Metadata.UID += "-" + strconv.Itoa(log.PackageIndex)
+	}
+	event.Unmapped = map[string]any{"operation": operation}
+	if log.PackageIndex > 0 {
+		event.Unmapped["package_index"] = log.PackageIndex
+		event.Unmapped["package_total"] = log.PackageTotal
+	}
+
+	var packageNames []string
+	event.Packages = nil
+	for _, pkg := range packages {
+		event.Packages = append(event.Packages, newOCSFPackage(pkg))
+		packageNames = append(packageNames, pkg.Name)
+
+		if pkg.OldVersion != "" {
+			previousVersions, _ := event.Unmapped["previous_versions"].(map[string]string)
+			if previousVersions == nil {
+				previousVersions = make(map[string]string)
+				event.Unmapped["previous_versions"] = previousVersions
+			}
+			previousVersions[pkg.Name] = pkg.OldVersion
+		}
+	}
+	event.Message = operation + " " + strings.Join(packageNames, " ")
+	return
+}
+
+// Splits the Debian version into OCSF package epoch, version and release
+func newOCSFPackage(pkg PackageInfo) (ocsfPkg ocsfPackage) {
+	ocsfPkg = ocsfPackage{
+		Name:         pkg.Name,
+		Version:      pkg.Version,
+		Architecture: pkg.Arch,
+		Purl:         "pkg:deb/" + pkg.Name + "@" + strings.ReplaceAll(pkg.Version, ":", "%3A"),
+	}
+	if pkg.Arch != "" {
+		ocsfPkg.Purl += "?arch=" + pkg.Arch
+	}
+
+	version, err := apthistory.ParseVersion(pkg.Version)
+	if err != nil {
+		return
+	}
+	ocsfPkg.Epoch = version.Epoch
+	ocsfPkg.Version = version.Upstream
+	ocsfPkg.Release = version.Revision
+	return
+}
@@ -0,0 +1,72 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestOCSFChunking(t *testing.T) {
+	var upgrades []PackageInfo
+	for index := range 2000 {
+		upgrades = append(upgrades, PackageInfo{Name: fmt.Sprintf("package-number-%d", index), Arch: "amd64", OldVersion: "1:2.36-9+deb12u9", Version: "1:2.36-9+deb12u10"})
+	}
+	log := LogJSON{
+		EventID:          "be15fb0b-7dff-cb97-8bf2-2bbada2040f4",
+		CommandLine:      "apt upgrade",
+		StartTimestamp:   "2025-06-01T10:00:00Z",
+		EndTimeStamp:     "2025-06-01T10:05:00Z",
+		TotalPackages:    len(upgrades) + 1,
+		Install:          []PackageInfo{{Name: "linux-image-6.1.0-22-amd64", Arch: "amd64", Version: "6.1.94-1"}},
+		Upgrade:          upgrades,
+		InstallOperation: true,
+		UpgradeOperation: true,
+		Raw:              "Start-Date: 2025-06-01  10:00:00\n" + strings.Repeat("x", 20000) + "\n",
+	}
+
+	tests := []struct {
+		name       string
+		chunkSize  int
+		wantEvents int
+	}{
+		{name: "Split to chunk size", chunkSize: journalDMaxSize},
+		{name: "No limit", chunkSize: 0, wantEvents: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines, err := mappedDocumentLines(log, "ocsf", hostInfo{}, test.chunkSize)
+			if err != nil {
+				t.Fatalf("mappedDocumentLines() unexpected error = %v", err)
+			}
+			if test.wantEvents > 0 && len(lines) != test.wantEvents {
+				t.Errorf("mappedDocumentLines() returned %d events, want %d", len(lines), test.wantEvents)
+			}
+
+			events, err := ocsfEvents(log, ocsfDevice{}, test.chunkSize)
+			if err != nil {
+				t.Fatalf("ocsfEvents() unexpected error = %v", err)
+			}
+
+			uids := make(map[string]bool)
+			var packageCount int
+			for index, event := range events {
+				if test.chunkSize > 0 && len(lines[index]) > test.chunkSize {
+					t.Errorf("event %d is %d bytes, want at most %d", index, len(lines[index]), test.chunkSize)
+				}
+				if event.Metadata.CorrelationUID != log.EventID {
+					t.Errorf("event %d correlation_uid = %s, want %s", index, event.Metadata.CorrelationUID, log.EventID)
+				}
+				if uids[event.Metadata.UID] {
+					t.Errorf("event %d reuses uid %s", index, event.Metadata.UID)
+				}
+				uids[event.Metadata.UID] = true
+				packageCount += len(event.Packages)
+			}
+			if packageCount != log.TotalPackages {
+				t.Errorf("events list %d packages, want %d", packageCount, log.TotalPackages)
+			}
+		})
+	}
+}
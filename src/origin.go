@@ -0,0 +1,56 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Extra command line pattern from the configuration file, checked before the built in patterns
+type OriginPatternConfig struct {
+	Origin  string `json:"origin"`  // interactive, unattended, config_management, gui or unknown
+	Pattern string `json:"pattern"` // Regular expression matched against the command line
+}
+
+// Parser for all history log reads, replaced by configureHistoryParser with the configured origin patterns and event extras
+var historyParser = apthistory.NewParser(apthistory.ParserOptions{})
+
+// Sets up the parser with the origin patterns of the configuration
+// Source locations and raw lines are only added to events when requested
+func configureHistoryParser(configs []OriginPatternConfig, recordSource bool, keepRaw bool) (err error) {
+	var patterns []apthistory.OriginPattern
+	for _, config := range configs {
+		if !slices.Contains(apthistory.Origins, config.Origin) {
+			err = fmt.Errorf("origin pattern '%s': unknown origin '%s': must be one of %s", config.Pattern, config.Origin, strings.Join(apthistory.Origins, ", "))
+			return
+		}
+
+		var pattern *regexp.Regexp
+		pattern, err = regexp.Compile(config.Pattern)
+		if err != nil {
+			err = fmt.Errorf("invalid origin pattern '%s': %v", config.Pattern, err)
+			return
+		}
+		patterns = append(patterns, apthistory.OriginPattern{Origin: config.Origin, Pattern: pattern})
+	}
+
+	historyParser = apthistory.NewParser(apthistory.ParserOptions{
+		OriginPatterns: patterns,
+		RecordSource:   recordSource,
+		KeepRaw:        keepRaw,
+	})
+	return
+}
+
+// Adds the fields derived from the command line to records written before they existed
+func fillCommandFields(log *LogJSON) {
+	if log.Origin == "" {
+		log.Origin = historyParser.Origin(log.CommandLine)
+	}
+	if log.Command == nil {
+		log.Command = apthistory.ParseCommandLine(log.CommandLine)
+	}
+}
@@ -0,0 +1,434 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Writes search results in a specific format
+// Formats that can stream write each result immediately, others hold results until finish
+type resultWriter interface {
+	write(log LogJSON) (err error)
+	finish() (err error)
+}
+
+var outputFormats = []string{"json", "ndjson", "csv", "tsv", "table", "markdown", "flat", "ecs", "ocsf", "cef", "leef"}
+
+// Formats the daemon can write events in
+var daemonOutputFormats = []string{"json", "ecs", "ocsf", "cef", "leef"}
+
+// Column names for formats with one row per event
+var eventColumnNames = []string{"EventID", "StartTimestamp", "EndTimeStamp", "ElapsedSeconds", "RequestedBy", "RequestedByUID", "CommandLine", "TotalPackages", "Operations", "Packages", "Error"}
+
+// Schema version applies to the JSON based formats, chunk size to the formats that split large events (CEF and LEEF)
+func newResultWriter(format string, output io.Writer, schemaVersion int, chunkSize int) (writer resultWriter, err error) {
+	switch format {
+	case "json":
+		writer = &jsonDocumentWriter{output: output, schemaVersion: schemaVersion}
+	case "ndjson":
+		writer = &ndjsonWriter{output: output, schemaVersion: schemaVersion}
+	case "csv":
+		writer = newDelimitedWriter(output, ',')
+	case "tsv":
+		writer = newDelimitedWriter(output, '\t')
+	case "table":
+		writer = &tableWriter{output: tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)}
+	case "markdown":
+		writer = &markdownWriter{output: output}
+	case "flat":
+		writer = &flatWriter{output: output}
+	case "ecs", "ocsf", "cef", "leef":
+		writer = &documentWriter{output: output, format: format, host: loadHostInfo(), chunkSize: chunkSize}
+	default:
+		err = fmt.Errorf("unknown output format '%s': must be one of %s", format, strings.Join(outputFormats, ", "))
+	}
+	return
+}
+
+// Fans each result out into one record per package change before passing it to the wrapped writer
+// Limit and offset still count whole events
+type perPackageWriter struct {
+	writer resultWriter
+}
+
+func (w *perPackageWriter) write(log LogJSON) (err error) {
+	for _, record := range log.PerPackage() {
+		err = w.writer.write(record)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (w *perPackageWriter) finish() (err error) {
+	err = w.writer.finish()
+	return
+}
+
+// ###################################
+//      JSON
+// ###################################
+
+// Single indented document with all results
+type jsonDocumentWriter struct {
+	output        io.Writer
+	schemaVersion int
+	results       []LogJSON
+}
+
+func (w *jsonDocumentWriter) write(log LogJSON) (err error) {
+	w.results = append(w.results, log)
+	return
+}
+
+func (w *jsonDocumentWriter) finish() (err error) {
+	if len(w.results) == 0 {
+		printMessage(verbosityStandard, "Search returned no results\n")
+		return
+	}
+
+	var outputJSON any
+	if w.schemaVersion == apthistory.SchemaVersion1 {
+		outputJSON = SearchOutput{TotalResults: len(w.results), Results: w.results}
+	} else {
+		outputV2 := SearchOutputV2{SchemaVersion: w.schemaVersion, TotalResults: len(w.results)}
+		for _, result := range w.results {
+			outputV2.Results = append(outputV2.Results, result.V2())
+		}
+		outputJSON = outputV2
+	}
+
+	searchResults, err := json.MarshalIndent(outputJSON, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("invalid JSON: %v", err)
+		return
+	}
+
+	_, err = fmt.Fprintf(w.output, "%s\n", string(searchResults))
+	return
+}
+
+// One JSON object per line
+type ndjsonWriter struct {
+	output        io.Writer
+	schemaVersion int
+}
+
+func (w *ndjsonWriter) write(log LogJSON) (err error) {
+	jsonLine, err := apthistory.MarshalEvent(log, w.schemaVersion)
+	if err != nil {
+		return
+	}
+
+	_, err = fmt.Fprintln(w.output, string(jsonLine))
+	return
+}
+
+func (w *ndjsonWriter) finish() (err error) {
+	return
+}
+
+// One schema mapped document (ECS, OCSF, CEF or LEEF) per line
+type documentWriter struct {
+	output    io.Writer
+	format    string
+	host      hostInfo
+	chunkSize int
+}
+
+func (w *documentWriter) write(log LogJSON) (err error) {
+	lines, err := mappedDocumentLines(log, w.format, w.host, w.chunkSize)
+	if err != nil {
+		return
+	}
+
+	for _, line := range lines {
+		_, err = fmt.Fprintln(w.output, string(line))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (w *documentWriter) finish() (err error) {
+	return
+}
+
+// Maps an event to the documents of an external schema, each encoded as one line
+// CEF and LEEF have no package arrays, so events with large package lists are split like journald output
+// OCSF events divide the packages of large operations between events
+func mappedDocumentLines(log LogJSON, format string, host hostInfo, chunkSize int) (lines [][]byte, err error) {
+	var documents []any
+	switch format {
+	case "cef", "leef":
+		var chunkedLogs []LogJSON
+		chunkedLogs, err = splitLog(log, chunkSize, apthistory.SchemaVersion1)
+		if err != nil {
+			err = fmt.Errorf("failed chunking event: %v", err)
+			return
+		}
+
+		for _, chunkedLog := range chunkedLogs {
+			if format == "cef" {
+				lines = append(lines, []byte(cefLine(chunkedLog, host)))
+			} else {
+				lines = append(lines, []byte(leefLine(chunkedLog, host)))
+			}
+		}
+		return
+	case "ecs":
+		for _, document := range ecsDocuments(log, newECSHost(host)) {
+			documents = append(documents, document)
+		}
+	case "ocsf":
+		var events []ocsfEvent
+		events, err = ocsfEvents(log, newOCSFDevice(host), chunkSize)
+		if err != nil {
+			err = fmt.Errorf("failed mapping event: %v", err)
+			return
+		}
+		for _, event := range events {
+			documents = append(documents, event)
+		}
+	}
+
+	for _, document := range documents {
+		var line []byte
+		line, err = json.Marshal(document)
+		if err != nil {
+			err = fmt.Errorf("invalid JSON: %v", err)
+			return
+		}
+		lines = append(lines, line)
+	}
+	return
+}
+
+// ###################################
+//      TABULAR
+// ###################################
+
+// Summarizes an event into the values for eventColumnNames
+func eventColumns(log LogJSON) (columns []string) {
+	var operations []string
+	var packages []string
+	for _, opList := range log.OperationLists() {
+		if len(*opList.Packages) == 0 {
+			continue
+		}
+		operations = append(operations, opList.Name)
+
+		for _, pkg := range *opList.Packages {
+			packages = append(packages, pkg.Name+":"+pkg.Arch+"="+pkg.Version)
+		}
+	}
+
+	columns = []string{
+		log.EventID,
+		log.StartTimestamp,
+		log.EndTimeStamp,
+		strconv.Itoa(log.ElapsedSeconds),
+		log.RequestedBy,
+		strconv.Itoa(log.RequestedByUID),
+		log.CommandLine,
+		strconv.Itoa(log.TotalPackages),
+		strings.Join(operations, ","),
+		strings.Join(packages, " "),
+		log.Error,
+	}
+	return
+}
+
+// CSV or TSV with a header row
+type delimitedWriter struct {
+	output        *csv.Writer
+	headerWritten bool
+}
+
+func newDelimitedWriter(output io.Writer, delimiter rune) (writer *delimitedWriter) {
+	writer = &delimitedWriter{output: csv.NewWriter(output)}
+	writer.output.Comma = delimiter
+	return
+}
+
+func (w *delimitedWriter) write(log LogJSON) (err error) {
+	if !w.headerWritten {
+		err = w.output.Write(eventColumnNames)
+		if err != nil {
+			return
+		}
+		w.headerWritten = true
+	}
+
+	err = w.output.Write(eventColumns(log))
+	if err != nil {
+		return
+	}
+
+	w.output.Flush()
+	err = w.output.Error()
+	return
+}
+
+func (w *delimitedWriter) finish() (err error) {
+	w.output.Flush()
+	err = w.output.Error()
+	return
+}
+
+// Human readable aligned columns
+type tableWriter struct {
+	output        *tabwriter.Writer
+	headerWritten bool
+}
+
+func (w *tableWriter) write(log LogJSON) (err error) {
+	if !w.headerWritten {
+		_, err = fmt.Fprintln(w.output, "START\tELAPSED\tUSER\tOPERATIONS\tPACKAGES\tCOMMAND\tERROR")
+		if err != nil {
+			return
+		}
+		w.headerWritten = true
+	}
+
+	columns := eventColumns(log)
+	user := emptyAsDash(log.RequestedBy)
+	_, err = fmt.Fprintf(w.output, "%s\t%ds\t%s\t%s\t%d\t%s\t%s\n", log.StartTimestamp, log.ElapsedSeconds, user, emptyAsDash(columns[8]), log.TotalPackages, emptyAsDash(log.CommandLine), emptyAsDash(log.Error))
+	return
+}
+
+func (w *tableWriter) finish() (err error) {
+	err = w.output.Flush()
+	return
+}
+
+// Markdown table for pasting into chat or documents
+type markdownWriter struct {
+	output        io.Writer
+	headerWritten bool
+}
+
+func (w *markdownWriter) write(log LogJSON) (err error) {
+	if !w.headerWritten {
+		header := "| Start | Elapsed | User | Operations | Packages | Command | Error |\n| --- | --- | --- | --- | --- | --- | --- |\n"
+		_, err = io.WriteString(w.output, header)
+		if err != nil {
+			return
+		}
+		w.headerWritten = true
+	}
+
+	columns := eventColumns(log)
+	row := []string{log.StartTimestamp, strconv.Itoa(log.ElapsedSeconds) + "s", log.RequestedBy, columns[8], columns[9], log.CommandLine, log.Error}
+	for index := range row {
+		row[index] = markdownEscape(row[index])
+	}
+
+	_, err = fmt.Fprintf(w.output, "| %s |\n", strings.Join(row, " | "))
+	return
+}
+
+func (w *markdownWriter) finish() (err error) {
+	return
+}
+
+func markdownEscape(text string) string {
+	text = strings.ReplaceAll(text, "|", "\\|")
+	text = strings.ReplaceAll(text, "\n", " ")
+	return text
+}
+
+// One line per package: event id, start time, user, operation, package, arch, old version, new version
+// Missing values are written as '-' so every line has the same number of fields
+type flatWriter struct {
+	output io.Writer
+}
+
+func (w *flatWriter) write(log LogJSON) (err error) {
+	user := emptyAsDash(log.RequestedBy)
+
+	var lineCount int
+	for _, opList := range log.OperationLists() {
+		for _, pkg := range *opList.Packages {
+			_, err = fmt.Fprintf(w.output, "%s %s %s %s %s %s %s %s\n", log.EventID, log.StartTimestamp, user, opList.Name, pkg.Name, emptyAsDash(pkg.Arch), emptyAsDash(pkg.OldVersion), emptyAsDash(pkg.Version))
+			if err != nil {
+				return
+			}
+			lineCount++
+		}
+	}
+
+	// Events without packages still get a line
+	if lineCount == 0 {
+		_, err = fmt.Fprintf(w.output, "%s %s %s - - - - -\n", log.EventID, log.StartTimestamp, user)
+	}
+	return
+}
+
+func (w *flatWriter) finish() (err error) {
+	return
+}
+
+// ###################################
+//      DAEMON
+// ###################################
+
+// Encodes an event as the lines written by the daemon
+// Events are split into chunks of at most chunkSize bytes (0 for never), so each line fits in the output sink
+func daemonEventLines(log LogJSON, daemonOpts DaemonOptions, chunkSize int) (lines [][]byte, err error) {
+	if daemonOpts.perPackage {
+		for _, record := range log.PerPackage() {
+			var recordLines [][]byte
+			recordLines, err = eventLines(record, daemonOpts, chunkSize)
+			if err != nil {
+				return
+			}
+			lines = append(lines, recordLines...)
+		}
+		return
+	}
+
+	lines, err = eventLines(log, daemonOpts, chunkSize)
+	return
+}
+
+// Encodes a single event (or per-package record) in the daemon output format
+func eventLines(log LogJSON, daemonOpts DaemonOptions, chunkSize int) (lines [][]byte, err error) {
+	switch daemonOpts.outputFormat {
+	case "ecs", "ocsf", "cef", "leef":
+		lines, err = mappedDocumentLines(log, daemonOpts.outputFormat, daemonOpts.host, chunkSize)
+	default:
+		var chunkedLogs []LogJSON
+		chunkedLogs, err = splitLog(log, chunkSize, daemonOpts.schemaVersion)
+		if err != nil {
+			err = fmt.Errorf("failed chunking JSON: %v", err)
+			return
+		}
+
+		for _, chunkedLog := range chunkedLogs {
+			var line []byte
+			line, err = apthistory.MarshalEvent(chunkedLog, daemonOpts.schemaVersion)
+			if err != nil {
+				return
+			}
+			lines = append(lines, line)
+		}
+	}
+	return
+}
+
+func emptyAsDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -2,215 +2,39 @@
 package main
 
 import (
-	"crypto/sha256"
+	"APTHistoryLogger/m/v2/pkg/apthistory"
 	"fmt"
 	"regexp"
 	"slices"
-	"strconv"
 	"strings"
 	"time"
 )
 
-func parseEvent(event string) (newLog LogJSON, err error) {
-	eventFields := strings.Split(event, "\n")
-
-	// Attempt to parse each field in event
-	for _, eventField := range eventFields {
-		// Skip empty
-		if eventField == "" {
-			continue
-		}
-
-		field := strings.Split(eventField, ": ")
-		if len(field) != 2 {
-			err = fmt.Errorf("unable to parse event field: unexpected value='%s'", eventField)
-			return
-		}
-
-		// Separate Field prefix (name) from its value
-		fieldPrefix := field[0]
-		fieldValue := field[1]
-
-		// Parse field values based on known prefixes
-		switch fieldPrefix {
-		case "Start-Date":
-			newLog.StartTimestamp, err = parseTimestamp(fieldValue)
-		case "End-Date":
-			newLog.EndTimeStamp, err = parseTimestamp(fieldValue)
-		case "Commandline":
-			newLog.CommandLine = fieldValue
-		case "Requested-By":
-			newLog.RequestedBy, newLog.RequestedByUID, err = parseRequester(fieldValue)
-		case "Error":
-			newLog.Error = fieldValue
-		case "Install":
-			newLog.Install, err = parsePackages(fieldValue)
-		case "Reinstall":
-			newLog.Reinstall, err = parsePackages(fieldValue)
-		case "Upgrade":
-			newLog.Upgrade, err = parsePackages(fieldValue)
-		case "Remove":
-			newLog.Remove, err = parsePackages(fieldValue)
-		case "Purge":
-			newLog.Purge, err = parsePackages(fieldValue)
-		default:
-			err = fmt.Errorf("unknown prefix '%s' with value '%s'", fieldPrefix, fieldValue)
-		}
-
-		// Check any errors after parsing
-		if err != nil {
-			err = fmt.Errorf("failed to parse field '%s': %v", fieldPrefix, err)
-			return
-		}
-	}
-
-	if len(newLog.Install) > 0 {
-		newLog.InstallOperation = true
-	}
-	if len(newLog.Reinstall) > 0 {
-		newLog.ReinstallOperation = true
-	}
-	if len(newLog.Upgrade) > 0 {
-		newLog.UpgradeOperation = true
-	}
-	if len(newLog.Remove) > 0 {
-		newLog.RemoveOperation = true
-	}
-	if len(newLog.Purge) > 0 {
-		newLog.PurgeOperation = true
-	}
-
-	// Use raw string of log data structure as source of event ID
-	eventBytes := fmt.Appendf(nil, "%v", newLog)
-	newLog.EventID = generateUUID(eventBytes)
-
-	// Calculate elapsed time of apt operation
-	newLog.ElapsedSeconds, err = calculateElaspedTime(newLog.StartTimestamp, newLog.EndTimeStamp)
-	if err != nil {
-		err = fmt.Errorf("failed to calculate elapsed time: %v", err)
+func (opts SearchOptions) parseSearchOptions() (validatedOpts SearchParameters, err error) {
+	if opts.outputOrder != "asc" && opts.outputOrder != "desc" {
+		err = fmt.Errorf("invalid time order '%s': must be asc or desc", opts.outputOrder)
 		return
 	}
-
-	// Add total package number for this operation
-	newLog.TotalPackages = len(newLog.Install) + len(newLog.Reinstall) + len(newLog.Upgrade) + len(newLog.Remove) + len(newLog.Purge)
-
-	return
-}
-
-func parseTimestamp(rawTimestamp string) (timestamp string, err error) {
-	layout := "2006-01-02  15:04:05"
-	dateTime, err := time.ParseInLocation(layout, rawTimestamp, time.Local)
-	if err != nil {
-		err = fmt.Errorf("failed parsing timestamp: %v", err)
+	if !slices.Contains(outputFormats, opts.outputFormat) {
+		err = fmt.Errorf("invalid output format '%s': must be one of %s", opts.outputFormat, strings.Join(outputFormats, ", "))
 		return
 	}
-	timestamp = dateTime.Format(time.RFC3339)
-
-	return
-}
-
-func calculateElaspedTime(startTime string, endTime string) (elapsedSeconds int, err error) {
-	// Assume input is ISO8601 format (RFC3339)
-	layout := time.RFC3339
-
-	// Parse the start time
-	start, err := time.Parse(layout, startTime)
-	if err != nil {
-		err = fmt.Errorf("invalid start time: %v", err)
+	if opts.limit < 0 || opts.offset < 0 {
+		err = fmt.Errorf("limit and offset cannot be negative")
 		return
 	}
-
-	// Parse the end time
-	end, err := time.Parse(layout, endTime)
-	if err != nil {
-		err = fmt.Errorf("invalid end time: %v", err)
+	if opts.jobs < 1 {
+		err = fmt.Errorf("number of search jobs must be at least 1")
 		return
 	}
 
-	// Calculate the duration between the start and end times
-	duration := end.Sub(start)
-
-	// Return the duration in whole seconds
-	elapsedSeconds = int(duration.Seconds())
-	return
-}
-
-func parseRequester(user string) (requester string, requeterUID int, err error) {
-	userInfo := strings.Split(user, " ")
-	if len(userInfo) == 0 {
-		err = fmt.Errorf("invalid length (length 0)")
+	location, err := loadSearchLocation(opts.timezone)
+	if err != nil {
 		return
 	}
 
-	requester = userInfo[0]
-
-	if len(userInfo) == 2 {
-		userInfo[1] = strings.TrimPrefix(userInfo[1], "(")
-		userInfo[1] = strings.TrimSuffix(userInfo[1], ")")
-
-		requeterUID, err = strconv.Atoi(userInfo[1])
-		if err != nil {
-			err = fmt.Errorf("failed to convert UID string '%s' to int", userInfo[1])
-			return
-		}
-	}
-
-	return
-}
-
-func parsePackages(rawList string) (packageList []PackageInfo, err error) {
-	// Split each package info on unique separator
-	fullList := strings.Split(rawList, "), ")
-
-	// Process each package in list for each specific info
-	for _, pkg := range fullList {
-		var packageInfo PackageInfo
-
-		// Remove known separators to get space-separated list
-		pkg = strings.TrimSuffix(pkg, ")")
-		pkg = strings.Replace(pkg, "(", "", 1)
-		pkg = strings.Replace(pkg, ",", "", 1)
-		pkg = strings.Replace(pkg, ":", " ", 1)
-
-		// Split on spaces
-		pkgFields := strings.Fields(pkg)
-
-		if len(pkgFields) < 2 {
-			err = fmt.Errorf("could identify more than 2 fields to extract name")
-			return
-		}
-
-		// Extract fields
-		packageInfo.Name = pkgFields[0]
-		packageInfo.Arch = pkgFields[1]
-		if len(pkgFields) == 4 {
-			// Automatic is from installs - installs do not require OldVersion
-			if pkgFields[3] == "automatic" {
-				packageInfo.Version = pkgFields[2]
-			} else {
-				packageInfo.OldVersion = pkgFields[2]
-				packageInfo.Version = pkgFields[3]
-			}
-		} else if len(pkgFields) == 3 {
-			packageInfo.Version = pkgFields[2]
-		}
-
-		// Add to main list
-		packageList = append(packageList, packageInfo)
-	}
-
-	return
-}
-
-func (opts SearchOptions) parseSearchOptions() (validatedOpts SearchParameters, err error) {
-	const searchTimestampLayout string = "2006-01-02T15:04:05"
-
-	if opts.eventID != "" {
-		validatedOpts.eventID = opts.eventID
-	}
-
 	if opts.startTimestamp != "" {
-		validatedOpts.startTimestamp, err = time.Parse(searchTimestampLayout, opts.startTimestamp)
+		validatedOpts.startTimestamp, err = apthistory.ParseTime(opts.startTimestamp, location)
 		if err != nil {
 			err = fmt.Errorf("failed parsing start time: %v", err)
 			return
@@ -222,7 +46,7 @@ func (opts SearchOptions) parseSearchOptions() (validatedOpts SearchParameters,
 	}
 
 	if opts.endTimestamp != "" {
-		validatedOpts.endTimestamp, err = time.Parse(searchTimestampLayout, opts.endTimestamp)
+		validatedOpts.endTimestamp, err = apthistory.ParseTime(opts.endTimestamp, location)
 		if err != nil {
 			err = fmt.Errorf("failed parsing end time: %v", err)
 			return
@@ -232,103 +56,152 @@ func (opts SearchOptions) parseSearchOptions() (validatedOpts SearchParameters,
 		validatedOpts.endTimestamp = currentTime
 	}
 
-	if opts.cmdLine != "" {
-		validatedOpts.cmdLine, err = regexp.Compile(opts.cmdLine)
+	// Time window always applies
+	var filters []apthistory.Node
+	for _, window := range []struct {
+		field    string
+		operator string
+		time     time.Time
+	}{
+		{"start", ">=", validatedOpts.startTimestamp},
+		{"end", "<=", validatedOpts.endTimestamp},
+	} {
+		var filter apthistory.CompareNode
+		filter, err = apthistory.NewComparison(window.field, window.operator, window.time.Format(time.RFC3339Nano), location)
 		if err != nil {
-			err = fmt.Errorf("failed to compile command line text as regex: %v", err)
 			return
 		}
+		filters = append(filters, filter)
+	}
+
+	// Individual filter options are translated into the equivalent query comparisons
+	optionFilters := []struct {
+		value    string
+		field    string
+		operator string
+	}{
+		{opts.eventID, "id", "="},
+		{opts.cmdLine, "cmd", "~"},
+		{opts.pkgName, "pkg", "~"},
+		{opts.pkgVersion, "version", "~"},
+		{opts.userName, "user", "~"},
+		{opts.userID, "uid", "="},
 	}
-	if opts.pkgName != "" {
-		validatedOpts.pkgName, err = regexp.Compile(opts.pkgName)
+	for _, optionFilter := range optionFilters {
+		if optionFilter.value == "" {
+			continue
+		}
+
+		var filter apthistory.CompareNode
+		filter, err = apthistory.NewComparison(optionFilter.field, optionFilter.operator, optionFilter.value, location)
 		if err != nil {
-			err = fmt.Errorf("failed to compile package name as regex: %v", err)
+			err = fmt.Errorf("invalid %s filter: %v", optionFilter.field, err)
 			return
 		}
+		filters = append(filters, filter)
+	}
+
+	// Version comparisons match if either the new or previous version of a package satisfies it
+	versionFilters := []struct {
+		value    string
+		operator string
+	}{
+		{opts.versionLT, "<"},
+		{opts.versionLE, "<="},
+		{opts.versionGT, ">"},
+		{opts.versionGE, ">="},
 	}
-	if opts.pkgVersion != "" {
-		validatedOpts.pkgVersion, err = regexp.Compile(opts.pkgVersion)
+	for _, versionFilter := range versionFilters {
+		if versionFilter.value == "" {
+			continue
+		}
+
+		var newVersion, oldVersion apthistory.CompareNode
+		newVersion, err = apthistory.NewComparison("version", versionFilter.operator, versionFilter.value, location)
+		if err != nil {
+			err = fmt.Errorf("invalid version filter: %v", err)
+			return
+		}
+		oldVersion, err = apthistory.NewComparison("oldversion", versionFilter.operator, versionFilter.value, location)
 		if err != nil {
-			err = fmt.Errorf("failed to compile package version as regex: %v", err)
+			err = fmt.Errorf("invalid version filter: %v", err)
 			return
 		}
+		filters = append(filters, apthistory.OrNode{Left: newVersion, Right: oldVersion})
 	}
+
 	if opts.operation != "" {
 		opts.operation = strings.ToLower(opts.operation)
 
-		operationCheckRegex := regexp.MustCompile(`^(install|reinstall|upgrade|remove|purge)(\|(install|reinstall|upgrade|remove|purge))*$`)
+		operationCheckRegex := regexp.MustCompile(`^(install|reinstall|upgrade|downgrade|remove|purge)(\|(install|reinstall|upgrade|downgrade|remove|purge))*$`)
 
 		if !operationCheckRegex.MatchString(opts.operation) {
-			err = fmt.Errorf("invalid operation type: must be install, reinstall, upgrade, remove, or purge (separated by '|' optionally)")
+			err = fmt.Errorf("invalid operation type: must be install, reinstall, upgrade, downgrade, remove, or purge (separated by '|' optionally)")
 			return
 		}
 
-		validatedOpts.operation, err = regexp.Compile(opts.operation)
-		if err != nil {
-			err = fmt.Errorf("failed to compile operation as regex: %v", err)
-			return
-		}
-	}
-	if opts.userName != "" {
-		validatedOpts.userName, err = regexp.Compile(opts.userName)
-		if err != nil {
-			err = fmt.Errorf("failed to compile user name as regex: %v", err)
-			return
+		var operationFilter apthistory.Node
+		for _, operation := range strings.Split(opts.operation, "|") {
+			var filter apthistory.CompareNode
+			filter, err = apthistory.NewComparison("op", "=", operation, location)
+			if err != nil {
+				return
+			}
+			if operationFilter == nil {
+				operationFilter = filter
+			} else {
+				operationFilter = apthistory.OrNode{Left: operationFilter, Right: filter}
+			}
 		}
+		filters = append(filters, operationFilter)
 	}
-	if opts.userID != "" {
-		validatedOpts.userID, err = strconv.Atoi(opts.userID)
+
+	// Packages named on the command line, combined with --package-name finds events that explicitly targeted a package
+	if opts.explicit {
+		var filter apthistory.CompareNode
+		filter, err = apthistory.NewComparison("explicit", "=", "true", location)
 		if err != nil {
-			err = fmt.Errorf("failed to compile user ID as number: %v", err)
 			return
 		}
+		filters = append(filters, filter)
 	}
 
-	return
-}
-
-func sortLogsByTimestamp(logs []LogJSON, order string) (sortedLogs []LogJSON) {
-	sortedLogs = logs
-	layout := time.RFC3339
-
-	slices.SortFunc(sortedLogs, func(a, b LogJSON) int {
-		t1, err1 := time.Parse(layout, a.StartTimestamp)
-		t2, err2 := time.Parse(layout, b.StartTimestamp)
+	if opts.origin != "" {
+		var originFilter apthistory.Node
+		for _, origin := range strings.Split(strings.ToLower(opts.origin), "|") {
+			if !slices.Contains(apthistory.Origins, origin) {
+				err = fmt.Errorf("invalid origin '%s': must be one of %s (separated by '|' optionally)", origin, strings.Join(apthistory.Origins, ", "))
+				return
+			}
 
-		if err1 != nil || err2 != nil {
-			if a.StartTimestamp < b.StartTimestamp {
-				return -1
-			} else if a.StartTimestamp > b.StartTimestamp {
-				return 1
+			var filter apthistory.CompareNode
+			filter, err = apthistory.NewComparison("origin", "=", origin, location)
+			if err != nil {
+				return
+			}
+			if originFilter == nil {
+				originFilter = filter
+			} else {
+				originFilter = apthistory.OrNode{Left: originFilter, Right: filter}
 			}
-			return 0
 		}
+		filters = append(filters, originFilter)
+	}
 
-		if order == "asc" {
-			return t1.Compare(t2)
+	if opts.query != "" {
+		var queryFilter apthistory.Node
+		queryFilter, err = apthistory.CompileQuery(opts.query, location)
+		if err != nil {
+			return
 		}
-		return t2.Compare(t1)
-	})
-
-	return
-}
-
-func generateUUID(inputData []byte) (uuid string) {
-	// Hash the data
-	hasher := sha256.New()
-	hasher.Write(inputData)
-	hashBytes := hasher.Sum(nil)
-
-	// Only using first 16 bytes
-	uuidBytes := hashBytes[:16]
+		filters = append(filters, queryFilter)
+	}
 
-	// Convert to UUID format
-	uuid = fmt.Sprintf("%08x-%04x-%04x-%04x-%012x",
-		uuidBytes[0:4],
-		uuidBytes[4:6],
-		uuidBytes[6:8],
-		uuidBytes[8:10],
-		uuidBytes[10:16])
+	// All filters must match
+	validatedOpts.matcher.Root = filters[0]
+	for _, filter := range filters[1:] {
+		validatedOpts.matcher.Root = apthistory.AndNode{Left: validatedOpts.matcher.Root, Right: filter}
+	}
 
 	return
 }
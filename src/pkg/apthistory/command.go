@@ -0,0 +1,184 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// Command line of an event split into its parts
+type Command struct {
+	Program    string          `json:"program"`
+	Subcommand string          `json:"subcommand,omitempty"`
+	Options    []CommandOption `json:"options,omitempty"`
+	Targets    []CommandTarget `json:"targets,omitempty"`
+}
+
+// Single command line option, combined short options (-qy) are split up
+type CommandOption struct {
+	Name  string `json:"name"`            // As written, like -y, --no-install-recommends or -o
+	Value string `json:"value,omitempty"` // Option argument, like Dpkg::Options::=--force-confold for -o
+}
+
+// Package argument of the command
+type CommandTarget struct {
+	Argument     string `json:"argument"` // As written, like nginx:amd64=1.22.1-9
+	Package      string `json:"package"`  // Package name, pattern or .deb file path
+	Architecture string `json:"architecture,omitempty"`
+	Version      string `json:"version,omitempty"` // From pkg=version
+	Release      string `json:"release,omitempty"` // From pkg/release
+}
+
+// Options of APT frontends that take the next argument as their value
+var valueOptions = []string{"-o", "-c", "-t", "-a", "--option", "--config-file", "--target-release", "--default-release", "--host-architecture"}
+
+// Splits a command line with shell quoting rules and sorts the words into program, subcommand, options and package targets
+// Returns nil for an empty command line
+func ParseCommandLine(commandLine string) (command *Command) {
+	words := splitWords(commandLine)
+	if len(words) == 0 {
+		return
+	}
+
+	command = &Command{Program: words[0]}
+	optionsEnded := false
+	for index := 1; index < len(words); index++ {
+		word := words[index]
+
+		if optionsEnded || !strings.HasPrefix(word, "-") || word == "-" {
+			if command.Subcommand == "" {
+				command.Subcommand = word
+			} else {
+				command.Targets = append(command.Targets, parseTarget(word))
+			}
+			continue
+		}
+
+		if word == "--" {
+			optionsEnded = true
+			continue
+		}
+
+		// Long options carry their value after '=' or in the next word
+		if strings.HasPrefix(word, "--") {
+			name, value, hasValue := strings.Cut(word, "=")
+			if !hasValue && slices.Contains(valueOptions, name) && index+1 < len(words) {
+				index++
+				value = words[index]
+			}
+			command.Options = append(command.Options, CommandOption{Name: name, Value: value})
+			continue
+		}
+
+		// Short options can be combined, a value option takes the rest of the word or the next word
+		for charIndex := 1; charIndex < len(word); charIndex++ {
+			option := CommandOption{Name: "-" + word[charIndex:charIndex+1]}
+			if slices.Contains(valueOptions, option.Name) {
+				option.Value = word[charIndex+1:]
+				if option.Value == "" && index+1 < len(words) {
+					index++
+					option.Value = words[index]
+				}
+				command.Options = append(command.Options, option)
+				break
+			}
+			command.Options = append(command.Options, option)
+		}
+	}
+	return
+}
+
+// Splits a package argument (name[:arch][=version] or name[:arch][/release])
+func parseTarget(argument string) (target CommandTarget) {
+	target.Argument = argument
+
+	// Local package files are installed by path
+	if strings.HasPrefix(argument, "/") || strings.HasPrefix(argument, ".") || strings.HasSuffix(argument, ".deb") {
+		target.Package = argument
+		return
+	}
+
+	name, version, hasVersion := strings.Cut(argument, "=")
+	if hasVersion {
+		target.Version = version
+	} else {
+		name, target.Release, _ = strings.Cut(argument, "/")
+	}
+	target.Package, target.Architecture, _ = strings.Cut(name, ":")
+	return
+}
+
+// Reports if the package was named on the command line, directly or through a glob pattern
+func (command *Command) Targeted(name string, arch string) bool {
+	if command == nil {
+		return false
+	}
+
+	for _, target := range command.Targets {
+		if target.Architecture != "" && target.Architecture != arch {
+			continue
+		}
+		if target.Package == name {
+			return true
+		}
+		if strings.ContainsAny(target.Package, "*?[") {
+			matched, _ := path.Match(target.Package, name)
+			if matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Splits a command line into words like a POSIX shell, without expansions
+// Unterminated quotes run to the end of the line
+func splitWords(commandLine string) (words []string) {
+	var word strings.Builder
+	inWord := false
+	var quote byte
+
+	for index := 0; index < len(commandLine); index++ {
+		char := commandLine[index]
+
+		switch {
+		case quote == '\'':
+			if char == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(char)
+			}
+		case quote == '"':
+			if char == '"' {
+				quote = 0
+			} else if char == '\\' && index+1 < len(commandLine) && strings.IndexByte("\"\\$`", commandLine[index+1]) >= 0 {
+				index++
+				word.WriteByte(commandLine[index])
+			} else {
+				word.WriteByte(char)
+			}
+		case char == '\'' || char == '"':
+			quote = char
+			inWord = true
+		case char == '\\' && index+1 < len(commandLine):
+			index++
+			word.WriteByte(commandLine[index])
+			inWord = true
+		case char == ' ' || char == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(char)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+	return
+}
@@ -0,0 +1,107 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	tests := []struct {
+		name        string
+		commandLine string
+		want        *Command
+	}{
+		{
+			name:        "Install with options",
+			commandLine: "apt-get install -y --no-install-recommends nginx",
+			want: &Command{
+				Program:    "apt-get",
+				Subcommand: "install",
+				Options:    []CommandOption{{Name: "-y"}, {Name: "--no-install-recommends"}},
+				Targets:    []CommandTarget{{Argument: "nginx", Package: "nginx"}},
+			},
+		},
+		{
+			name:        "Option values and combined short options",
+			commandLine: "/usr/bin/apt-get -qy -o Dpkg::Options::=--force-confold -t bookworm-backports --target-release=bookworm install",
+			want: &Command{
+				Program:    "/usr/bin/apt-get",
+				Subcommand: "install",
+				Options: []CommandOption{
+					{Name: "-q"}, {Name: "-y"},
+					{Name: "-o", Value: "Dpkg::Options::=--force-confold"},
+					{Name: "-t", Value: "bookworm-backports"},
+					{Name: "--target-release", Value: "bookworm"},
+				},
+			},
+		},
+		{
+			name:        "Version, release and architecture targets",
+			commandLine: "apt install openssl=3.0.17-1~deb12u2 curl/bookworm-backports libc6:i386 ./local_1.0_all.deb",
+			want: &Command{
+				Program:    "apt",
+				Subcommand: "install",
+				Targets: []CommandTarget{
+					{Argument: "openssl=3.0.17-1~deb12u2", Package: "openssl", Version: "3.0.17-1~deb12u2"},
+					{Argument: "curl/bookworm-backports", Package: "curl", Release: "bookworm-backports"},
+					{Argument: "libc6:i386", Package: "libc6", Architecture: "i386"},
+					{Argument: "./local_1.0_all.deb", Package: "./local_1.0_all.deb"},
+				},
+			},
+		},
+		{
+			name:        "Shell quoting",
+			commandLine: `packagekit role='update-packages' "two words" esc\ aped`,
+			want: &Command{
+				Program:    "packagekit",
+				Subcommand: "role=update-packages",
+				Targets:    []CommandTarget{{Argument: "two words", Package: "two words"}, {Argument: "esc aped", Package: "esc aped"}},
+			},
+		},
+		{
+			name:        "No subcommand",
+			commandLine: "/usr/bin/unattended-upgrade",
+			want:        &Command{Program: "/usr/bin/unattended-upgrade"},
+		},
+		{
+			name:        "Empty",
+			commandLine: "",
+			want:        nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ParseCommandLine(test.commandLine)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseCommandLine() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCommandTargeted(t *testing.T) {
+	command := ParseCommandLine("apt install nginx libc6:i386 'linux-image-6.1.*'")
+
+	tests := []struct {
+		name string
+		pkg  string
+		arch string
+		want bool
+	}{
+		{name: "Named package", pkg: "nginx", arch: "amd64", want: true},
+		{name: "Dependency", pkg: "nginx-common", arch: "all", want: false},
+		{name: "Matching architecture", pkg: "libc6", arch: "i386", want: true},
+		{name: "Other architecture", pkg: "libc6", arch: "amd64", want: false},
+		{name: "Glob pattern", pkg: "linux-image-6.1.0-40-amd64", arch: "amd64", want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := command.Targeted(test.pkg, test.arch); got != test.want {
+				t.Errorf("Targeted(%s, %s) = %v, want %v", test.pkg, test.arch, got, test.want)
+			}
+		})
+	}
+}
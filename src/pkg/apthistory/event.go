@@ -0,0 +1,124 @@
+// APTHistoryLogger/m/v2
+
+// Package apthistory parses, searches and follows APT history logs (/var/log/apt/history.log)
+//
+// Events are read from any io.Reader with a Reader, followed live from a file with a Tailer,
+// and filtered with a Matcher compiled from a query expression.
+package apthistory
+
+// Single APT history event
+type Event struct {
+	EventID            string        `json:"EventID"`
+	CommandLine        string        `json:"CommandLine"`
+	Command            *Command      `json:"Command,omitempty"`
+	StartTimestamp     string        `json:"StartTimestamp"`
+	EndTimeStamp       string        `json:"EndTimeStamp"`
+	ElapsedSeconds     int           `json:"ElapsedSeconds"`
+	RequestedBy        string        `json:"RequestedBy,omitempty"`
+	RequestedByUID     int           `json:"RequestedByUID,omitempty"`
+	TotalPackages      int           `json:"TotalPackages,omitempty"`
+	Origin             string        `json:"Origin,omitempty"`
+	PackageIndex       int           `json:"PackageIndex,omitempty"`
+	PackageTotal       int           `json:"PackageTotal,omitempty"`
+	ChunkIndex         int           `json:"ChunkIndex,omitempty"`
+	ChunkTotal         int           `json:"ChunkTotal,omitempty"`
+	ChunkOf            string        `json:"ChunkOf,omitempty"`
+	Incomplete         bool          `json:"Incomplete,omitempty"`
+	Tags               []string      `json:"Tags,omitempty"`
+	MaintenanceWindow  string        `json:"MaintenanceWindow,omitempty"`
+	OutOfWindow        bool          `json:"OutOfWindow,omitempty"`
+	RebootRequired     bool          `json:"RebootRequired,omitempty"`
+	RebootPackages     []string      `json:"RebootPackages,omitempty"`
+	RestartServices    []string      `json:"RestartServices,omitempty"`
+	RestartProcesses   []string      `json:"RestartProcesses,omitempty"`
+	Install            []PackageInfo `json:"Install,omitempty"`
+	Reinstall          []PackageInfo `json:"Reinstall,omitempty"`
+	Upgrade            []PackageInfo `json:"Upgrade,omitempty"`
+	Downgrade          []PackageInfo `json:"Downgrade,omitempty"`
+	Remove             []PackageInfo `json:"Remove,omitempty"`
+	Purge              []PackageInfo `json:"Purge,omitempty"`
+	InstallOperation   bool          `json:"InstallOperation,omitempty"`
+	ReinstallOperation bool          `json:"ReinstallOperation,omitempty"`
+	UpgradeOperation   bool          `json:"UpgradeOperation,omitempty"`
+	DowngradeOperation bool          `json:"DowngradeOperation,omitempty"`
+	RemoveOperation    bool          `json:"RemoveOperation,omitempty"`
+	PurgeOperation     bool          `json:"PurgeOperation,omitempty"`
+	Error              string        `json:"Error,omitempty"`
+	Source             *EventSource  `json:"Source,omitempty"`
+	Raw                string        `json:"Raw,omitempty"`
+}
+
+// Location of an event in the log it was parsed from
+// Offsets of compressed archives are positions in the decompressed content
+type EventSource struct {
+	File        string `json:"file,omitempty"`
+	Inode       uint64 `json:"inode,omitempty"`
+	StartOffset int64  `json:"start_offset"` // Byte offset of the Start-Date line
+	EndOffset   int64  `json:"end_offset"`   // Byte offset just past the End-Date line
+}
+
+type PackageInfo struct {
+	Name       string `json:"package"`
+	Arch       string `json:"archiecture"`
+	OldVersion string `json:"oldversion,omitempty"`
+	Version    string `json:"version"`
+}
+
+// Pointer to one operation's package list within an event
+type OperationList struct {
+	Name     string
+	Packages *[]PackageInfo
+	Flag     *bool
+}
+
+// Operation names in the order APT writes them
+var Operations = []string{"install", "reinstall", "upgrade", "downgrade", "remove", "purge"}
+
+// Package lists of an event in the order APT writes them
+func (event *Event) OperationLists() (lists []OperationList) {
+	lists = []OperationList{
+		{Name: "install", Packages: &event.Install, Flag: &event.InstallOperation},
+		{Name: "reinstall", Packages: &event.Reinstall, Flag: &event.ReinstallOperation},
+		{Name: "upgrade", Packages: &event.Upgrade, Flag: &event.UpgradeOperation},
+		{Name: "downgrade", Packages: &event.Downgrade, Flag: &event.DowngradeOperation},
+		{Name: "remove", Packages: &event.Remove, Flag: &event.RemoveOperation},
+		{Name: "purge", Packages: &event.Purge, Flag: &event.PurgeOperation},
+	}
+	return
+}
+
+// Splits the event into one record per package change, in the order APT writes them
+// Every record keeps the event metadata and is numbered with its position (from 1) among all records of the event.
+// Events without packages are returned unchanged.
+func (event Event) PerPackage() (records []Event) {
+	if event.TotalPackages == 0 {
+		records = []Event{event}
+		return
+	}
+
+	base := event
+	for _, opList := range base.OperationLists() {
+		*opList.Packages = nil
+		*opList.Flag = false
+	}
+
+	for listIndex, opList := range event.OperationLists() {
+		for _, pkg := range *opList.Packages {
+			record := base
+			recordList := record.OperationLists()[listIndex]
+			*recordList.Packages = []PackageInfo{pkg}
+			*recordList.Flag = true
+			record.PackageIndex = len(records) + 1
+			records = append(records, record)
+		}
+	}
+
+	// Raw text of the whole event is only kept once, on the first record
+	for index := range records {
+		records[index].PackageTotal = len(records)
+		if index > 0 {
+			records[index].Raw = ""
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"testing"
+)
+
+func TestPerPackage(t *testing.T) {
+	tests := []struct {
+		name         string
+		event        Event
+		wantPackages []string
+		wantOps      []string
+	}{
+		{
+			name: "Multiple operations",
+			event: Event{
+				EventID:          "be15fb0b-7dff-cb97-8bf2-2bbada2040f4",
+				RequestedBy:      "admin",
+				TotalPackages:    3,
+				Install:          []PackageInfo{{Name: "nginx", Arch: "amd64", Version: "1.22.1-9"}},
+				Upgrade:          []PackageInfo{{Name: "curl", Arch: "amd64", OldVersion: "7.88.1-10", Version: "7.88.1-10+deb12u5"}},
+				Purge:            []PackageInfo{{Name: "telnet", Arch: "amd64", Version: "0.17+2.4-2"}},
+				InstallOperation: true,
+				UpgradeOperation: true,
+				PurgeOperation:   true,
+			},
+			wantPackages: []string{"nginx", "curl", "telnet"},
+			wantOps:      []string{"install", "upgrade", "purge"},
+		},
+		{
+			name:         "No packages",
+			event:        Event{EventID: "be15fb0b-7dff-cb97-8bf2-2bbada2040f4", Error: "Sub-process returned an error code"},
+			wantPackages: []string{""},
+			wantOps:      []string{""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records := test.event.PerPackage()
+			if len(records) != len(test.wantPackages) {
+				t.Fatalf("PerPackage() returned %d records, want %d", len(records), len(test.wantPackages))
+			}
+
+			for index, record := range records {
+				var gotPackage, gotOp string
+				var packageCount, flagCount int
+				for _, opList := range record.OperationLists() {
+					for _, pkg := range *opList.Packages {
+						gotPackage = pkg.Name
+						gotOp = opList.Name
+						packageCount++
+					}
+					if *opList.Flag {
+						flagCount++
+					}
+				}
+
+				if gotPackage != test.wantPackages[index] || gotOp != test.wantOps[index] {
+					t.Errorf("record %d = %s %s, want %s %s", index, gotOp, gotPackage, test.wantOps[index], test.wantPackages[index])
+				}
+				if packageCount > 1 || flagCount != packageCount {
+					t.Errorf("record %d has %d packages and %d operation flags, want at most one of each", index, packageCount, flagCount)
+				}
+				if record.EventID != test.event.EventID || record.RequestedBy != test.event.RequestedBy || record.TotalPackages != test.event.TotalPackages {
+					t.Errorf("record %d did not keep the event metadata", index)
+				}
+
+				wantIndex, wantTotal := index+1, len(records)
+				if test.event.TotalPackages == 0 {
+					wantIndex, wantTotal = 0, 0
+				}
+				if record.PackageIndex != wantIndex || record.PackageTotal != wantTotal {
+					t.Errorf("record %d numbered %d/%d, want %d/%d", index, record.PackageIndex, record.PackageTotal, wantIndex, wantTotal)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"regexp"
+)
+
+// How an APT run was started, classified from its command line
+const (
+	OriginInteractive      = "interactive"       // apt, apt-get or aptitude run by a user
+	OriginUnattended       = "unattended"        // unattended-upgrades
+	OriginConfigManagement = "config_management" // Ansible, Puppet, Salt, Chef, cloud-init
+	OriginGUI              = "gui"               // PackageKit, aptdaemon, Synaptic
+	OriginUnknown          = "unknown"
+)
+
+var Origins = []string{OriginInteractive, OriginUnattended, OriginConfigManagement, OriginGUI, OriginUnknown}
+
+// Command line pattern that marks events with an origin
+type OriginPattern struct {
+	Origin  string
+	Pattern *regexp.Regexp
+}
+
+// Built in patterns, checked in order after any patterns from the parser options
+var DefaultOriginPatterns = []OriginPattern{
+	{OriginUnattended, regexp.MustCompile(`(^|/)unattended-upgrade(\s|$)`)},
+	{OriginGUI, regexp.MustCompile(`^(packagekit|aptdaemon)\s|(^|/)synaptic(\s|$)`)},
+	// Configuration management tools all keep existing config files without prompting
+	{OriginConfigManagement, regexp.MustCompile(`(?i)dpkg::options::=["']?--force-conf(old|def|new|miss)`)},
+	{OriginInteractive, regexp.MustCompile(`^(\S*/)?(apt|apt-get|aptitude|nala)(\s|$)`)},
+}
+
+// Classifies an event command line, the first matching pattern wins
+func (parser *Parser) Origin(commandLine string) (origin string) {
+	origin = OriginUnknown
+	if commandLine == "" {
+		return
+	}
+
+	for _, patterns := range [][]OriginPattern{parser.options.OriginPatterns, DefaultOriginPatterns} {
+		for _, pattern := range patterns {
+			if pattern.Pattern.MatchString(commandLine) {
+				origin = pattern.Origin
+				return
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,43 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestParserOrigin(t *testing.T) {
+	tests := []struct {
+		name        string
+		patterns    []OriginPattern
+		commandLine string
+		want        string
+	}{
+		{name: "Interactive apt", commandLine: "apt upgrade", want: OriginInteractive},
+		{name: "Interactive apt-get path", commandLine: "/usr/bin/apt-get install vim", want: OriginInteractive},
+		{name: "Aptitude", commandLine: "aptitude safe-upgrade", want: OriginInteractive},
+		{name: "Unattended upgrades", commandLine: "/usr/bin/unattended-upgrade", want: OriginUnattended},
+		{name: "Ansible", commandLine: "/usr/bin/apt-get -y -o Dpkg::Options::=--force-confdef -o Dpkg::Options::=--force-confold install nginx", want: OriginConfigManagement},
+		{name: "Puppet", commandLine: "/usr/bin/apt-get -q -y -o DPkg::Options::=--force-confold install nginx", want: OriginConfigManagement},
+		{name: "PackageKit", commandLine: "packagekit role='update-packages'", want: OriginGUI},
+		{name: "Aptdaemon", commandLine: "aptdaemon role='role-commit-packages' sender=':1.95'", want: OriginGUI},
+		{name: "No command line", commandLine: "", want: OriginUnknown},
+		{name: "Unrecognized", commandLine: "/usr/local/bin/patch-runner --all", want: OriginUnknown},
+		{name: "Apt prefixed name", commandLine: "apt-listbugs list", want: OriginUnknown},
+		{
+			name:        "Custom pattern first",
+			patterns:    []OriginPattern{{OriginConfigManagement, regexp.MustCompile(`^/usr/bin/apt-get -q -y install`)}},
+			commandLine: "/usr/bin/apt-get -q -y install nginx",
+			want:        OriginConfigManagement,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parser := NewParser(ParserOptions{OriginPatterns: test.patterns})
+			if got := parser.Origin(test.commandLine); got != test.want {
+				t.Errorf("Origin(%q) = %s, want %s", test.commandLine, got, test.want)
+			}
+		})
+	}
+}
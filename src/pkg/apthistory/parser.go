@@ -0,0 +1,288 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options controlling how history events are parsed
+type ParserOptions struct {
+	Location            *time.Location  // Timezone of history log timestamps [default: time.Local]
+	IgnoreUnknownFields bool            // Skip unrecognized event fields instead of failing the event
+	OriginPatterns      []OriginPattern // Command line patterns checked before DefaultOriginPatterns
+	RecordSource        bool            // Add the byte offset range of each event (and file and inode when following a file)
+	KeepRaw             bool            // Add the raw event lines to each event
+}
+
+// Converts raw APT history event blocks into events
+type Parser struct {
+	options ParserOptions
+}
+
+// Event fields used as the source of event IDs
+// Kept separate from Event so new fields never change the ID of an existing event
+type eventIDFields struct {
+	EventID            string
+	CommandLine        string
+	StartTimestamp     string
+	EndTimeStamp       string
+	ElapsedSeconds     int
+	RequestedBy        string
+	RequestedByUID     int
+	TotalPackages      int
+	Install            []PackageInfo
+	Reinstall          []PackageInfo
+	Upgrade            []PackageInfo
+	Remove             []PackageInfo
+	Purge              []PackageInfo
+	InstallOperation   bool
+	ReinstallOperation bool
+	UpgradeOperation   bool
+	RemoveOperation    bool
+	PurgeOperation     bool
+	Error              string
+}
+
+func NewParser(options ParserOptions) (parser *Parser) {
+	if options.Location == nil {
+		options.Location = time.Local
+	}
+	parser = &Parser{options: options}
+	return
+}
+
+// Parses a single event block, from the Start-Date line up to and including the End-Date line
+func (parser *Parser) Parse(eventBlock string) (newEvent Event, err error) {
+	eventFields := strings.Split(eventBlock, "\n")
+
+	// Attempt to parse each field in event
+	for _, eventField := range eventFields {
+		// Skip empty
+		if eventField == "" {
+			continue
+		}
+
+		field := strings.Split(eventField, ": ")
+		if len(field) != 2 {
+			err = fmt.Errorf("unable to parse event field: unexpected value='%s'", eventField)
+			return
+		}
+
+		// Separate Field prefix (name) from its value
+		fieldPrefix := field[0]
+		fieldValue := field[1]
+
+		// Parse field values based on known prefixes
+		switch fieldPrefix {
+		case "Start-Date":
+			newEvent.StartTimestamp, err = parser.parseTimestamp(fieldValue)
+		case "End-Date":
+			newEvent.EndTimeStamp, err = parser.parseTimestamp(fieldValue)
+		case "Commandline":
+			newEvent.CommandLine = fieldValue
+		case "Requested-By":
+			newEvent.RequestedBy, newEvent.RequestedByUID, err = parseRequester(fieldValue)
+		case "Error":
+			newEvent.Error = fieldValue
+		case "Install":
+			newEvent.Install, err = ParsePackages(fieldValue)
+		case "Reinstall":
+			newEvent.Reinstall, err = ParsePackages(fieldValue)
+		case "Upgrade":
+			newEvent.Upgrade, err = ParsePackages(fieldValue)
+		case "Downgrade":
+			newEvent.Downgrade, err = ParsePackages(fieldValue)
+		case "Remove":
+			newEvent.Remove, err = ParsePackages(fieldValue)
+		case "Purge":
+			newEvent.Purge, err = ParsePackages(fieldValue)
+		default:
+			if !parser.options.IgnoreUnknownFields {
+				err = fmt.Errorf("unknown prefix '%s' with value '%s'", fieldPrefix, fieldValue)
+			}
+		}
+
+		// Check any errors after parsing
+		if err != nil {
+			err = fmt.Errorf("failed to parse field '%s': %v", fieldPrefix, err)
+			return
+		}
+	}
+
+	for _, opList := range newEvent.OperationLists() {
+		*opList.Flag = len(*opList.Packages) > 0
+	}
+
+	// Use raw string of event data structure as source of event ID
+	eventBytes := fmt.Appendf(nil, "%v", eventIDFields{
+		EventID:            newEvent.EventID,
+		CommandLine:        newEvent.CommandLine,
+		StartTimestamp:     newEvent.StartTimestamp,
+		EndTimeStamp:       newEvent.EndTimeStamp,
+		ElapsedSeconds:     newEvent.ElapsedSeconds,
+		RequestedBy:        newEvent.RequestedBy,
+		RequestedByUID:     newEvent.RequestedByUID,
+		TotalPackages:      newEvent.TotalPackages,
+		Install:            newEvent.Install,
+		Reinstall:          newEvent.Reinstall,
+		Upgrade:            newEvent.Upgrade,
+		Remove:             newEvent.Remove,
+		Purge:              newEvent.Purge,
+		InstallOperation:   newEvent.InstallOperation,
+		ReinstallOperation: newEvent.ReinstallOperation,
+		UpgradeOperation:   newEvent.UpgradeOperation,
+		RemoveOperation:    newEvent.RemoveOperation,
+		PurgeOperation:     newEvent.PurgeOperation,
+		Error:              newEvent.Error,
+	})
+	// Downgrades were added later, they are only part of the ID source when present
+	if len(newEvent.Downgrade) > 0 {
+		eventBytes = fmt.Appendf(eventBytes, "%v", newEvent.Downgrade)
+	}
+	newEvent.EventID = generateUUID(eventBytes)
+
+	// Calculate elapsed time of apt operation
+	newEvent.ElapsedSeconds, err = calculateElaspedTime(newEvent.StartTimestamp, newEvent.EndTimeStamp)
+	if err != nil {
+		err = fmt.Errorf("failed to calculate elapsed time: %v", err)
+		return
+	}
+
+	// Add total package number for this operation
+	newEvent.TotalPackages = len(newEvent.Install) + len(newEvent.Reinstall) + len(newEvent.Upgrade) + len(newEvent.Downgrade) + len(newEvent.Remove) + len(newEvent.Purge)
+
+	newEvent.Command = ParseCommandLine(newEvent.CommandLine)
+	newEvent.Origin = parser.Origin(newEvent.CommandLine)
+
+	return
+}
+
+func (parser *Parser) parseTimestamp(rawTimestamp string) (timestamp string, err error) {
+	layout := "2006-01-02  15:04:05"
+	dateTime, err := time.ParseInLocation(layout, rawTimestamp, parser.options.Location)
+	if err != nil {
+		err = fmt.Errorf("failed parsing timestamp: %v", err)
+		return
+	}
+	timestamp = dateTime.Format(time.RFC3339)
+
+	return
+}
+
+func calculateElaspedTime(startTime string, endTime string) (elapsedSeconds int, err error) {
+	// Assume input is ISO8601 format (RFC3339)
+	layout := time.RFC3339
+
+	// Parse the start time
+	start, err := time.Parse(layout, startTime)
+	if err != nil {
+		err = fmt.Errorf("invalid start time: %v", err)
+		return
+	}
+
+	// Parse the end time
+	end, err := time.Parse(layout, endTime)
+	if err != nil {
+		err = fmt.Errorf("invalid end time: %v", err)
+		return
+	}
+
+	// Calculate the duration between the start and end times
+	duration := end.Sub(start)
+
+	// Return the duration in whole seconds
+	elapsedSeconds = int(duration.Seconds())
+	return
+}
+
+func parseRequester(user string) (requester string, requeterUID int, err error) {
+	userInfo := strings.Split(user, " ")
+	if len(userInfo) == 0 {
+		err = fmt.Errorf("invalid length (length 0)")
+		return
+	}
+
+	requester = userInfo[0]
+
+	if len(userInfo) == 2 {
+		userInfo[1] = strings.TrimPrefix(userInfo[1], "(")
+		userInfo[1] = strings.TrimSuffix(userInfo[1], ")")
+
+		requeterUID, err = strconv.Atoi(userInfo[1])
+		if err != nil {
+			err = fmt.Errorf("failed to convert UID string '%s' to int", userInfo[1])
+			return
+		}
+	}
+
+	return
+}
+
+// Parses the package list of an operation field (Install, Upgrade, ...)
+func ParsePackages(rawList string) (packageList []PackageInfo, err error) {
+	// Split each package info on unique separator
+	fullList := strings.Split(rawList, "), ")
+
+	// Process each package in list for each specific info
+	for _, pkg := range fullList {
+		var packageInfo PackageInfo
+
+		// Remove known separators to get space-separated list
+		pkg = strings.TrimSuffix(pkg, ")")
+		pkg = strings.Replace(pkg, "(", "", 1)
+		pkg = strings.Replace(pkg, ",", "", 1)
+		pkg = strings.Replace(pkg, ":", " ", 1)
+
+		// Split on spaces
+		pkgFields := strings.Fields(pkg)
+
+		if len(pkgFields) < 2 {
+			err = fmt.Errorf("could identify more than 2 fields to extract name")
+			return
+		}
+
+		// Extract fields
+		packageInfo.Name = pkgFields[0]
+		packageInfo.Arch = pkgFields[1]
+		if len(pkgFields) == 4 {
+			// Automatic is from installs - installs do not require OldVersion
+			if pkgFields[3] == "automatic" {
+				packageInfo.Version = pkgFields[2]
+			} else {
+				packageInfo.OldVersion = pkgFields[2]
+				packageInfo.Version = pkgFields[3]
+			}
+		} else if len(pkgFields) == 3 {
+			packageInfo.Version = pkgFields[2]
+		}
+
+		// Add to main list
+		packageList = append(packageList, packageInfo)
+	}
+
+	return
+}
+
+func generateUUID(inputData []byte) (uuid string) {
+	// Hash the data
+	hasher := sha256.New()
+	hasher.Write(inputData)
+	hashBytes := hasher.Sum(nil)
+
+	// Only using first 16 bytes
+	uuidBytes := hashBytes[:16]
+
+	// Convert to UUID format
+	uuid = fmt.Sprintf("%08x-%04x-%04x-%04x-%012x",
+		uuidBytes[0:4],
+		uuidBytes[4:6],
+		uuidBytes[6:8],
+		uuidBytes[8:10],
+		uuidBytes[10:16])
+
+	return
+}
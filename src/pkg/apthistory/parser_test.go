@@ -1,5 +1,5 @@
 // APTHistoryLogger/m/v2
-package main
+package apthistory
 
 import (
 	"reflect"
@@ -55,14 +55,35 @@ func TestParsePackages(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := parsePackages(test.rawList)
+			got, err := ParsePackages(test.rawList)
 			if (err != nil) != test.expectError {
-				t.Errorf("parsePackages() error = %v, expectError %v", err, test.expectError)
+				t.Errorf("ParsePackages() error = %v, expectError %v", err, test.expectError)
 				return
 			}
 			if !reflect.DeepEqual(got, test.want) {
-				t.Errorf("parsePackages() = %v, want %v", got, test.want)
+				t.Errorf("ParsePackages() = %v, want %v", got, test.want)
 			}
 		})
 	}
 }
+
+func TestParseDowngrade(t *testing.T) {
+	eventBlock := `Start-Date: 2025-06-04  09:00:00
+Commandline: apt install openssl=3.0.9-1
+Requested-By: admin (1000)
+Downgrade: openssl:amd64 (3.0.11-1~deb12u2, 3.0.9-1)
+End-Date: 2025-06-04  09:00:10`
+
+	event, err := NewParser(ParserOptions{}).Parse(eventBlock)
+	if err != nil {
+		t.Fatalf("Parse() unexpected error = %v", err)
+	}
+
+	want := []PackageInfo{{Name: "openssl", Arch: "amd64", OldVersion: "3.0.11-1~deb12u2", Version: "3.0.9-1"}}
+	if !reflect.DeepEqual(event.Downgrade, want) {
+		t.Errorf("Parse() downgrades = %v, want %v", event.Downgrade, want)
+	}
+	if !event.DowngradeOperation || event.TotalPackages != 1 {
+		t.Errorf("Parse() downgrade operation = %t, total packages = %d, want true and 1", event.DowngradeOperation, event.TotalPackages)
+	}
+}
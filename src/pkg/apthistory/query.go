@@ -0,0 +1,700 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Value types of fields available to search queries
+const (
+	fieldKindString int = iota
+	fieldKindNumber
+	fieldKindTime
+	fieldKindVersion
+)
+
+// Single evaluation unit for a query
+// Package scoped fields are evaluated against one package (and its operation) at a time
+type queryRow struct {
+	event     *Event
+	start     time.Time
+	end       time.Time
+	operation string
+	pkg       *PackageInfo
+}
+
+type queryField struct {
+	kind          int
+	packageScoped bool
+	text          func(row *queryRow) string
+	number        func(row *queryRow) int
+	time          func(row *queryRow) time.Time
+}
+
+// Compiled query expression
+// Trees are built by CompileQuery and NewComparison, and can be combined with AndNode, OrNode and NotNode
+type Node interface {
+	eval(row *queryRow) bool
+	packageScoped() bool
+}
+
+type AndNode struct{ Left, Right Node }
+type OrNode struct{ Left, Right Node }
+type NotNode struct{ Inner Node }
+
+// True when the field has a (non-zero) value
+type HasNode struct {
+	Field string
+	field queryField
+}
+
+// Comparison of a field against a value
+type CompareNode struct {
+	Field    string
+	Operator string
+	Value    string         // Value as given (lowercased for op)
+	Regex    *regexp.Regexp // Compiled value for '~' and '!~'
+	field    queryField
+	number   int
+	time     time.Time
+	version  Version
+}
+
+var fields = map[string]queryField{
+	"id": {
+		kind: fieldKindString,
+		text: func(row *queryRow) string { return row.event.EventID },
+	},
+	"cmd": {
+		kind: fieldKindString,
+		text: func(row *queryRow) string { return row.event.CommandLine },
+	},
+	"user": {
+		kind: fieldKindString,
+		text: func(row *queryRow) string { return row.event.RequestedBy },
+	},
+	"uid": {
+		kind:   fieldKindNumber,
+		number: func(row *queryRow) int { return row.event.RequestedByUID },
+	},
+	"origin": {
+		kind: fieldKindString,
+		text: func(row *queryRow) string { return row.event.Origin },
+	},
+	"error": {
+		kind: fieldKindString,
+		text: func(row *queryRow) string { return row.event.Error },
+	},
+	"elapsed": {
+		kind:   fieldKindNumber,
+		number: func(row *queryRow) int { return row.event.ElapsedSeconds },
+	},
+	"total": {
+		kind:   fieldKindNumber,
+		number: func(row *queryRow) int { return row.event.TotalPackages },
+	},
+	"start": {
+		kind: fieldKindTime,
+		time: func(row *queryRow) time.Time { return row.start },
+	},
+	"end": {
+		kind: fieldKindTime,
+		time: func(row *queryRow) time.Time { return row.end },
+	},
+	"op": {
+		kind:          fieldKindString,
+		packageScoped: true,
+		text:          func(row *queryRow) string { return row.operation },
+	},
+	"pkg": {
+		kind:          fieldKindString,
+		packageScoped: true,
+		text:          func(row *queryRow) string { return row.pkg.Name },
+	},
+	"arch": {
+		kind:          fieldKindString,
+		packageScoped: true,
+		text:          func(row *queryRow) string { return row.pkg.Arch },
+	},
+	"explicit": {
+		kind:          fieldKindString,
+		packageScoped: true,
+		text: func(row *queryRow) string {
+			if row.event.Command.Targeted(row.pkg.Name, row.pkg.Arch) {
+				return "true"
+			}
+			return ""
+		},
+	},
+	"version": {
+		kind:          fieldKindVersion,
+		packageScoped: true,
+		text:          func(row *queryRow) string { return row.pkg.Version },
+	},
+	"oldversion": {
+		kind:          fieldKindVersion,
+		packageScoped: true,
+		text:          func(row *queryRow) string { return row.pkg.OldVersion },
+	},
+}
+
+// Alternate names users can type for fields
+var fieldAliases = map[string]string{
+	"eventid":     "id",
+	"commandline": "cmd",
+	"requestedby": "user",
+	"operation":   "op",
+	"package":     "pkg",
+	"name":        "pkg",
+	"old":         "oldversion",
+	"packages":    "total",
+	"initiator":   "origin",
+	"targeted":    "explicit",
+}
+
+// ###################################
+//      EVALUATION
+// ###################################
+
+func (n AndNode) eval(row *queryRow) bool { return n.Left.eval(row) && n.Right.eval(row) }
+func (n OrNode) eval(row *queryRow) bool  { return n.Left.eval(row) || n.Right.eval(row) }
+func (n NotNode) eval(row *queryRow) bool { return !n.Inner.eval(row) }
+
+func (n AndNode) packageScoped() bool { return n.Left.packageScoped() || n.Right.packageScoped() }
+func (n OrNode) packageScoped() bool  { return n.Left.packageScoped() || n.Right.packageScoped() }
+func (n NotNode) packageScoped() bool { return n.Inner.packageScoped() }
+
+func (n HasNode) packageScoped() bool { return n.field.packageScoped }
+func (n HasNode) eval(row *queryRow) bool {
+	if n.field.packageScoped && row.pkg == nil {
+		return false
+	}
+
+	switch n.field.kind {
+	case fieldKindNumber:
+		return n.field.number(row) != 0
+	case fieldKindTime:
+		return !n.field.time(row).IsZero()
+	default:
+		return n.field.text(row) != ""
+	}
+}
+
+func (n CompareNode) packageScoped() bool { return n.field.packageScoped }
+func (n CompareNode) eval(row *queryRow) bool {
+	// Events without packages never satisfy package comparisons
+	if n.field.packageScoped && row.pkg == nil {
+		return false
+	}
+
+	var result int
+	switch n.field.kind {
+	case fieldKindNumber:
+		value := n.field.number(row)
+		if value < n.number {
+			result = -1
+		} else if value > n.number {
+			result = 1
+		}
+	case fieldKindTime:
+		result = n.field.time(row).Compare(n.time)
+	case fieldKindVersion:
+		value := n.field.text(row)
+		switch n.Operator {
+		case "~":
+			return n.Regex.MatchString(value)
+		case "!~":
+			return !n.Regex.MatchString(value)
+		}
+
+		// Packages without this version (like oldversion on installs) are never compared
+		if value == "" {
+			return false
+		}
+		version, err := ParseVersion(value)
+		if err != nil {
+			return false
+		}
+		result = version.Compare(n.version)
+	default:
+		value := n.field.text(row)
+		switch n.Operator {
+		case "~":
+			return n.Regex.MatchString(value)
+		case "!~":
+			return !n.Regex.MatchString(value)
+		}
+		result = strings.Compare(value, n.Value)
+	}
+
+	switch n.Operator {
+	case "=":
+		return result == 0
+	case "!=":
+		return result != 0
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	}
+	return false
+}
+
+// ###################################
+//      PARSING
+// ###################################
+
+type queryParser struct {
+	input    string
+	pos      int
+	location *time.Location // Timezone for dates without an offset
+}
+
+// Compiles a boolean query expression into an evaluable tree
+//
+//	expr    := or
+//	or      := and { ("or" | "||") and }
+//	and     := unary { ("and" | "&&") unary }
+//	unary   := ("not" | "!") unary | primary
+//	primary := "(" expr ")" | "has" "(" field ")" | field "in" "(" value {"," value} ")" | field operator value
+func CompileQuery(query string, location *time.Location) (node Node, err error) {
+	parser := &queryParser{input: query, location: location}
+
+	node, err = parser.parseOr()
+	if err != nil {
+		err = fmt.Errorf("invalid query: %v", err)
+		return
+	}
+
+	parser.skipSpace()
+	if parser.pos < len(parser.input) {
+		err = fmt.Errorf("invalid query: unexpected text at position %d: '%s'", parser.pos, parser.input[parser.pos:])
+		return
+	}
+	return
+}
+
+func (p *queryParser) parseOr() (node Node, err error) {
+	node, err = p.parseAnd()
+	if err != nil {
+		return
+	}
+
+	for p.consumeKeyword("or") || p.consumeSymbol("||") {
+		var right Node
+		right, err = p.parseAnd()
+		if err != nil {
+			return
+		}
+		node = OrNode{Left: node, Right: right}
+	}
+	return
+}
+
+func (p *queryParser) parseAnd() (node Node, err error) {
+	node, err = p.parseUnary()
+	if err != nil {
+		return
+	}
+
+	for p.consumeKeyword("and") || p.consumeSymbol("&&") {
+		var right Node
+		right, err = p.parseUnary()
+		if err != nil {
+			return
+		}
+		node = AndNode{Left: node, Right: right}
+	}
+	return
+}
+
+func (p *queryParser) parseUnary() (node Node, err error) {
+	p.skipSpace()
+
+	// Lone '!' negates, but '!=' and '!~' are comparison operators
+	isBang := strings.HasPrefix(p.input[p.pos:], "!") && !strings.HasPrefix(p.input[p.pos:], "!=") && !strings.HasPrefix(p.input[p.pos:], "!~")
+	if p.consumeKeyword("not") || (isBang && p.consumeSymbol("!")) {
+		var inner Node
+		inner, err = p.parseUnary()
+		if err != nil {
+			return
+		}
+		node = NotNode{Inner: inner}
+		return
+	}
+
+	node, err = p.parsePrimary()
+	return
+}
+
+func (p *queryParser) parsePrimary() (node Node, err error) {
+	if p.consumeSymbol("(") {
+		node, err = p.parseOr()
+		if err != nil {
+			return
+		}
+		if !p.consumeSymbol(")") {
+			err = fmt.Errorf("expected ')' at position %d", p.pos)
+		}
+		return
+	}
+
+	if p.consumeKeyword("has") {
+		if !p.consumeSymbol("(") {
+			err = fmt.Errorf("expected '(' after has at position %d", p.pos)
+			return
+		}
+
+		var field queryField
+		var fieldName string
+		field, fieldName, err = p.parseField()
+		if err != nil {
+			return
+		}
+
+		if !p.consumeSymbol(")") {
+			err = fmt.Errorf("expected ')' at position %d", p.pos)
+			return
+		}
+
+		node = HasNode{Field: fieldName, field: field}
+		return
+	}
+
+	field, fieldName, err := p.parseField()
+	if err != nil {
+		return
+	}
+
+	if p.consumeKeyword("in") {
+		node, err = p.parseList(field, fieldName)
+		return
+	}
+
+	operator := p.parseOperator()
+	if operator == "" {
+		err = fmt.Errorf("expected comparison operator after field '%s' at position %d", fieldName, p.pos)
+		return
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return
+	}
+
+	node, err = newComparison(field, fieldName, operator, value, p.location)
+	return
+}
+
+// Expands 'field in (a, b)' into equality comparisons joined by or
+func (p *queryParser) parseList(field queryField, fieldName string) (node Node, err error) {
+	if !p.consumeSymbol("(") {
+		err = fmt.Errorf("expected '(' after in at position %d", p.pos)
+		return
+	}
+
+	for {
+		var value string
+		value, err = p.parseValue()
+		if err != nil {
+			return
+		}
+
+		var compare Node
+		compare, err = newComparison(field, fieldName, "=", value, p.location)
+		if err != nil {
+			return
+		}
+
+		if node == nil {
+			node = compare
+		} else {
+			node = OrNode{Left: node, Right: compare}
+		}
+
+		if p.consumeSymbol(",") {
+			continue
+		}
+		if p.consumeSymbol(")") {
+			break
+		}
+		err = fmt.Errorf("expected ',' or ')' in list at position %d", p.pos)
+		return
+	}
+	return
+}
+
+func (p *queryParser) parseField() (field queryField, name string, err error) {
+	p.skipSpace()
+	start := p.pos
+	name = strings.ToLower(p.readIdentifier())
+	if name == "" {
+		err = fmt.Errorf("expected field name at position %d", start)
+		return
+	}
+
+	if alias, isAlias := fieldAliases[name]; isAlias {
+		name = alias
+	}
+
+	field, validField := fields[name]
+	if !validField {
+		err = fmt.Errorf("unknown field '%s' at position %d", name, start)
+		return
+	}
+	return
+}
+
+func (p *queryParser) parseOperator() (operator string) {
+	p.skipSpace()
+
+	// Longest operators first
+	for _, candidate := range []string{"==", "!=", "!~", "<=", ">=", "=", "<", ">", "~"} {
+		if strings.HasPrefix(p.input[p.pos:], candidate) {
+			p.pos += len(candidate)
+			operator = candidate
+			if operator == "==" {
+				operator = "="
+			}
+			return
+		}
+	}
+	return
+}
+
+// Reads either a quoted string or a bare word ending at whitespace, ',' or parentheses
+func (p *queryParser) parseValue() (value string, err error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		err = fmt.Errorf("expected value at end of query")
+		return
+	}
+
+	quote := p.input[p.pos]
+	if quote == '"' || quote == '\'' {
+		var builder strings.Builder
+		p.pos++
+		for p.pos < len(p.input) {
+			char := p.input[p.pos]
+			if char == '\\' && p.pos+1 < len(p.input) && p.input[p.pos+1] == quote {
+				builder.WriteByte(quote)
+				p.pos += 2
+				continue
+			}
+			if char == quote {
+				p.pos++
+				value = builder.String()
+				return
+			}
+			builder.WriteByte(char)
+			p.pos++
+		}
+		err = fmt.Errorf("unterminated string starting at position %d", p.pos-builder.Len()-1)
+		return
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(" \t\n(),", rune(p.input[p.pos])) {
+		p.pos++
+	}
+	value = p.input[start:p.pos]
+	if value == "" {
+		err = fmt.Errorf("expected value at position %d", start)
+	}
+	return
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.input) && strings.ContainsRune(" \t\n", rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *queryParser) readIdentifier() (identifier string) {
+	start := p.pos
+	for p.pos < len(p.input) && isIdentifierChar(p.input[p.pos]) {
+		p.pos++
+	}
+	identifier = p.input[start:p.pos]
+	return
+}
+
+// Consumes keyword only when it is a whole word (case-insensitive)
+func (p *queryParser) consumeKeyword(keyword string) (consumed bool) {
+	p.skipSpace()
+	end := p.pos + len(keyword)
+	if end > len(p.input) || !strings.EqualFold(p.input[p.pos:end], keyword) {
+		return
+	}
+	if end < len(p.input) && isIdentifierChar(p.input[end]) {
+		return
+	}
+	p.pos = end
+	consumed = true
+	return
+}
+
+func (p *queryParser) consumeSymbol(symbol string) (consumed bool) {
+	p.skipSpace()
+	if strings.HasPrefix(p.input[p.pos:], symbol) {
+		p.pos += len(symbol)
+		consumed = true
+	}
+	return
+}
+
+func isIdentifierChar(char byte) bool {
+	return char == '_' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')
+}
+
+// Creates a comparison of the named field (or alias) against a value, as if written in a query
+// Operator is one of =, !=, <, <=, >, >=, ~ (regex) or !~
+func NewComparison(fieldName string, operator string, value string, location *time.Location) (node CompareNode, err error) {
+	fieldName = strings.ToLower(fieldName)
+	if alias, isAlias := fieldAliases[fieldName]; isAlias {
+		fieldName = alias
+	}
+
+	field, validField := fields[fieldName]
+	if !validField {
+		err = fmt.Errorf("unknown field '%s'", fieldName)
+		return
+	}
+	if !slices.Contains([]string{"=", "!=", "<", "<=", ">", ">=", "~", "!~"}, operator) {
+		err = fmt.Errorf("unknown comparison operator '%s'", operator)
+		return
+	}
+
+	node, err = newComparison(field, fieldName, operator, value, location)
+	return
+}
+
+// Validates and converts the comparison value to the type of the field
+func newComparison(field queryField, fieldName string, operator string, value string, location *time.Location) (node CompareNode, err error) {
+	node.Field = fieldName
+	node.field = field
+	node.Operator = operator
+
+	isRegex := operator == "~" || operator == "!~"
+	if isRegex && field.kind != fieldKindString && field.kind != fieldKindVersion {
+		err = fmt.Errorf("regex operator '%s' is only valid for text fields, not '%s'", operator, fieldName)
+		return
+	}
+
+	switch field.kind {
+	case fieldKindNumber:
+		node.number, err = strconv.Atoi(value)
+		if err != nil {
+			err = fmt.Errorf("field '%s' requires a number, got '%s'", fieldName, value)
+			return
+		}
+	case fieldKindTime:
+		node.time, err = ParseTime(value, location)
+		if err != nil {
+			err = fmt.Errorf("field '%s' requires a date: %v", fieldName, err)
+			return
+		}
+	case fieldKindVersion:
+		node.Value = value
+		if isRegex {
+			node.Regex, err = regexp.Compile(value)
+			if err != nil {
+				err = fmt.Errorf("failed to compile regex for field '%s': %v", fieldName, err)
+				return
+			}
+			return
+		}
+
+		node.version, err = ParseVersion(value)
+		if err != nil {
+			err = fmt.Errorf("field '%s' requires a Debian version: %v", fieldName, err)
+			return
+		}
+	default:
+		if fieldName == "op" {
+			value = strings.ToLower(value)
+			if !isRegex && !slices.Contains(Operations, value) {
+				err = fmt.Errorf("invalid operation '%s': must be one of %s", value, strings.Join(Operations, ", "))
+				return
+			}
+		}
+
+		node.Value = value
+		if isRegex {
+			node.Regex, err = regexp.Compile(value)
+			if err != nil {
+				err = fmt.Errorf("failed to compile regex for field '%s': %v", fieldName, err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// ###################################
+//      MATCHING
+// ###################################
+
+// Filters events with a compiled query
+// A matcher without a root node matches every event
+type Matcher struct {
+	Root Node
+}
+
+// Evaluates the matcher against an event
+// Package scoped filters trim the package lists of the returned event down to only the packages that matched
+func (matcher Matcher) Match(event Event) (matched bool, result Event, err error) {
+	if matcher.Root == nil {
+		matched, result = true, event
+		return
+	}
+
+	row := queryRow{event: &event}
+
+	row.start, err = time.Parse(time.RFC3339, event.StartTimestamp)
+	if err != nil {
+		err = fmt.Errorf("failed parsing start time: %v", err)
+		return
+	}
+	row.end, err = time.Parse(time.RFC3339, event.EndTimeStamp)
+	if err != nil {
+		err = fmt.Errorf("failed parsing end time: %v", err)
+		return
+	}
+
+	if !matcher.Root.packageScoped() || event.TotalPackages == 0 {
+		matched = matcher.Root.eval(&row)
+		if matched {
+			result = event
+		}
+		return
+	}
+
+	result = event
+	for _, opList := range result.OperationLists() {
+		var matchedPackages []PackageInfo
+		for _, pkg := range *opList.Packages {
+			row.operation = opList.Name
+			row.pkg = &pkg
+			if matcher.Root.eval(&row) {
+				matchedPackages = append(matchedPackages, pkg)
+			}
+		}
+
+		*opList.Packages = matchedPackages
+		*opList.Flag = len(matchedPackages) > 0
+		if len(matchedPackages) > 0 {
+			matched = true
+		}
+	}
+	return
+}
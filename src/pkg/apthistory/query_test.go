@@ -0,0 +1,69 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompileQuery(t *testing.T) {
+	event := Event{
+		EventID:        "92cc42af-7d5a-e8ee-8245-1689698e0730",
+		CommandLine:    "apt-get purge telnet",
+		StartTimestamp: "2025-06-03T12:00:00Z",
+		EndTimeStamp:   "2025-06-03T12:01:05Z",
+		ElapsedSeconds: 65,
+		RequestedBy:    "bob",
+		RequestedByUID: 1001,
+		TotalPackages:  2,
+		Upgrade:        []PackageInfo{{Name: "linux-image-amd64", Arch: "amd64", OldVersion: "6.1.140-1", Version: "6.1.147-1"}},
+		Purge:          []PackageInfo{{Name: "telnet", Arch: "amd64", Version: "0.17+2.4-2"}},
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		wantMatch   bool
+		expectError bool
+	}{
+		{name: "Number comparison", query: "elapsed > 60", wantMatch: true},
+		{name: "Negated user", query: "user != root", wantMatch: true},
+		{name: "Regex package", query: `pkg ~ "^linux-image"`, wantMatch: true},
+		{name: "Operation list", query: "op in (install, remove)", wantMatch: false},
+		{name: "Has error", query: "has(error)", wantMatch: false},
+		{name: "Not has error", query: "not has(error)", wantMatch: true},
+		{name: "Precedence", query: "uid = 0 and elapsed > 60 or pkg = telnet", wantMatch: true},
+		{name: "Parentheses", query: "uid = 0 and (elapsed > 60 or pkg = telnet)", wantMatch: false},
+		{name: "Same package", query: "pkg = telnet and op = upgrade", wantMatch: false},
+		{name: "Date comparison", query: "start >= 2025-06-03 and end < 2025-06-04", wantMatch: true},
+		{name: "Symbolic operators", query: "!(uid == 0) && (op = purge || op = remove)", wantMatch: true},
+		{name: "Quoted value", query: `cmd = 'apt-get purge telnet'`, wantMatch: true},
+		{name: "Unknown field", query: "color = blue", expectError: true},
+		{name: "Invalid operation", query: "op = destroy", expectError: true},
+		{name: "Number field regex", query: "uid ~ 100", expectError: true},
+		{name: "Unclosed parenthesis", query: "(uid = 0", expectError: true},
+		{name: "Trailing text", query: "uid = 0 uid", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := CompileQuery(test.query, time.UTC)
+			if (err != nil) != test.expectError {
+				t.Errorf("CompileQuery() error = %v, expectError %v", err, test.expectError)
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			searchMatched, _, err := Matcher{Root: root}.Match(event)
+			if err != nil {
+				t.Errorf("Match() unexpected error = %v", err)
+				return
+			}
+			if searchMatched != test.wantMatch {
+				t.Errorf("Match() = %v, want %v", searchMatched, test.wantMatch)
+			}
+		})
+	}
+}
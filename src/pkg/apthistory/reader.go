@@ -0,0 +1,187 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Event block that could not be parsed
+// Readers and tailers skip past the block, so reading can continue after this error
+type ParseError struct {
+	Block     string // Raw event lines
+	Offset    int64  // Byte offset of the block start in the (decompressed) input
+	EndOffset int64  // Byte offset just past the block
+	Err       error
+}
+
+func (parseErr *ParseError) Error() string {
+	return fmt.Sprintf("failed to parse log entry at offset %d: %v", parseErr.Offset, parseErr.Err)
+}
+
+func (parseErr *ParseError) Unwrap() error {
+	return parseErr.Err
+}
+
+// Streams events from APT history log content
+type Reader struct {
+	input  *bufio.Reader
+	parser *Parser
+	block  eventBlock
+}
+
+// Lines of an event between Start-Date and End-Date
+type eventBlock struct {
+	lines       strings.Builder
+	started     bool
+	startOffset int64
+	offset      int64 // Bytes consumed from input so far
+}
+
+// Returns a buffered reader of the input, transparently decompressing gzip content
+func Decompress(input io.Reader) (output *bufio.Reader, err error) {
+	output = bufio.NewReader(input)
+
+	magic, err := output.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("failed to read log: %v", err)
+		return
+	}
+	err = nil
+
+	if !bytes.Equal(magic, gzipMagic) {
+		return
+	}
+
+	gzReader, err := gzip.NewReader(output)
+	if err != nil {
+		err = fmt.Errorf("failed to open gzip log: %v", err)
+		return
+	}
+	output = bufio.NewReader(gzReader)
+	return
+}
+
+// Creates a reader of history events from plain or gzip compressed input
+// A nil parser uses the default parser options
+func NewReader(input io.Reader, parser *Parser) (reader *Reader, err error) {
+	if parser == nil {
+		parser = NewParser(ParserOptions{})
+	}
+
+	bufferedInput, err := Decompress(input)
+	if err != nil {
+		return
+	}
+
+	reader = &Reader{input: bufferedInput, parser: parser}
+	return
+}
+
+// Returns the next event in the input, or io.EOF once no complete events remain
+// Unparsable events are returned as *ParseError, the next call continues with the following event
+func (reader *Reader) Next() (event Event, err error) {
+	for {
+		var line string
+		line, err = reader.input.ReadString('\n')
+		if err != nil && err != io.EOF {
+			err = fmt.Errorf("encountered error while reading log lines: %v", err)
+			return
+		}
+		atEnd := err == io.EOF
+		err = nil
+
+		if line != "" {
+			var complete bool
+			event, complete, err = reader.block.addLine(line, reader.parser)
+			if complete || err != nil {
+				return
+			}
+		}
+
+		if atEnd {
+			err = io.EOF
+			return
+		}
+	}
+}
+
+// Iterates over all remaining events
+// Iteration stops after the first error that is not a *ParseError
+func (reader *Reader) All() iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		for {
+			event, err := reader.Next()
+			if err == io.EOF {
+				return
+			}
+			if !yield(event, err) {
+				return
+			}
+			if _, isParseErr := err.(*ParseError); err != nil && !isParseErr {
+				return
+			}
+		}
+	}
+}
+
+// Adds a raw line (including its newline) to the block
+// Complete is true once the End-Date line finished an event
+func (block *eventBlock) addLine(line string, parser *Parser) (event Event, complete bool, err error) {
+	lineStart := block.offset
+	block.offset += int64(len(line))
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "Start-Date: ") {
+		// Always ensure block buffer is empty on new block
+		block.lines.Reset()
+		block.started = true
+		block.startOffset = lineStart
+	}
+
+	// Lines outside of a block are ignored
+	if !block.started {
+		return
+	}
+	block.lines.WriteString(line + "\n")
+
+	// Once at the end of block, parse the entries
+	if !strings.HasPrefix(line, "End-Date: ") {
+		return
+	}
+	block.started = false
+	complete = true
+
+	rawBlock := block.lines.String()
+	block.lines.Reset()
+
+	event, err = parser.Parse(rawBlock)
+	if err != nil {
+		err = &ParseError{Block: rawBlock, Offset: block.startOffset, EndOffset: block.offset, Err: err}
+		return
+	}
+
+	if parser.options.RecordSource {
+		event.Source = &EventSource{StartOffset: block.startOffset, EndOffset: block.offset}
+	}
+	if parser.options.KeepRaw {
+		event.Raw = rawBlock
+	}
+	return
+}
+
+// Offset up to which all input has been fully handled
+// Lines of an unfinished event are not counted, so reading from this offset again yields the whole event
+func (block *eventBlock) handledOffset() (offset int64) {
+	if block.started {
+		return block.startOffset
+	}
+	return block.offset
+}
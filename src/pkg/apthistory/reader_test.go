@@ -0,0 +1,121 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReaderNext(t *testing.T) {
+	history := `Start-Date: 2025-06-01  10:00:00
+Commandline: apt-get install -y nginx
+Requested-By: admin (1000)
+Install: nginx:amd64 (1.22.1-9), nginx-common:amd64 (1.22.1-9, automatic)
+End-Date: 2025-06-01  10:00:30
+
+Start-Date: 2025-06-02  03:00:00
+Commandline: apt-get upgrade
+Bogus-Field: something
+End-Date: 2025-06-02  03:00:05
+
+Start-Date: 2025-06-03  12:00:00
+Commandline: apt purge telnet
+Requested-By: bob (1001)
+Purge: telnet:amd64 (0.17+2.4-2)
+End-Date: 2025-06-03  12:00:05
+`
+
+	var compressed bytes.Buffer
+	gzWriter := gzip.NewWriter(&compressed)
+	gzWriter.Write([]byte(history))
+	gzWriter.Close()
+
+	inputs := map[string]io.Reader{
+		"Plain": strings.NewReader(history),
+		"Gzip":  &compressed,
+	}
+
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			reader, err := NewReader(input, NewParser(ParserOptions{Location: time.UTC}))
+			if err != nil {
+				t.Fatalf("NewReader() unexpected error = %v", err)
+			}
+
+			var eventIDs []string
+			var parseErrors int
+			for event, err := range reader.All() {
+				var parseErr *ParseError
+				if errors.As(err, &parseErr) {
+					parseErrors++
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Next() unexpected error = %v", err)
+				}
+				eventIDs = append(eventIDs, event.EventID)
+			}
+
+			// Event IDs must stay stable across releases
+			wantFirstID := "be15fb0b-7dff-cb97-8bf2-2bbada2040f4"
+			if len(eventIDs) != 2 || eventIDs[0] != wantFirstID {
+				t.Errorf("All() event IDs = %v, want 2 events starting with %s", eventIDs, wantFirstID)
+			}
+			if parseErrors != 1 {
+				t.Errorf("All() parse errors = %d, want 1", parseErrors)
+			}
+		})
+	}
+}
+
+func TestReaderSource(t *testing.T) {
+	first := "Start-Date: 2025-06-01  10:00:00\nCommandline: apt-get install -y nginx\nInstall: nginx:amd64 (1.22.1-9)\nEnd-Date: 2025-06-01  10:00:30\n"
+	broken := "Start-Date: 2025-06-02  03:00:00\nBogus-Field: something\nEnd-Date: 2025-06-02  03:00:05\n"
+	last := "Start-Date: 2025-06-03  12:00:00\r\nPurge: telnet:amd64 (0.17+2.4-2)\r\nEnd-Date: 2025-06-03  12:00:05\r\n"
+	history := "\n" + first + "\n" + broken + "\n" + last
+
+	reader, err := NewReader(strings.NewReader(history), NewParser(ParserOptions{Location: time.UTC, RecordSource: true, KeepRaw: true}))
+	if err != nil {
+		t.Fatalf("NewReader() unexpected error = %v", err)
+	}
+
+	type location struct {
+		start int64
+		end   int64
+		raw   string
+	}
+	var got []location
+	for event, err := range reader.All() {
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			got = append(got, location{parseErr.Offset, parseErr.EndOffset, parseErr.Block})
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Next() unexpected error = %v", err)
+		}
+		if event.Source == nil {
+			t.Fatalf("event %s has no source", event.EventID)
+		}
+		got = append(got, location{event.Source.StartOffset, event.Source.EndOffset, event.Raw})
+	}
+
+	// Offsets count the bytes as read, raw text has line endings normalized
+	firstStart := int64(1)
+	brokenStart := firstStart + int64(len(first)) + 1
+	lastStart := brokenStart + int64(len(broken)) + 1
+	want := []location{
+		{firstStart, firstStart + int64(len(first)), first},
+		{brokenStart, brokenStart + int64(len(broken)), broken},
+		{lastStart, int64(len(history)), strings.ReplaceAll(last, "\r", "")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("All() locations = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,453 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Versions of the JSON event format
+//
+//	1 - Original format (mixed key casing, misspelled 'archiecture' package key)
+//	2 - Consistent snake_case keys and a schema_version field in every record
+const (
+	SchemaVersion1       int = 1
+	SchemaVersion2       int = 2
+	CurrentSchemaVersion     = SchemaVersion2
+)
+
+var SchemaVersions = []int{SchemaVersion1, SchemaVersion2}
+
+// Event in the schema version 2 JSON format
+type EventV2 struct {
+	SchemaVersion      int             `json:"schema_version"`
+	EventID            string          `json:"event_id"`
+	CommandLine        string          `json:"command_line"`
+	Command            *Command        `json:"command,omitempty"`
+	StartTimestamp     string          `json:"start_timestamp"`
+	EndTimeStamp       string          `json:"end_timestamp"`
+	ElapsedSeconds     int             `json:"elapsed_seconds"`
+	RequestedBy        string          `json:"requested_by,omitempty"`
+	RequestedByUID     int             `json:"requested_by_uid,omitempty"`
+	TotalPackages      int             `json:"total_packages,omitempty"`
+	Origin             string          `json:"origin,omitempty"`
+	PackageIndex       int             `json:"package_index,omitempty"`
+	PackageTotal       int             `json:"package_total,omitempty"`
+	ChunkIndex         int             `json:"chunk_index,omitempty"`
+	ChunkTotal         int             `json:"chunk_total,omitempty"`
+	ChunkOf            string          `json:"chunk_of,omitempty"`
+	Incomplete         bool            `json:"incomplete,omitempty"`
+	Tags               []string        `json:"tags,omitempty"`
+	MaintenanceWindow  string          `json:"maintenance_window,omitempty"`
+	OutOfWindow        bool            `json:"out_of_window,omitempty"`
+	RebootRequired     bool            `json:"reboot_required,omitempty"`
+	RebootPackages     []string        `json:"reboot_packages,omitempty"`
+	RestartServices    []string        `json:"restart_services,omitempty"`
+	RestartProcesses   []string        `json:"restart_processes,omitempty"`
+	Install            []PackageInfoV2 `json:"install,omitempty"`
+	Reinstall          []PackageInfoV2 `json:"reinstall,omitempty"`
+	Upgrade            []PackageInfoV2 `json:"upgrade,omitempty"`
+	Downgrade          []PackageInfoV2 `json:"downgrade,omitempty"`
+	Remove             []PackageInfoV2 `json:"remove,omitempty"`
+	Purge              []PackageInfoV2 `json:"purge,omitempty"`
+	InstallOperation   bool            `json:"install_operation,omitempty"`
+	ReinstallOperation bool            `json:"reinstall_operation,omitempty"`
+	UpgradeOperation   bool            `json:"upgrade_operation,omitempty"`
+	DowngradeOperation bool            `json:"downgrade_operation,omitempty"`
+	RemoveOperation    bool            `json:"remove_operation,omitempty"`
+	PurgeOperation     bool            `json:"purge_operation,omitempty"`
+	Error              string          `json:"error,omitempty"`
+	Source             *EventSource    `json:"source,omitempty"`
+	Raw                string          `json:"raw,omitempty"`
+}
+
+// Package in the schema version 2 JSON format
+type PackageInfoV2 struct {
+	Name       string `json:"package"`
+	Arch       string `json:"architecture"`
+	OldVersion string `json:"old_version,omitempty"`
+	Version    string `json:"version"`
+}
+
+// Descriptions of event and package fields (by Go field name, or type and field name for nested types) for the JSON schema
+var fieldDescriptions = map[string]string{
+	"SchemaVersion":         "Version of this record format",
+	"EventID":               "Identifier derived from the event content, identical for every chunk of a split event",
+	"CommandLine":           "APT command line",
+	"Command":               "APT command line split into program, subcommand, options and package targets",
+	"Program":               "Program that ran APT, as written on the command line",
+	"Subcommand":            "First argument that is not an option, like install or full-upgrade",
+	"Options":               "Command line options in order, combined short options split up",
+	"Targets":               "Package arguments of the command line",
+	"Argument":              "Package argument as written",
+	"Package":               "Package name, pattern or .deb file path of the argument",
+	"Architecture":          "Architecture given with package:architecture",
+	"Release":               "Release given with package/release",
+	"Value":                 "Value of the option",
+	"CommandOption.Name":    "Option as written, like -y or --no-install-recommends",
+	"CommandTarget.Version": "Version given with package=version",
+	"StartTimestamp":        "Start time of the APT operation",
+	"EndTimeStamp":          "End time of the APT operation",
+	"ElapsedSeconds":        "Duration of the APT operation in seconds",
+	"RequestedBy":           "Name of the user that ran the APT operation",
+	"RequestedByUID":        "ID of the user that ran the APT operation",
+	"TotalPackages":         "Number of packages in all operations of the event",
+	"Origin":                "How the APT run was started: interactive, unattended, config_management, gui or unknown",
+	"PackageIndex":          "Position (from 1) of this record's package change within the event, only set in per-package records",
+	"PackageTotal":          "Number of per-package records of the event, only set in per-package records",
+	"ChunkIndex":            "Position (from 1) of this chunk within a split event, only set in chunks",
+	"ChunkTotal":            "Number of chunks the event was split into, only set in chunks",
+	"ChunkOf":               "SHA-256 digest of the whole event, shared by all of its chunks",
+	"Incomplete":            "Set when reassembly did not find every chunk of the event",
+	"Tags":                  "Names of the alert rules the event matched",
+	"MaintenanceWindow":     "Name of the maintenance window the event ran in",
+	"OutOfWindow":           "Set when the event ran outside of all maintenance windows",
+	"RebootRequired":        "Set when a package of the event only takes effect after a reboot",
+	"RebootPackages":        "Packages of the event that need a reboot",
+	"RestartServices":       "Systemd services still running files replaced by the event",
+	"RestartProcesses":      "Processes outside of services still running files replaced by the event (name[pid])",
+	"Install":               "Installed packages",
+	"Reinstall":             "Reinstalled packages",
+	"Upgrade":               "Upgraded packages",
+	"Downgrade":             "Downgraded packages",
+	"Remove":                "Removed packages",
+	"Purge":                 "Purged packages",
+	"InstallOperation":      "Event includes installs",
+	"ReinstallOperation":    "Event includes reinstalls",
+	"UpgradeOperation":      "Event includes upgrades",
+	"DowngradeOperation":    "Event includes downgrades",
+	"RemoveOperation":       "Event includes removals",
+	"PurgeOperation":        "Event includes purges",
+	"Error":                 "Error reported by APT",
+	"Source":                "Location of the event in the log it was parsed from",
+	"File":                  "Path of the log file",
+	"Inode":                 "Inode of the log file",
+	"StartOffset":           "Byte offset of the first line of the event (in the decompressed content for archives)",
+	"EndOffset":             "Byte offset just past the last line of the event",
+	"Raw":                   "Event lines as written in the log, only on the first of per-package records",
+	"Name":                  "Package name",
+	"Arch":                  "Package architecture",
+	"OldVersion":            "Version before the operation (upgrades and downgrades)",
+	"Version":               "Version after the operation",
+}
+
+// Converts the event to the schema version 2 format
+func (event Event) V2() (eventV2 EventV2) {
+	eventV2 = EventV2{
+		SchemaVersion:      SchemaVersion2,
+		EventID:            event.EventID,
+		CommandLine:        event.CommandLine,
+		Command:            event.Command,
+		StartTimestamp:     event.StartTimestamp,
+		EndTimeStamp:       event.EndTimeStamp,
+		ElapsedSeconds:     event.ElapsedSeconds,
+		RequestedBy:        event.RequestedBy,
+		RequestedByUID:     event.RequestedByUID,
+		TotalPackages:      event.TotalPackages,
+		Origin:             event.Origin,
+		PackageIndex:       event.PackageIndex,
+		PackageTotal:       event.PackageTotal,
+		ChunkIndex:         event.ChunkIndex,
+		ChunkTotal:         event.ChunkTotal,
+		ChunkOf:            event.ChunkOf,
+		Incomplete:         event.Incomplete,
+		Tags:               event.Tags,
+		MaintenanceWindow:  event.MaintenanceWindow,
+		OutOfWindow:        event.OutOfWindow,
+		RebootRequired:     event.RebootRequired,
+		RebootPackages:     event.RebootPackages,
+		RestartServices:    event.RestartServices,
+		RestartProcesses:   event.RestartProcesses,
+		Install:            packagesV2(event.Install),
+		Reinstall:          packagesV2(event.Reinstall),
+		Upgrade:            packagesV2(event.Upgrade),
+		Downgrade:          packagesV2(event.Downgrade),
+		Remove:             packagesV2(event.Remove),
+		Purge:              packagesV2(event.Purge),
+		InstallOperation:   event.InstallOperation,
+		ReinstallOperation: event.ReinstallOperation,
+		UpgradeOperation:   event.UpgradeOperation,
+		DowngradeOperation: event.DowngradeOperation,
+		RemoveOperation:    event.RemoveOperation,
+		PurgeOperation:     event.PurgeOperation,
+		Error:              event.Error,
+		Source:             event.Source,
+		Raw:                event.Raw,
+	}
+	return
+}
+
+// Converts a schema version 2 event back to an event
+func (eventV2 EventV2) Event() (event Event) {
+	event = Event{
+		EventID:            eventV2.EventID,
+		CommandLine:        eventV2.CommandLine,
+		Command:            eventV2.Command,
+		StartTimestamp:     eventV2.StartTimestamp,
+		EndTimeStamp:       eventV2.EndTimeStamp,
+		ElapsedSeconds:     eventV2.ElapsedSeconds,
+		RequestedBy:        eventV2.RequestedBy,
+		RequestedByUID:     eventV2.RequestedByUID,
+		TotalPackages:      eventV2.TotalPackages,
+		Origin:             eventV2.Origin,
+		PackageIndex:       eventV2.PackageIndex,
+		PackageTotal:       eventV2.PackageTotal,
+		ChunkIndex:         eventV2.ChunkIndex,
+		ChunkTotal:         eventV2.ChunkTotal,
+		ChunkOf:            eventV2.ChunkOf,
+		Incomplete:         eventV2.Incomplete,
+		Tags:               eventV2.Tags,
+		MaintenanceWindow:  eventV2.MaintenanceWindow,
+		OutOfWindow:        eventV2.OutOfWindow,
+		RebootRequired:     eventV2.RebootRequired,
+		RebootPackages:     eventV2.RebootPackages,
+		RestartServices:    eventV2.RestartServices,
+		RestartProcesses:   eventV2.RestartProcesses,
+		Install:            packagesV1(eventV2.Install),
+		Reinstall:          packagesV1(eventV2.Reinstall),
+		Upgrade:            packagesV1(eventV2.Upgrade),
+		Downgrade:          packagesV1(eventV2.Downgrade),
+		Remove:             packagesV1(eventV2.Remove),
+		Purge:              packagesV1(eventV2.Purge),
+		InstallOperation:   eventV2.InstallOperation,
+		ReinstallOperation: eventV2.ReinstallOperation,
+		UpgradeOperation:   eventV2.UpgradeOperation,
+		DowngradeOperation: eventV2.DowngradeOperation,
+		RemoveOperation:    eventV2.RemoveOperation,
+		PurgeOperation:     eventV2.PurgeOperation,
+		Error:              eventV2.Error,
+		Source:             eventV2.Source,
+		Raw:                eventV2.Raw,
+	}
+	return
+}
+
+func packagesV2(packages []PackageInfo) (packagesV2 []PackageInfoV2) {
+	for _, pkg := range packages {
+		packagesV2 = append(packagesV2, PackageInfoV2(pkg))
+	}
+	return
+}
+
+func packagesV1(packagesV2 []PackageInfoV2) (packages []PackageInfo) {
+	for _, pkg := range packagesV2 {
+		packages = append(packages, PackageInfo(pkg))
+	}
+	return
+}
+
+func validateSchemaVersion(schemaVersion int) (err error) {
+	if !slices.Contains(SchemaVersions, schemaVersion) {
+		err = fmt.Errorf("unknown schema version %d: must be 1 or 2", schemaVersion)
+	}
+	return
+}
+
+// Encodes the event as a single line JSON record in the given schema version
+func MarshalEvent(event Event, schemaVersion int) (record []byte, err error) {
+	err = validateSchemaVersion(schemaVersion)
+	if err != nil {
+		return
+	}
+
+	if schemaVersion == SchemaVersion1 {
+		record, err = json.Marshal(event)
+	} else {
+		record, err = json.Marshal(event.V2())
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid JSON: %v", err)
+		return
+	}
+	return
+}
+
+// Decodes a JSON record of any schema version
+func UnmarshalEvent(record []byte) (event Event, err error) {
+	var versionField struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	err = json.Unmarshal(record, &versionField)
+	if err != nil {
+		return
+	}
+
+	// Version 1 records have no version field
+	switch versionField.SchemaVersion {
+	case 0:
+		err = json.Unmarshal(record, &event)
+	case SchemaVersion2:
+		var eventV2 EventV2
+		err = json.Unmarshal(record, &eventV2)
+		event = eventV2.Event()
+	default:
+		err = fmt.Errorf("unsupported schema version %d", versionField.SchemaVersion)
+	}
+	return
+}
+
+// Record written to the same output as events, told apart from events by its record_type field
+type RecordSchema struct {
+	RecordType   string            // Value of the record_type field
+	Description  string            // Description of the record
+	Record       any               // Value of the record struct, its JSON tags describe the record
+	Descriptions map[string]string // Field descriptions (by Go field name, or type and field name for nested types)
+}
+
+// Generates the JSON Schema document describing the records of the given schema version
+// Records are either an event or one of the given records, selected by record_type
+func JSONSchema(schemaVersion int, records ...RecordSchema) (schema []byte, err error) {
+	err = validateSchemaVersion(schemaVersion)
+	if err != nil {
+		return
+	}
+
+	eventType := reflect.TypeOf(Event{})
+	packageType := reflect.TypeOf(PackageInfo{})
+	if schemaVersion == SchemaVersion2 {
+		eventType = reflect.TypeOf(EventV2{})
+		packageType = reflect.TypeOf(PackageInfoV2{})
+	}
+
+	// Events are the only records without a record_type field
+	eventSchema := objectSchema(eventType, schemaVersion, nil)
+	eventSchema["description"] = "APT history event"
+	eventSchema["not"] = map[string]any{"required": []string{"record_type"}}
+
+	definitions := map[string]any{
+		"event":          eventSchema,
+		"package":        objectSchema(packageType, schemaVersion, nil),
+		"command":        objectSchema(reflect.TypeOf(Command{}), schemaVersion, nil),
+		"command_option": objectSchema(reflect.TypeOf(CommandOption{}), schemaVersion, nil),
+		"command_target": objectSchema(reflect.TypeOf(CommandTarget{}), schemaVersion, nil),
+		"source":         objectSchema(reflect.TypeOf(EventSource{}), schemaVersion, nil),
+	}
+	recordTypes := []any{map[string]any{"$ref": "#/$defs/event"}}
+	for _, record := range records {
+		recordSchema := objectSchema(reflect.TypeOf(record.Record), schemaVersion, record.Descriptions)
+		recordSchema["description"] = record.Description
+		recordSchema["properties"].(map[string]any)["record_type"].(map[string]any)["const"] = record.RecordType
+
+		definitions[record.RecordType] = recordSchema
+		recordTypes = append(recordTypes, map[string]any{"$ref": "#/$defs/" + record.RecordType})
+	}
+
+	document := map[string]any{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"$id":         fmt.Sprintf("https://github.com/EvSecDev/APTHistoryLogger/schema/v%d/event.json", schemaVersion),
+		"title":       "APT history record",
+		"description": fmt.Sprintf("Record written by APT History Logger (schema version %d)", schemaVersion),
+		"oneOf":       recordTypes,
+		"$defs":       definitions,
+	}
+
+	schema, err = json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("invalid JSON: %v", err)
+		return
+	}
+	return
+}
+
+// Builds the schema of a struct from its JSON tags
+// Fields without omitempty are always present and therefore required
+// Descriptions are looked up in the given descriptions before the event field descriptions
+func objectSchema(structType reflect.Type, schemaVersion int, descriptions map[string]string) (schema map[string]any) {
+	properties := make(map[string]any)
+	required := []string{}
+
+	for index := range structType.NumField() {
+		field := structType.Field(index)
+		jsonName, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+
+		// Fields of nested types can have their own description under Type.Field
+		property := map[string]any{
+			"description": fieldDescription(structType.Name(), field.Name, descriptions),
+		}
+		switch field.Type.Kind() {
+		case reflect.String:
+			property["type"] = "string"
+		case reflect.Int, reflect.Int64, reflect.Uint64:
+			property["type"] = "integer"
+		case reflect.Bool:
+			property["type"] = "boolean"
+		case reflect.Slice:
+			property["type"] = "array"
+			if field.Type.Elem().Kind() == reflect.String {
+				property["items"] = map[string]any{"type": "string"}
+			} else {
+				property["items"] = nestedSchema(field.Type.Elem(), schemaVersion, descriptions)
+			}
+		case reflect.Pointer:
+			maps.Copy(property, nestedSchema(field.Type.Elem(), schemaVersion, descriptions))
+		case reflect.Struct:
+			maps.Copy(property, nestedSchema(field.Type, schemaVersion, descriptions))
+		}
+
+		switch field.Name {
+		case "EventID":
+			property["format"] = "uuid"
+		case "StartTimestamp", "EndTimeStamp":
+			property["format"] = "date-time"
+		case "SchemaVersion":
+			property["const"] = schemaVersion
+		}
+
+		properties[jsonName] = property
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, jsonName)
+		}
+	}
+
+	schema = map[string]any{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+	return
+}
+
+// Description of a struct field, by type and field name before field name alone
+func fieldDescription(typeName string, fieldName string, descriptions map[string]string) (description string) {
+	for _, source := range []map[string]string{descriptions, fieldDescriptions} {
+		for _, key := range []string{typeName + "." + fieldName, fieldName} {
+			description, found := source[key]
+			if found {
+				return description
+			}
+		}
+	}
+	return
+}
+
+// Reference to the $defs entry of a shared type, other types are described in place
+func nestedSchema(structType reflect.Type, schemaVersion int, descriptions map[string]string) (schema map[string]any) {
+	name := schemaDefinition(structType)
+	if name == "" {
+		schema = objectSchema(structType, schemaVersion, descriptions)
+		return
+	}
+	schema = map[string]any{"$ref": "#/$defs/" + name}
+	return
+}
+
+// Name of the $defs entry describing a nested struct type
+func schemaDefinition(structType reflect.Type) (name string) {
+	switch structType {
+	case reflect.TypeOf(CommandOption{}):
+		name = "command_option"
+	case reflect.TypeOf(CommandTarget{}):
+		name = "command_target"
+	case reflect.TypeOf(Command{}):
+		name = "command"
+	case reflect.TypeOf(EventSource{}):
+		name = "source"
+	case reflect.TypeOf(PackageInfo{}), reflect.TypeOf(PackageInfoV2{}):
+		name = "package"
+	}
+	return
+}
@@ -0,0 +1,125 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshalEventRoundTrip(t *testing.T) {
+	event := Event{
+		EventID:          "be15fb0b-7dff-cb97-8bf2-2bbada2040f4",
+		CommandLine:      "apt-get install -y nginx",
+		StartTimestamp:   "2025-06-01T10:00:00Z",
+		EndTimeStamp:     "2025-06-01T10:00:30Z",
+		ElapsedSeconds:   30,
+		RequestedBy:      "admin",
+		RequestedByUID:   1000,
+		TotalPackages:    1,
+		Upgrade:          []PackageInfo{{Name: "nginx", Arch: "amd64", OldVersion: "1.22.1-8", Version: "1.22.1-9"}},
+		UpgradeOperation: true,
+	}
+
+	tests := []struct {
+		name          string
+		schemaVersion int
+		wantKey       string
+		expectError   bool
+	}{
+		{name: "Version 1", schemaVersion: SchemaVersion1, wantKey: `"archiecture":"amd64"`},
+		{name: "Version 2", schemaVersion: SchemaVersion2, wantKey: `"architecture":"amd64"`},
+		{name: "Unknown version", schemaVersion: 3, expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record, err := MarshalEvent(event, test.schemaVersion)
+			if (err != nil) != test.expectError {
+				t.Errorf("MarshalEvent() error = %v, expectError %v", err, test.expectError)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if !strings.Contains(string(record), test.wantKey) {
+				t.Errorf("MarshalEvent() = %s, want key %s", record, test.wantKey)
+			}
+
+			decoded, err := UnmarshalEvent(record)
+			if err != nil {
+				t.Errorf("UnmarshalEvent() unexpected error = %v", err)
+				return
+			}
+			if !reflect.DeepEqual(decoded, event) {
+				t.Errorf("UnmarshalEvent() = %v, want %v", decoded, event)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaRecordTypes(t *testing.T) {
+	type recordViolation struct {
+		Rule string `json:"rule"`
+	}
+	type violationRecord struct {
+		RecordType string            `json:"record_type"`
+		EventID    string            `json:"event_id"`
+		Violations []recordViolation `json:"violations"`
+		Source     EventSource       `json:"source"`
+	}
+	violationSchema := RecordSchema{
+		RecordType:   "policy_violation",
+		Record:       violationRecord{},
+		Descriptions: map[string]string{"recordViolation.Rule": "Broken rule"},
+	}
+
+	for _, schemaVersion := range SchemaVersions {
+		schema, err := JSONSchema(schemaVersion, violationSchema)
+		if err != nil {
+			t.Fatalf("JSONSchema() schema version %d unexpected error = %v", schemaVersion, err)
+		}
+
+		var document struct {
+			OneOf []struct {
+				Ref string `json:"$ref"`
+			} `json:"oneOf"`
+			Defs map[string]struct {
+				Not        map[string][]string       `json:"not"`
+				Properties map[string]map[string]any `json:"properties"`
+			} `json:"$defs"`
+		}
+		err = json.Unmarshal(schema, &document)
+		if err != nil {
+			t.Fatalf("JSONSchema() schema version %d returned invalid JSON: %v", schemaVersion, err)
+		}
+
+		var refs []string
+		for _, recordType := range document.OneOf {
+			refs = append(refs, recordType.Ref)
+		}
+		wantRefs := []string{"#/$defs/event", "#/$defs/policy_violation"}
+		if !reflect.DeepEqual(refs, wantRefs) {
+			t.Errorf("schema version %d oneOf = %v, want %v", schemaVersion, refs, wantRefs)
+		}
+
+		// Events must not match the other record types and the other way around
+		if !reflect.DeepEqual(document.Defs["event"].Not["required"], []string{"record_type"}) {
+			t.Errorf("schema version %d event does not exclude record_type", schemaVersion)
+		}
+		properties := document.Defs["policy_violation"].Properties
+		if properties["record_type"]["const"] != "policy_violation" {
+			t.Errorf("schema version %d record_type = %v, want const policy_violation", schemaVersion, properties["record_type"])
+		}
+		if properties["source"]["$ref"] != "#/$defs/source" {
+			t.Errorf("schema version %d source = %v, want reference to source", schemaVersion, properties["source"])
+		}
+		items, _ := properties["violations"]["items"].(map[string]any)
+		itemProperties, _ := items["properties"].(map[string]any)
+		rule, _ := itemProperties["rule"].(map[string]any)
+		if rule["description"] != "Broken rule" {
+			t.Errorf("schema version %d nested rule = %v, want description from the record", schemaVersion, rule)
+		}
+	}
+}
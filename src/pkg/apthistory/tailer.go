@@ -0,0 +1,322 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Returned by Tailer.Next once the tailer is closed
+var ErrTailerClosed = errors.New("tailer closed")
+
+// Follows a live history log file, including across log rotation
+type Tailer struct {
+	path    string
+	parser  *Parser
+	file    *os.File
+	input   *bufio.Reader
+	inode   uint64
+	block   eventBlock
+	partial string // Unterminated last line, completed by a later write
+
+	rotatePending bool // Rotation seen, switch files once the old file is fully read
+
+	inotifyFd int
+	fileWatch int
+	dirWatch  int
+	changed   chan struct{} // Log file was written to
+	rotated   chan struct{} // Log file path now points to a new file
+	errs      chan error    // Watcher failures
+	done      chan struct{} // Closed by Close
+	closeOnce sync.Once
+}
+
+// Starts following the file at path from the given byte offset
+// Offset should come from a previous Tailer.Offset for the same inode, or 0 to read from the start
+// A nil parser uses the default parser options
+func NewTailer(path string, offset int64, parser *Parser) (tailer *Tailer, err error) {
+	if parser == nil {
+		parser = NewParser(ParserOptions{})
+	}
+
+	tailer = &Tailer{
+		path:    path,
+		parser:  parser,
+		changed: make(chan struct{}, 1),
+		rotated: make(chan struct{}, 1),
+		errs:    make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+
+	err = tailer.open(offset)
+	if err != nil {
+		return
+	}
+
+	tailer.inotifyFd, err = syscall.InotifyInit()
+	if err != nil {
+		tailer.file.Close()
+		err = fmt.Errorf("failed to initialize inotify: %v", err)
+		return
+	}
+
+	// Watcher for the log file
+	tailer.fileWatch, err = syscall.InotifyAddWatch(tailer.inotifyFd, path, syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE)
+	if err != nil {
+		tailer.file.Close()
+		syscall.Close(tailer.inotifyFd)
+		err = fmt.Errorf("failed to add log file to inotify watcher: %v", err)
+		return
+	}
+
+	// Watcher for the log directory to catch rotation
+	tailer.dirWatch, err = syscall.InotifyAddWatch(tailer.inotifyFd, filepath.Dir(path), syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO|syscall.IN_DELETE|syscall.IN_CREATE)
+	if err != nil {
+		tailer.file.Close()
+		syscall.Close(tailer.inotifyFd)
+		err = fmt.Errorf("failed to add directory to inotify watcher: %v", err)
+		return
+	}
+
+	go tailer.watch()
+	return
+}
+
+// Returns the next event written to the log, blocking until one is available
+// Unparsable events are returned as *ParseError, the next call continues with the following event
+func (tailer *Tailer) Next() (event Event, err error) {
+	for {
+		var line string
+		line, err = tailer.input.ReadString('\n')
+		if err != nil && err != io.EOF {
+			err = fmt.Errorf("encountered error while reading log lines: %v", err)
+			return
+		}
+
+		if err == io.EOF {
+			// Hold on to partial lines until the rest is written
+			tailer.partial += line
+			err = tailer.wait()
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		line = tailer.partial + line
+		tailer.partial = ""
+
+		var complete bool
+		event, complete, err = tailer.block.addLine(line, tailer.parser)
+		if event.Source != nil {
+			event.Source.File = tailer.path
+			event.Source.Inode = tailer.inode
+		}
+		if complete || err != nil {
+			return
+		}
+	}
+}
+
+// Byte offset up to which the current file has been fully handled
+// Resuming a new Tailer from this offset will not skip or repeat events
+func (tailer *Tailer) Offset() (offset int64) {
+	offset = tailer.block.handledOffset()
+	return
+}
+
+// Inode of the file currently being read
+func (tailer *Tailer) Inode() (inode uint64) {
+	inode = tailer.inode
+	return
+}
+
+// Stops following the file
+func (tailer *Tailer) Close() (err error) {
+	tailer.closeOnce.Do(func() {
+		close(tailer.done)
+
+		// Removing the watch wakes up the watcher, which cleans up the inotify instance
+		syscall.InotifyRmWatch(tailer.inotifyFd, uint32(tailer.dirWatch))
+
+		err = tailer.file.Close()
+	})
+	return
+}
+
+// Opens the log file at path and moves to the given offset
+func (tailer *Tailer) open(offset int64) (err error) {
+	file, err := os.Open(tailer.path)
+	if err != nil {
+		err = fmt.Errorf("failed to open log file: %v", err)
+		return
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		err = fmt.Errorf("unable to stat log file: %v", err)
+		return
+	}
+	stat := fileInfo.Sys().(*syscall.Stat_t)
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		err = fmt.Errorf("failed to resume in log: %v", err)
+		return
+	}
+
+	tailer.file = file
+	tailer.input = bufio.NewReader(file)
+	tailer.inode = stat.Ino
+	tailer.block = eventBlock{offset: offset}
+	tailer.partial = ""
+	return
+}
+
+// Blocks until more data may be available
+func (tailer *Tailer) wait() (err error) {
+	// Old file has been read to the end, continue in the new one
+	if tailer.rotatePending {
+		tailer.rotatePending = false
+
+		// Rotation can be reported more than once (move then create), only switch to files not yet read
+		fileInfo, statErr := os.Stat(tailer.path)
+		if statErr == nil && fileInfo.Sys().(*syscall.Stat_t).Ino == tailer.inode {
+			return
+		}
+
+		tailer.file.Close()
+		err = tailer.open(0)
+		if err != nil {
+			err = fmt.Errorf("failed to reopen rotated log file: %v", err)
+		}
+		return
+	}
+
+	select {
+	case <-tailer.changed:
+	case <-tailer.rotated:
+		// Lines may have been written to the old file before it was moved
+		tailer.rotatePending = true
+	case err = <-tailer.errs:
+	case <-tailer.done:
+		err = ErrTailerClosed
+	}
+	return
+}
+
+// Background inotify reader, notifying Next of file changes and rotation
+func (tailer *Tailer) watch() {
+	defer syscall.Close(tailer.inotifyFd)
+	defer syscall.InotifyRmWatch(tailer.inotifyFd, uint32(tailer.fileWatch))
+
+	// Create a buffer to read the events
+	buf := make([]byte, syscall.SizeofInotifyEvent+8192)
+	logFileName := filepath.Base(tailer.path)
+
+	for {
+		// Read the event
+		n, err := syscall.Read(tailer.inotifyFd, buf)
+		if tailer.isClosed() {
+			return
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			tailer.errs <- fmt.Errorf("error reading inotify event: %v", err)
+			return
+		}
+
+		var offset uint32
+		for offset+syscall.SizeofInotifyEvent <= uint32(n) {
+			var event syscall.InotifyEvent
+
+			// Retrieve the event
+			eventBytes := buf[offset : offset+syscall.SizeofInotifyEvent]
+			err = binary.Read(bytes.NewReader(eventBytes), binary.LittleEndian, &event)
+			if err != nil {
+				tailer.errs <- fmt.Errorf("failed to read inotify event content: %v", err)
+				return
+			}
+
+			// Name field has the filename for dir events (null-terminated)
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+event.Len]
+			name := strings.TrimRight(string(nameBytes), "\x00")
+
+			// File modified
+			if event.Mask&syscall.IN_MODIFY != 0 && event.Wd == int32(tailer.fileWatch) {
+				notify(tailer.changed)
+			}
+
+			// Directory events - only look for our file
+			if event.Wd == int32(tailer.dirWatch) && name == logFileName {
+				if (event.Mask & (syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_CREATE)) != 0 {
+					err = tailer.rewatch()
+					if err != nil {
+						tailer.errs <- err
+						return
+					}
+					notify(tailer.rotated)
+				}
+			}
+
+			// Move the offset forward to the next event
+			offset += syscall.SizeofInotifyEvent + event.Len
+		}
+	}
+}
+
+// Moves the file watch to the new file at the log path
+func (tailer *Tailer) rewatch() (err error) {
+	// Ensure new file is created before adding watcher for new inode
+	for {
+		if _, statErr := os.Stat(tailer.path); statErr == nil {
+			break
+		}
+		if tailer.isClosed() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Cleanup watcher for old inode
+	syscall.InotifyRmWatch(tailer.inotifyFd, uint32(tailer.fileWatch))
+
+	// Add watcher for new inode
+	tailer.fileWatch, err = syscall.InotifyAddWatch(tailer.inotifyFd, tailer.path, syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE)
+	if err != nil {
+		err = fmt.Errorf("failed to add rotated log file to inotify watcher: %v", err)
+		return
+	}
+	return
+}
+
+func (tailer *Tailer) isClosed() (closed bool) {
+	select {
+	case <-tailer.done:
+		closed = true
+	default:
+	}
+	return
+}
+
+// Non-blocking send, pending notifications are merged
+func notify(channel chan struct{}) {
+	select {
+	case channel <- struct{}{}:
+	default:
+	}
+}
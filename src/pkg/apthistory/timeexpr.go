@@ -0,0 +1,124 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Relative offsets like '-3d', '+2h', '2h ago' or '3 days ago'
+var relativeTimeRegex = regexp.MustCompile(`^([+-]?)(\d+)\s*([a-z]+?)(\s+ago)?$`)
+
+var weekdayNames = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// Parses user supplied date/time values
+// Values without an explicit offset are interpreted in the given location
+func ParseTime(rawTime string, location *time.Location) (parsedTime time.Time, err error) {
+	parsedTime, err = ParseTimeAt(rawTime, time.Now().In(location), location)
+	return
+}
+
+// Parses absolute, relative and natural time expressions relative to the given current time
+func ParseTimeAt(rawTime string, now time.Time, location *time.Location) (parsedTime time.Time, err error) {
+	rawTime = strings.TrimSpace(rawTime)
+
+	// Absolute timestamps with an offset are used as is
+	parsedTime, err = time.Parse(time.RFC3339, rawTime)
+	if err == nil {
+		return
+	}
+
+	localLayouts := []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+	for _, layout := range localLayouts {
+		parsedTime, err = time.ParseInLocation(layout, rawTime, location)
+		if err == nil {
+			return
+		}
+	}
+	err = nil
+
+	expression := strings.ToLower(rawTime)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+
+	switch expression {
+	case "now":
+		parsedTime = now
+		return
+	case "today":
+		parsedTime = midnight
+		return
+	case "yesterday":
+		parsedTime = midnight.AddDate(0, 0, -1)
+		return
+	}
+
+	// Most recent occurrence of weekday before today
+	if weekdayName, isLast := strings.CutPrefix(expression, "last "); isLast {
+		weekday, validWeekday := weekdayNames[strings.TrimSpace(weekdayName)]
+		if !validWeekday {
+			err = fmt.Errorf("unrecognized weekday '%s'", weekdayName)
+			return
+		}
+
+		daysBack := int(midnight.Weekday()-weekday+7) % 7
+		if daysBack == 0 {
+			daysBack = 7
+		}
+		parsedTime = midnight.AddDate(0, 0, -daysBack)
+		return
+	}
+
+	relativeFields := relativeTimeRegex.FindStringSubmatch(expression)
+	if relativeFields != nil {
+		sign := relativeFields[1]
+		unit := relativeFields[3]
+		isAgo := relativeFields[4] != ""
+
+		if sign == "+" && isAgo {
+			err = fmt.Errorf("relative time '%s' cannot be both in the future and ago", rawTime)
+			return
+		}
+
+		var amount int
+		amount, err = strconv.Atoi(relativeFields[2])
+		if err != nil {
+			err = fmt.Errorf("invalid number in relative time '%s'", rawTime)
+			return
+		}
+
+		// Without a sign, relative times point to the past
+		if sign != "+" {
+			amount = -amount
+		}
+
+		switch unit {
+		case "s", "sec", "secs", "second", "seconds":
+			parsedTime = now.Add(time.Duration(amount) * time.Second)
+		case "m", "min", "mins", "minute", "minutes":
+			parsedTime = now.Add(time.Duration(amount) * time.Minute)
+		case "h", "hr", "hrs", "hour", "hours":
+			parsedTime = now.Add(time.Duration(amount) * time.Hour)
+		case "d", "day", "days":
+			parsedTime = now.AddDate(0, 0, amount)
+		case "w", "week", "weeks":
+			parsedTime = now.AddDate(0, 0, amount*7)
+		default:
+			err = fmt.Errorf("unrecognized time unit '%s' in '%s'", unit, rawTime)
+		}
+		return
+	}
+
+	err = fmt.Errorf("unrecognized time '%s': expected a date (2006-01-02[T15:04:05]), RFC3339 timestamp, relative time (-3d, 2h ago) or today/yesterday/last <weekday>", rawTime)
+	return
+}
@@ -0,0 +1,48 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSearchTimeAt(t *testing.T) {
+	location := time.FixedZone("UTC-5", -5*60*60)
+	now := time.Date(2025, 6, 4, 15, 30, 0, 0, location) // Wednesday
+
+	tests := []struct {
+		name        string
+		rawTime     string
+		want        time.Time
+		expectError bool
+	}{
+		{name: "Local timestamp", rawTime: "2025-06-01T10:00:00", want: time.Date(2025, 6, 1, 10, 0, 0, 0, location)},
+		{name: "Date only", rawTime: "2025-06-01", want: time.Date(2025, 6, 1, 0, 0, 0, 0, location)},
+		{name: "RFC3339 offset", rawTime: "2025-06-01T10:00:00Z", want: time.Date(2025, 6, 1, 10, 0, 0, 0, time.UTC)},
+		{name: "Now", rawTime: "now", want: now},
+		{name: "Today", rawTime: "today", want: time.Date(2025, 6, 4, 0, 0, 0, 0, location)},
+		{name: "Yesterday", rawTime: "Yesterday", want: time.Date(2025, 6, 3, 0, 0, 0, 0, location)},
+		{name: "Last monday", rawTime: "last monday", want: time.Date(2025, 6, 2, 0, 0, 0, 0, location)},
+		{name: "Last same weekday", rawTime: "last wednesday", want: time.Date(2025, 5, 28, 0, 0, 0, 0, location)},
+		{name: "Negative days", rawTime: "-3d", want: now.AddDate(0, 0, -3)},
+		{name: "Hours ago", rawTime: "2h ago", want: now.Add(-2 * time.Hour)},
+		{name: "Spelled out", rawTime: "3 days ago", want: now.AddDate(0, 0, -3)},
+		{name: "Future", rawTime: "+1w", want: now.AddDate(0, 0, 7)},
+		{name: "Unknown unit", rawTime: "-3y", expectError: true},
+		{name: "Unknown weekday", rawTime: "last caturday", expectError: true},
+		{name: "Garbage", rawTime: "whenever", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseTimeAt(test.rawTime, now, location)
+			if (err != nil) != test.expectError {
+				t.Errorf("ParseTimeAt() error = %v, expectError %v", err, test.expectError)
+				return
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("ParseTimeAt(%s) = %v, want %v", test.rawTime, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Debian package version split into its comparable parts
+type Version struct {
+	Epoch    int
+	Upstream string
+	Revision string
+}
+
+// Splits version string in the form [epoch:]upstream[-revision]
+func ParseVersion(rawVersion string) (version Version, err error) {
+	rawVersion = strings.TrimSpace(rawVersion)
+	if rawVersion == "" {
+		err = fmt.Errorf("version string is empty")
+		return
+	}
+	if strings.ContainsAny(rawVersion, " \t") {
+		err = fmt.Errorf("version string '%s' has embedded spaces", rawVersion)
+		return
+	}
+
+	// Epoch is everything before the first colon
+	remainder := rawVersion
+	epochStr, afterEpoch, hasEpoch := strings.Cut(rawVersion, ":")
+	if hasEpoch {
+		version.Epoch, err = strconv.Atoi(epochStr)
+		if err != nil || version.Epoch < 0 {
+			err = fmt.Errorf("epoch in version '%s' is not a number", rawVersion)
+			return
+		}
+		remainder = afterEpoch
+	}
+
+	// Revision is everything after the last hyphen
+	hyphenIndex := strings.LastIndex(remainder, "-")
+	if hyphenIndex >= 0 {
+		version.Upstream = remainder[:hyphenIndex]
+		version.Revision = remainder[hyphenIndex+1:]
+	} else {
+		version.Upstream = remainder
+	}
+
+	if version.Upstream == "" {
+		err = fmt.Errorf("version '%s' has empty upstream version", rawVersion)
+		return
+	}
+	return
+}
+
+// Compares two Debian version strings the same way dpkg does
+// Returns -1 if a is older than b, 0 if equal, 1 if a is newer than b
+func CompareVersions(a string, b string) (result int, err error) {
+	versionA, err := ParseVersion(a)
+	if err != nil {
+		return
+	}
+	versionB, err := ParseVersion(b)
+	if err != nil {
+		return
+	}
+
+	result = versionA.Compare(versionB)
+	return
+}
+
+func (a Version) Compare(b Version) (result int) {
+	if a.Epoch != b.Epoch {
+		if a.Epoch < b.Epoch {
+			return -1
+		}
+		return 1
+	}
+
+	result = compareVersionPart(a.Upstream, b.Upstream)
+	if result != 0 {
+		return
+	}
+
+	result = compareVersionPart(a.Revision, b.Revision)
+	return
+}
+
+// Sorting weight of a single non-digit character
+// Tilde sorts before everything (even the end of the string), letters before other symbols
+func versionCharOrder(version string, index int) int {
+	if index >= len(version) {
+		return 0
+	}
+
+	char := version[index]
+	switch {
+	case char >= '0' && char <= '9':
+		return 0
+	case (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z'):
+		return int(char)
+	case char == '~':
+		return -1
+	default:
+		return int(char) + 256
+	}
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+// Alternates between comparing non-digit prefixes lexically and digit runs numerically (dpkg verrevcmp)
+func compareVersionPart(a string, b string) (result int) {
+	var i, j int
+	for i < len(a) || j < len(b) {
+		firstDiff := 0
+
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			orderA := versionCharOrder(a, i)
+			orderB := versionCharOrder(b, j)
+			if orderA != orderB {
+				return normalizeComparison(orderA - orderB)
+			}
+			i++
+			j++
+		}
+
+		// Leading zeros do not count
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+
+		// Longer number is the larger one
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return normalizeComparison(firstDiff)
+		}
+	}
+	return 0
+}
+
+func normalizeComparison(difference int) int {
+	if difference < 0 {
+		return -1
+	} else if difference > 0 {
+		return 1
+	}
+	return 0
+}
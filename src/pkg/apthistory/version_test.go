@@ -0,0 +1,46 @@
+// APTHistoryLogger/m/v2
+package apthistory
+
+import (
+	"testing"
+)
+
+func TestCompareDebianVersions(t *testing.T) {
+	tests := []struct {
+		name        string
+		a           string
+		b           string
+		want        int
+		expectError bool
+	}{
+		{name: "Equal", a: "1.2.3-1", b: "1.2.3-1", want: 0},
+		{name: "Leading zeros", a: "1.002-1", b: "1.2-1", want: 0},
+		{name: "Numeric not lexical", a: "1.10", b: "1.9", want: 1},
+		{name: "Epoch wins", a: "1:1.0", b: "2.0", want: 1},
+		{name: "Implicit zero epoch", a: "0:1.0", b: "1.0", want: 0},
+		{name: "Revision", a: "5.36.0-7+deb12u1", b: "5.36.0-7+deb12u2", want: -1},
+		{name: "Tilde sorts before end", a: "1.0~rc1", b: "1.0", want: -1},
+		{name: "Tilde security release", a: "3.0.11-1~deb12u2", b: "3.0.11-1", want: -1},
+		{name: "Tilde ordering", a: "3.0.11-1~deb12u2", b: "3.0.16-1~deb12u1", want: -1},
+		{name: "Double tilde", a: "1.0~~", b: "1.0~", want: -1},
+		{name: "Letters before symbols", a: "1.0a", b: "1.0+", want: -1},
+		{name: "Plus after end", a: "1.0+b1", b: "1.0", want: 1},
+		{name: "Hyphen in upstream", a: "2.1-20230119-1", b: "2.1-20230119-2", want: -1},
+		{name: "Missing revision", a: "1.0", b: "1.0-0", want: 0},
+		{name: "Bad epoch", a: "x:1.0", b: "1.0", expectError: true},
+		{name: "Empty", a: "", b: "1.0", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := CompareVersions(test.a, test.b)
+			if (err != nil) != test.expectError {
+				t.Errorf("CompareVersions() error = %v, expectError %v", err, test.expectError)
+				return
+			}
+			if got != test.want {
+				t.Errorf("CompareVersions(%s, %s) = %d, want %d", test.a, test.b, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"text/tabwriter"
+)
+
+// Package policy file (JSON)
+type Policy struct {
+	DeniedPackages   []string     `json:"denied_packages"`   // Regular expressions of package names that must never be installed
+	RequiredPackages []string     `json:"required_packages"` // Package names that must never be removed
+	VersionPins      []VersionPin `json:"version_pins"`
+}
+
+// Allowed versions of a package after installs and upgrades
+type VersionPin struct {
+	Package  string `json:"package"`
+	Operator string `json:"operator"` // =, !=, <, <=, >, >= (dpkg version ordering) [default: =]
+	Version  string `json:"version"`
+}
+
+// Exit code of --policy-check when violations were found (errors exit with 1)
+const policyViolationExitCode = 2
+
+// Operations that leave a package installed
+var installingOperations = []string{"install", "reinstall", "upgrade", "downgrade"}
+
+// Single policy rule broken by one package change
+type policyViolation struct {
+	Policy       string `json:"policy"` // denied_package, required_package or version_pin
+	Rule         string `json:"rule"`
+	Package      string `json:"package"`
+	Architecture string `json:"architecture"`
+	Operation    string `json:"operation"`
+	Version      string `json:"version,omitempty"`
+}
+
+// Violations of one event, written by the daemon after the event itself
+type policyViolationRecord struct {
+	RecordType     string            `json:"record_type"`
+	EventID        string            `json:"event_id"`
+	StartTimestamp string            `json:"start_timestamp"`
+	RequestedBy    string            `json:"requested_by,omitempty"`
+	CommandLine    string            `json:"command_line"`
+	Violations     []policyViolation `json:"violations"`
+}
+
+type packagePolicy struct {
+	denied   []*regexp.Regexp
+	required []string
+	pins     []VersionPin
+}
+
+// Loads the policy file
+// A missing file is only an error when required (user chosen path or policy check mode)
+func loadPolicy(policyPath string, required bool) (policy *packagePolicy, err error) {
+	var policyFile Policy
+	loaded, err := readJSONFile(policyPath, required, &policyFile)
+	if err != nil {
+		err = fmt.Errorf("invalid policy file %s: %v", policyPath, err)
+		return
+	}
+	if loaded {
+		printMessage(verbosityProgress, "Loaded package policy from %s\n", policyPath)
+	}
+
+	policy, err = newPackagePolicy(policyFile)
+	if err != nil {
+		err = fmt.Errorf("invalid policy file %s: %v", policyPath, err)
+		return
+	}
+	return
+}
+
+func newPackagePolicy(policyFile Policy) (policy *packagePolicy, err error) {
+	policy = &packagePolicy{required: policyFile.RequiredPackages}
+
+	for _, pattern := range policyFile.DeniedPackages {
+		var denied *regexp.Regexp
+		denied, err = regexp.Compile(pattern)
+		if err != nil {
+			err = fmt.Errorf("invalid denied package pattern '%s': %v", pattern, err)
+			return
+		}
+		policy.denied = append(policy.denied, denied)
+	}
+
+	for _, pin := range policyFile.VersionPins {
+		if pin.Operator == "" {
+			pin.Operator = "="
+		}
+		if !slices.Contains([]string{"=", "!=", "<", "<=", ">", ">="}, pin.Operator) {
+			err = fmt.Errorf("version pin for %s: unknown operator '%s'", pin.Package, pin.Operator)
+			return
+		}
+		if pin.Package == "" {
+			err = fmt.Errorf("version pin without a package")
+			return
+		}
+		_, err = apthistory.ParseVersion(pin.Version)
+		if err != nil {
+			err = fmt.Errorf("version pin for %s: %v", pin.Package, err)
+			return
+		}
+		policy.pins = append(policy.pins, pin)
+	}
+	return
+}
+
+// Reports if the policy has any rules to check
+func (policy *packagePolicy) empty() bool {
+	return len(policy.denied) == 0 && len(policy.required) == 0 && len(policy.pins) == 0
+}
+
+// Checks every package change of the event against the policy
+func (policy *packagePolicy) evaluate(log LogJSON) (violations []policyViolation, err error) {
+	for _, opList := range log.OperationLists() {
+		for _, pkg := range *opList.Packages {
+			violation := policyViolation{
+				Package:      pkg.Name,
+				Architecture: pkg.Arch,
+				Operation:    opList.Name,
+				Version:      pkg.Version,
+			}
+
+			if !slices.Contains(installingOperations, opList.Name) {
+				if slices.Contains(policy.required, pkg.Name) {
+					violation.Policy = "required_package"
+					violation.Rule = pkg.Name
+					violations = append(violations, violation)
+				}
+				continue
+			}
+
+			for _, denied := range policy.denied {
+				if denied.MatchString(pkg.Name) {
+					violation.Policy = "denied_package"
+					violation.Rule = denied.String()
+					violations = append(violations, violation)
+				}
+			}
+
+			for _, pin := range policy.pins {
+				if pin.Package != pkg.Name {
+					continue
+				}
+
+				var comparison int
+				comparison, err = apthistory.CompareVersions(pkg.Version, pin.Version)
+				if err != nil {
+					err = fmt.Errorf("package %s: %v", pkg.Name, err)
+					return
+				}
+				if !versionSatisfies(comparison, pin.Operator) {
+					violation.Policy = "version_pin"
+					violation.Rule = pin.Package + " " + pin.Operator + " " + pin.Version
+					violations = append(violations, violation)
+				}
+			}
+		}
+	}
+	return
+}
+
+func versionSatisfies(comparison int, operator string) bool {
+	switch operator {
+	case "=":
+		return comparison == 0
+	case "!=":
+		return comparison != 0
+	case "<":
+		return comparison < 0
+	case "<=":
+		return comparison <= 0
+	case ">":
+		return comparison > 0
+	case ">=":
+		return comparison >= 0
+	}
+	return false
+}
+
+var policyViolationRecordSchema = apthistory.RecordSchema{
+	RecordType:  "policy_violation",
+	Description: "Policy violations of one event, written by the daemon after the event itself",
+	Record:      policyViolationRecord{},
+	Descriptions: map[string]string{
+		"RecordType":                   "Kind of record",
+		"EventID":                      "Identifier of the event that broke the policy",
+		"Violations":                   "Policy rules broken by the event",
+		"policyViolation.Policy":       "Broken policy: denied_package, required_package or version_pin",
+		"policyViolation.Rule":         "Rule of the policy that was broken: package pattern, package name or version pin",
+		"policyViolation.Package":      "Package name",
+		"policyViolation.Operation":    "Operation on the package: install, reinstall, upgrade, downgrade, remove or purge",
+		"policyViolation.Version":      "Package version after the operation",
+		"policyViolation.Architecture": "Package architecture",
+	},
+}
+
+func newPolicyViolationRecord(log LogJSON, violations []policyViolation) (record policyViolationRecord) {
+	record = policyViolationRecord{
+		RecordType:     "policy_violation",
+		EventID:        log.EventID,
+		StartTimestamp: log.StartTimestamp,
+		RequestedBy:    log.RequestedBy,
+		CommandLine:    log.CommandLine,
+		Violations:     violations,
+	}
+	return
+}
+
+// Checks all events of the log file and its rotated archives against the policy
+// Exits with policyViolationExitCode when any event broke the policy
+func policyCheck(inputPath string, policyPath string, outputFormat string) {
+	if !slices.Contains([]string{"json", "ndjson", "table"}, outputFormat) {
+		logError("Invalid output format", fmt.Errorf("policy check format must be one of json, ndjson, table"))
+	}
+
+	policy, err := loadPolicy(policyPath, true)
+	logError("Failed to load policy", err)
+	if policy.empty() {
+		logError("Failed to load policy", fmt.Errorf("no rules in %s", policyPath))
+	}
+
+	// Include rotated archives of a single log file
+	searchPaths, err := collectLogArchivePaths(inputPath)
+	logError("Failed to read input file choice", err)
+
+	var records []policyViolationRecord
+	var eventCount int
+	for _, searchPath := range searchPaths {
+		printMessage(verbosityProgress, "Checking events from %s\n", searchPath)
+
+		err = readLogEvents(searchPath, func(log LogJSON) (keepReading bool, err error) {
+			keepReading = true
+			eventCount++
+
+			violations, err := policy.evaluate(log)
+			if err != nil {
+				err = fmt.Errorf("event %s: %v", log.EventID, err)
+				return
+			}
+			if len(violations) > 0 {
+				records = append(records, newPolicyViolationRecord(log, violations))
+			}
+			return
+		})
+		logError("Failed to check log file", err)
+	}
+
+	// Archives are read in name order, report in time order
+	slices.SortStableFunc(records, func(a, b policyViolationRecord) int {
+		return compareStartTimestamps(a.StartTimestamp, b.StartTimestamp)
+	})
+
+	err = writePolicyReport(records, outputFormat)
+	logError("Failed to write policy report", err)
+
+	printMessage(verbosityProgress, "Checked %d events, %d with policy violations\n", eventCount, len(records))
+	if len(records) > 0 {
+		os.Exit(policyViolationExitCode)
+	}
+}
+
+func writePolicyReport(records []policyViolationRecord, outputFormat string) (err error) {
+	switch outputFormat {
+	case "json":
+		var violationCount int
+		for _, record := range records {
+			violationCount += len(record.Violations)
+		}
+		report := struct {
+			TotalEvents     int                     `json:"total_events"`
+			TotalViolations int                     `json:"total_violations"`
+			Events          []policyViolationRecord `json:"events"`
+		}{len(records), violationCount, records}
+		if report.Events == nil {
+			report.Events = []policyViolationRecord{}
+		}
+
+		var reportJSON []byte
+		reportJSON, err = json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			err = fmt.Errorf("invalid JSON: %v", err)
+			return
+		}
+		fmt.Println(string(reportJSON))
+	case "ndjson":
+		for _, record := range records {
+			var recordJSON []byte
+			recordJSON, err = json.Marshal(record)
+			if err != nil {
+				err = fmt.Errorf("invalid JSON: %v", err)
+				return
+			}
+			fmt.Println(string(recordJSON))
+		}
+	case "table":
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "START\tEVENT\tUSER\tPOLICY\tOPERATION\tPACKAGE\tVERSION\tRULE")
+		for _, record := range records {
+			for _, violation := range record.Violations {
+				fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s:%s\t%s\t%s\n", record.StartTimestamp, record.EventID, emptyAsDash(record.RequestedBy),
+					violation.Policy, violation.Operation, violation.Package, violation.Architecture, emptyAsDash(violation.Version), violation.Rule)
+			}
+		}
+		err = table.Flush()
+	}
+	return
+}
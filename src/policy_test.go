@@ -0,0 +1,100 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy, err := newPackagePolicy(Policy{
+		DeniedPackages:   []string{"^telnetd$", "^netcat-traditional$"},
+		RequiredPackages: []string{"openssh-server"},
+		VersionPins: []VersionPin{
+			{Package: "openssl", Operator: ">=", Version: "3.0.11-1~deb12u2"},
+			{Package: "nginx", Version: "1.22.1-9"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newPackagePolicy() unexpected error = %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		log          LogJSON
+		wantPolicies []string
+	}{
+		{
+			name:         "Denied package installed",
+			log:          LogJSON{Install: []PackageInfo{{Name: "telnetd", Arch: "amd64", Version: "0.17+2.4-2"}, {Name: "telnet", Arch: "amd64", Version: "0.17+2.4-2"}}},
+			wantPolicies: []string{"denied_package"},
+		},
+		{
+			name: "Denied package removed",
+			log:  LogJSON{Purge: []PackageInfo{{Name: "netcat-traditional", Arch: "amd64", Version: "1.10-47"}}},
+		},
+		{
+			name:         "Required package removed",
+			log:          LogJSON{Remove: []PackageInfo{{Name: "openssh-server", Arch: "amd64", Version: "1:9.2p1-2+deb12u3"}}},
+			wantPolicies: []string{"required_package"},
+		},
+		{
+			name:         "Pinned package below minimum",
+			log:          LogJSON{Upgrade: []PackageInfo{{Name: "openssl", Arch: "amd64", OldVersion: "3.0.9-1", Version: "3.0.11-1~deb12u1"}}},
+			wantPolicies: []string{"version_pin"},
+		},
+		{
+			name:         "Pinned package downgraded below minimum",
+			log:          LogJSON{Downgrade: []PackageInfo{{Name: "openssl", Arch: "amd64", OldVersion: "3.0.11-1~deb12u2", Version: "3.0.9-1"}}},
+			wantPolicies: []string{"version_pin"},
+		},
+		{
+			name: "Pinned package at minimum",
+			log:  LogJSON{Upgrade: []PackageInfo{{Name: "openssl", Arch: "amd64", OldVersion: "3.0.9-1", Version: "3.0.11-1~deb12u2"}}},
+		},
+		{
+			name:         "Exact pin with epoch",
+			log:          LogJSON{Install: []PackageInfo{{Name: "nginx", Arch: "amd64", Version: "1:1.22.1-9"}}},
+			wantPolicies: []string{"version_pin"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			violations, err := policy.evaluate(test.log)
+			if err != nil {
+				t.Fatalf("evaluate() unexpected error = %v", err)
+			}
+
+			var policies []string
+			for _, violation := range violations {
+				policies = append(policies, violation.Policy)
+			}
+			if !slices.Equal(policies, test.wantPolicies) {
+				t.Errorf("evaluate() violations %v, want %v", policies, test.wantPolicies)
+			}
+		})
+	}
+}
+
+func TestCompareStartTimestamps(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want int
+	}{
+		{name: "Same offset", a: "2025-06-01T10:00:00+02:00", b: "2025-06-01T11:00:00+02:00", want: -1},
+		{name: "Offset change reorders", a: "2025-10-26T02:50:00+02:00", b: "2025-10-26T02:10:00+01:00", want: -1},
+		{name: "Same instant", a: "2025-06-01T10:00:00Z", b: "2025-06-01T12:00:00+02:00", want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := compareStartTimestamps(test.a, test.b)
+			if got != test.want {
+				t.Errorf("compareStartTimestamps(%s, %s) = %d, want %d", test.a, test.b, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"APTHistoryLogger/m/v2/pkg/apthistory"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Reads NDJSON output (daemon output, journal messages) and writes every event whole
+// Chunks are joined by their chunk metadata in any order, events missing chunks are written last and marked incomplete
+func reassembleEvents(inputPath string, schemaVersion int) {
+	logReader, err := openLogFile(inputPath)
+	logError("Failed to read input", err)
+	defer logReader.Close()
+
+	bufferedLog, err := apthistory.Decompress(logReader)
+	logError("Failed to read input", err)
+
+	writer := &ndjsonWriter{output: os.Stdout, schemaVersion: schemaVersion}
+	reassembler := newChunkReassembler()
+
+	var eventCount, incompleteCount int
+	writeEvents := func(events []LogJSON) {
+		for _, event := range events {
+			// Split events are written without the parsed command
+			fillCommandFields(&event)
+
+			if event.Incomplete {
+				incompleteCount++
+				printMessage(verbosityProgress, "Event %s is incomplete\n", event.EventID)
+			}
+
+			err := writer.write(event)
+			logError("Failed to write event", err)
+			eventCount++
+		}
+	}
+
+	var lineNumber int
+	for {
+		line, readErr := bufferedLog.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			logError("Failed to read input", readErr)
+		}
+		lineNumber++
+
+		// Skip blank lines and any non-JSON messages mixed into the output
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && line[0] == '{' {
+			record, err := apthistory.UnmarshalEvent(line)
+			if err != nil {
+				logError("Failed to parse JSON record", fmt.Errorf("line %d: %v", lineNumber, err))
+			}
+
+			// Records of other types, like parse errors, are not events
+			if record.StartTimestamp == "" {
+				printMessage(verbosityData, "Skipping JSON record without a start timestamp on line %d\n", lineNumber)
+			} else {
+				events, err := reassembler.add(record)
+				if err != nil {
+					logError("Failed to reassemble event", fmt.Errorf("line %d: %v", lineNumber, err))
+				}
+				writeEvents(events)
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	events, err := reassembler.flush()
+	logError("Failed to reassemble event", err)
+	writeEvents(events)
+
+	printMessage(verbosityProgress, "Reassembled %d events, %d incomplete\n", eventCount, incompleteCount)
+}
@@ -0,0 +1,232 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Packages that only take effect after a reboot (glob patterns)
+var rebootPackagePatterns = []string{"linux-image-*", "libc6", "systemd", "*-microcode"}
+
+const (
+	procDirectory              = "/proc"
+	dpkgInfoDirectory          = "/var/lib/dpkg/info"
+	rebootRequiredPackagesFile = "/var/run/reboot-required.pkgs" // Written by package hooks (update-notifier)
+)
+
+// Flags events that need a reboot or leave running processes on replaced files
+type restartDetector struct {
+	procDirectory              string
+	dpkgInfoDirectory          string
+	rebootRequiredPackagesFile string
+	warnedUnreadableMaps       bool // Missing privileges are only reported for the first event
+}
+
+// Returns nil when detection was not requested
+func newRestartDetector(enabled bool) (detector *restartDetector) {
+	if !enabled {
+		return
+	}
+	detector = &restartDetector{
+		procDirectory:              procDirectory,
+		dpkgInfoDirectory:          dpkgInfoDirectory,
+		rebootRequiredPackagesFile: rebootRequiredPackagesFile,
+	}
+	return
+}
+
+// Adds reboot and restart details to the event
+// Has to run right after the event is written to the log, processes started later use the new files
+func (detector *restartDetector) flag(log *LogJSON) (err error) {
+	if detector == nil {
+		return
+	}
+
+	log.RebootPackages, err = detector.rebootPackages(*log)
+	if err != nil {
+		return
+	}
+	log.RebootRequired = len(log.RebootPackages) > 0
+
+	log.RestartServices, log.RestartProcesses, err = detector.staleProcesses(*log)
+	return
+}
+
+// Packages of the event that need a reboot, by name pattern or listed in the reboot-required file
+func (detector *restartDetector) rebootPackages(log LogJSON) (packages []string, err error) {
+	var listed []string
+	listFile, err := os.ReadFile(detector.rebootRequiredPackagesFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		err = fmt.Errorf("failed to read %s: %v", detector.rebootRequiredPackagesFile, err)
+		return
+	}
+	err = nil
+	listed = strings.Fields(string(listFile))
+
+	for _, opList := range log.OperationLists() {
+		if !slices.Contains(installingOperations, opList.Name) {
+			continue
+		}
+		for _, pkg := range *opList.Packages {
+			if slices.Contains(packages, pkg.Name) {
+				continue
+			}
+			if slices.Contains(listed, pkg.Name) || matchesAnyPattern(pkg.Name, rebootPackagePatterns) {
+				packages = append(packages, pkg.Name)
+			}
+		}
+	}
+	return
+}
+
+func matchesAnyPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		matched, _ := path.Match(pattern, name)
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds processes that still map deleted files which belong to packages replaced by the event
+// Processes in a systemd service are reported by unit name, all others as name[pid]
+func (detector *restartDetector) staleProcesses(log LogJSON) (services []string, processes []string, err error) {
+	replacedFiles, err := detector.packageFiles(log)
+	if err != nil || len(replacedFiles) == 0 {
+		return
+	}
+
+	procEntries, err := os.ReadDir(detector.procDirectory)
+	if err != nil {
+		err = fmt.Errorf("failed to list processes: %v", err)
+		return
+	}
+
+	for _, procEntry := range procEntries {
+		pid, convErr := strconv.Atoi(procEntry.Name())
+		if convErr != nil {
+			continue
+		}
+		processDirectory := filepath.Join(detector.procDirectory, procEntry.Name())
+
+		// Processes can exit or be unreadable (kernel threads, missing privileges) at any point, those are skipped
+		stale, readErr := mapsReplacedFile(filepath.Join(processDirectory, "maps"), replacedFiles)
+		if errors.Is(readErr, fs.ErrPermission) && !detector.warnedUnreadableMaps {
+			printMessage(verbosityStandard, "Warning: cannot read memory maps of processes of other users (%v), their services are not checked for restarts (needs root or CAP_SYS_PTRACE)\n", readErr)
+			detector.warnedUnreadableMaps = true
+		}
+		if readErr != nil || !stale {
+			continue
+		}
+
+		unit := serviceUnit(processDirectory)
+		if unit != "" {
+			if !slices.Contains(services, unit) {
+				services = append(services, unit)
+			}
+			continue
+		}
+
+		name, _ := os.ReadFile(filepath.Join(processDirectory, "comm"))
+		processes = append(processes, fmt.Sprintf("%s[%d]", strings.TrimSpace(string(name)), pid))
+	}
+
+	slices.Sort(services)
+	return
+}
+
+// Files installed by the upgraded, downgraded and reinstalled packages of the event, from the dpkg file lists
+func (detector *restartDetector) packageFiles(log LogJSON) (files map[string]bool, err error) {
+	files = make(map[string]bool)
+	for _, pkg := range slices.Concat(log.Upgrade, log.Downgrade, log.Reinstall) {
+		// Multi-arch packages have the architecture in the list name
+		for _, listName := range []string{pkg.Name + ":" + pkg.Arch + ".list", pkg.Name + ".list"} {
+			var listFile []byte
+			listFile, err = os.ReadFile(filepath.Join(detector.dpkgInfoDirectory, listName))
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+				continue
+			} else if err != nil {
+				err = fmt.Errorf("failed to read file list of %s: %v", pkg.Name, err)
+				return
+			}
+
+			for _, file := range strings.Split(string(listFile), "\n") {
+				if file != "" {
+					files[mergedUsrPath(file)] = true
+				}
+			}
+			break
+		}
+	}
+	return
+}
+
+// Reports if the process memory map has a deleted file that is in replacedFiles
+func mapsReplacedFile(mapsPath string, replacedFiles map[string]bool) (stale bool, err error) {
+	mapsFile, err := os.Open(mapsPath)
+	if err != nil {
+		return
+	}
+	defer mapsFile.Close()
+
+	// Lines are "address perms offset dev inode path", replaced files end in " (deleted)"
+	scanner := bufio.NewScanner(mapsFile)
+	for scanner.Scan() {
+		line := scanner.Text()
+		mappedFile, deleted := strings.CutSuffix(line, " (deleted)")
+		if !deleted {
+			continue
+		}
+		pathStart := strings.IndexByte(mappedFile, '/')
+		if pathStart < 0 {
+			continue
+		}
+
+		if replacedFiles[mergedUsrPath(mappedFile[pathStart:])] {
+			stale = true
+			return
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// Name of the systemd service the process runs in, empty for processes outside of services
+func serviceUnit(processDirectory string) (unit string) {
+	cgroupFile, err := os.ReadFile(filepath.Join(processDirectory, "cgroup"))
+	if err != nil {
+		return
+	}
+
+	// Lines are "id:controllers:path", the innermost service in the path wins
+	for _, line := range strings.Split(string(cgroupFile), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		cgroupPath := strings.Split(fields[2], "/")
+		for index := len(cgroupPath) - 1; index >= 0; index-- {
+			if strings.HasSuffix(cgroupPath[index], ".service") {
+				unit = cgroupPath[index]
+				return
+			}
+		}
+	}
+	return
+}
+
+// Package file lists can use /lib while processes map /usr/lib (or the reverse), compare without the /usr prefix
+func mergedUsrPath(file string) string {
+	return strings.TrimPrefix(file, "/usr")
+}
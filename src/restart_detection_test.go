@@ -0,0 +1,95 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRestartDetectorFlag(t *testing.T) {
+	root := t.TempDir()
+	detector := &restartDetector{
+		procDirectory:              filepath.Join(root, "proc"),
+		dpkgInfoDirectory:          filepath.Join(root, "info"),
+		rebootRequiredPackagesFile: filepath.Join(root, "reboot-required.pkgs"),
+	}
+
+	files := map[string]string{
+		"reboot-required.pkgs":    "dbus\n",
+		"info/libssl3:amd64.list": "/.\n/usr\n/usr/lib/x86_64-linux-gnu/libssl.so.3\n",
+		"info/curl.list":          "/usr/bin/curl\n",
+		// Service still using the replaced library, through the /lib path
+		"proc/812/maps":   "7f2c1a000000-7f2c1a0a0000 r-xp 00000000 08:01 1234 /lib/x86_64-linux-gnu/libssl.so.3 (deleted)\n",
+		"proc/812/cgroup": "0::/system.slice/ssh.service\n",
+		"proc/812/comm":   "sshd\n",
+		// Process outside of services using the replaced library
+		"proc/2045/maps":   "00400000-00452000 r-xp 00000000 08:01 99 /usr/bin/bash\n7f2c1a000000-7f2c1a0a0000 r-xp 00000000 08:01 1234 /usr/lib/x86_64-linux-gnu/libssl.so.3 (deleted)\n",
+		"proc/2045/cgroup": "0::/user.slice/user-1000.slice/session-3.scope\n",
+		"proc/2045/comm":   "python3\n",
+		// Deleted file from a package not in the event
+		"proc/900/maps":   "7f2c1a000000-7f2c1a0a0000 r-xp 00000000 08:01 55 /usr/lib/x86_64-linux-gnu/libz.so.1 (deleted)\n",
+		"proc/900/cgroup": "0::/system.slice/cron.service\n",
+		"proc/900/comm":   "cron\n",
+	}
+	for name, content := range files {
+		filePath := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filePath, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		log           LogJSON
+		wantReboot    []string
+		wantServices  []string
+		wantProcesses []string
+	}{
+		{
+			name: "Kernel and listed package",
+			log: LogJSON{
+				Install: []PackageInfo{{Name: "linux-image-6.1.0-40-amd64", Arch: "amd64", Version: "6.1.153-1"}},
+				Upgrade: []PackageInfo{{Name: "dbus", Arch: "amd64", OldVersion: "1.14.10-1", Version: "1.14.10-2"}, {Name: "intel-microcode", Arch: "amd64", OldVersion: "3.20250211.1", Version: "3.20250512.1"}},
+			},
+			wantReboot: []string{"linux-image-6.1.0-40-amd64", "dbus", "intel-microcode"},
+		},
+		{
+			name:       "Removed kernel",
+			log:        LogJSON{Remove: []PackageInfo{{Name: "linux-image-6.1.0-38-amd64", Arch: "amd64", Version: "6.1.147-1"}}},
+			wantReboot: nil,
+		},
+		{
+			name: "Library upgrade with running users",
+			log: LogJSON{
+				Upgrade: []PackageInfo{{Name: "libssl3", Arch: "amd64", OldVersion: "3.0.16-1", Version: "3.0.17-1"}, {Name: "curl", Arch: "amd64", OldVersion: "7.88.1-10", Version: "7.88.1-11"}},
+			},
+			wantServices:  []string{"ssh.service"},
+			wantProcesses: []string{"python3[2045]"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := detector.flag(&test.log)
+			if err != nil {
+				t.Fatalf("flag() error = %v", err)
+			}
+			if !slices.Equal(test.log.RebootPackages, test.wantReboot) || test.log.RebootRequired != (len(test.wantReboot) > 0) {
+				t.Errorf("reboot = %v %v, want %v", test.log.RebootRequired, test.log.RebootPackages, test.wantReboot)
+			}
+			if !slices.Equal(test.log.RestartServices, test.wantServices) {
+				t.Errorf("RestartServices = %v, want %v", test.log.RestartServices, test.wantServices)
+			}
+			if !slices.Equal(test.log.RestartProcesses, test.wantProcesses) {
+				t.Errorf("RestartProcesses = %v, want %v", test.log.RestartProcesses, test.wantProcesses)
+			}
+		})
+	}
+}
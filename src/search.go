@@ -2,59 +2,424 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Single match from a file stream, or the error that ended the stream
+type searchResult struct {
+	log   LogJSON
+	start time.Time
+	err   error
+}
+
+// Log file scheduled for searching
+type searchFile struct {
+	path         string
+	firstEvent   time.Time         // Lower bound of all event times in file
+	lastModified time.Time         // Upper bound of all event times in file
+	stream       chan searchResult // Matches in search order, closed once file is fully searched
+	started      chan struct{}     // Closed once a worker picked up the file
+}
+
+// Matches a file can send ahead of the merge
+const searchStreamBuffer = 64
+
 func search(inputPath string, userSearchOpts SearchOptions) {
 	searchParams, err := userSearchOpts.parseSearchOptions()
 	logError("Invalid search parameter", err)
 
+	writer, err := newResultWriter(userSearchOpts.outputFormat, os.Stdout, userSearchOpts.schemaVersion, userSearchOpts.chunkSize)
+	logError("Invalid output format", err)
+	if userSearchOpts.perPackage {
+		writer = &perPackageWriter{writer: writer}
+	}
+
+	// Window checks need the configuration file
+	config, err := loadConfig(userSearchOpts.configPath, userSearchOpts.outOfWindow || userSearchOpts.configPath != defaultConfigPath)
+	logError("Failed to load configuration", err)
+
+	// Log files are parsed with the origin patterns as they are now defined
+	err = configureHistoryParser(config.OriginPatterns, userSearchOpts.recordSource, userSearchOpts.keepRaw)
+	logError("Invalid origin pattern configuration", err)
+
+	// Historical events are checked against the windows as they are now defined
+	var windows maintenanceWindows
+	if userSearchOpts.outOfWindow {
+		windows, err = newMaintenanceWindows(config.MaintenanceWindows)
+		logError("Invalid maintenance window configuration", err)
+		if len(windows) == 0 {
+			logError("Invalid search parameter", fmt.Errorf("no maintenance windows defined in %s", userSearchOpts.configPath))
+		}
+	}
+
+	var resultCount int
+	var skipped int
+	emitResult := func(result LogJSON) bool {
+		err := windows.flag(&result)
+		if err != nil {
+			printMessage(verbosityNone, "Failed to check maintenance windows for event %s: %v\n", result.EventID, err)
+			return true
+		}
+		if userSearchOpts.outOfWindow && !result.OutOfWindow {
+			return true
+		}
+
+		if skipped < userSearchOpts.offset {
+			skipped++
+			return true
+		}
+
+		err = writer.write(result)
+		logError("Failed to write search result", err)
+		resultCount++
+
+		// Continue until limit reached
+		return userSearchOpts.limit == 0 || resultCount < userSearchOpts.limit
+	}
+
+	if userSearchOpts.useIndex {
+		var index *eventIndex
+		index, err = loadEventIndex(eventIndexDirectory)
+		logError("Failed to load event index", err)
+
+		err = index.search(searchParams, userSearchOpts.outputOrder, emitResult)
+		logError("Failed to search event index", err)
+	} else {
+		var searchPaths []string
+		var inputIsDir bool
+		searchPaths, inputIsDir, err = collectSearchPaths(inputPath)
+		logError("Failed to read input file choice", err)
+
+		var searchFiles []*searchFile
+		searchFiles, err = planSearchFiles(searchPaths, inputIsDir, searchParams)
+		logError("Failed to prepare log files for search", err)
+
+		// Closed once output has everything it needs, stops all file workers
+		searchDone := make(chan struct{})
+		defer close(searchDone)
+
+		go searchFilesParallel(searchFiles, userSearchOpts.outputOrder, searchParams, userSearchOpts.jobs, searchDone)
+
+		err = mergeSearchFiles(searchFiles, userSearchOpts.outputOrder, emitResult)
+		logError("Failed to search log", err)
+	}
+
+	err = writer.finish()
+	logError("Failed to write search results", err)
+
+	printMessage(verbosityProgress, "Search returned %d results\n", resultCount)
+}
+
+// Expands the input path into the list of files to read
+// Input can be a single file, a directory (all files inside), a glob, or '-' for stdin
+func collectSearchPaths(inputPath string) (searchPaths []string, inputIsDir bool, err error) {
 	// Error is irrelevant, actual file access errors are addressed in log search function
 	logMeta, _ := os.Stat(inputPath)
 
-	var searchFiles []string
-	if logMeta == nil {
-		searchFiles, err = filepath.Glob(inputPath)
-		logError("Failed to read input file choice", err)
+	if inputPath == "-" {
+		searchPaths = append(searchPaths, inputPath)
+	} else if logMeta == nil {
+		searchPaths, err = filepath.Glob(inputPath)
+		if err != nil {
+			return
+		}
 	} else if logMeta.Mode().IsRegular() {
-		searchFiles = append(searchFiles, inputPath)
+		searchPaths = append(searchPaths, inputPath)
 	} else if logMeta.Mode().IsDir() {
+		inputIsDir = true
+
 		var logFiles []os.DirEntry
-		logFiles, err := os.ReadDir(inputPath)
-		logError("Failed to read directory contents", err)
+		logFiles, err = os.ReadDir(inputPath)
+		if err != nil {
+			err = fmt.Errorf("failed to read directory contents: %v", err)
+			return
+		}
 
 		for _, logFile := range logFiles {
 			if !logFile.IsDir() {
 				absLogFile := filepath.Join(inputPath, logFile.Name())
-				searchFiles = append(searchFiles, absLogFile)
+				searchPaths = append(searchPaths, absLogFile)
 			}
 		}
 	}
+	return
+}
+
+// Expands the input path like collectSearchPaths, a single log file also includes its rotated archives
+func collectLogArchivePaths(inputPath string) (searchPaths []string, err error) {
+	logMeta, err := os.Stat(inputPath)
+	if err == nil && logMeta.Mode().IsRegular() {
+		inputPath += "*"
+	}
+	searchPaths, _, err = collectSearchPaths(inputPath)
+	return
+}
 
-	var rawSearchResults []LogJSON
+// Determines the time range of each file and drops files that cannot contain events in the search window
+// Returned files are ordered by their first event
+func planSearchFiles(searchPaths []string, inputIsDir bool, searchParams SearchParameters) (searchFiles []*searchFile, err error) {
+	for _, searchPath := range searchPaths {
+		// Stdin can only be read once, so its time range is unknown
+		if searchPath == "-" {
+			searchFiles = append(searchFiles, &searchFile{
+				path:         searchPath,
+				lastModified: time.Now(),
+				stream:       make(chan searchResult, searchStreamBuffer),
+				started:      make(chan struct{}),
+			})
+			continue
+		}
 
-	for _, searchFile := range searchFiles {
-		matchedEntries, err := logReaderSearch(searchFile, searchParams)
-		logError("Failed to search log", err)
+		var fileMeta os.FileInfo
+		fileMeta, err = os.Stat(searchPath)
+		if err != nil {
+			err = fmt.Errorf("failed to stat log file: %v", err)
+			return
+		}
 
-		rawSearchResults = append(rawSearchResults, matchedEntries...)
+		// Files in the APT log directory are only ever appended to, so nothing inside can be newer than the last write
+		if inputIsDir && fileMeta.ModTime().Before(searchParams.startTimestamp) {
+			printMessage(verbosityData, "Skipping %s: last modified before search start time\n", searchPath)
+			continue
+		}
+
+		var firstEvent time.Time
+		var hasEvents bool
+		firstEvent, hasEvents, err = logFirstEventTime(searchPath)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", searchPath, err)
+			return
+		}
+		if !hasEvents {
+			printMessage(verbosityData, "Skipping %s: no events in file\n", searchPath)
+			continue
+		}
+		if firstEvent.After(searchParams.endTimestamp) {
+			printMessage(verbosityData, "Skipping %s: first event is after search end time\n", searchPath)
+			continue
+		}
+
+		newFile := &searchFile{
+			path:         searchPath,
+			firstEvent:   firstEvent,
+			lastModified: fileMeta.ModTime(),
+			stream:       make(chan searchResult, searchStreamBuffer),
+			started:      make(chan struct{}),
+		}
+		searchFiles = append(searchFiles, newFile)
 	}
 
-	if len(rawSearchResults) == 0 {
-		printMessage(verbosityStandard, "Search returned no results\n")
+	slices.SortStableFunc(searchFiles, func(a, b *searchFile) int {
+		comparison := a.firstEvent.Compare(b.firstEvent)
+		if comparison == 0 {
+			comparison = strings.Compare(a.path, b.path)
+		}
+		return comparison
+	})
+	return
+}
+
+// Searches files using a bounded pool of workers
+// Files are handed out in the order the merge will need them (oldest first for ascending, newest first for descending)
+func searchFilesParallel(searchFiles []*searchFile, order string, searchParams SearchParameters, jobs int, searchDone <-chan struct{}) {
+	queue := make(chan *searchFile)
+
+	var workers sync.WaitGroup
+	for range jobs {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for file := range queue {
+				file.search(searchParams, order, searchDone)
+			}
+		}()
+	}
+
+	for index := range searchFiles {
+		if order == "desc" {
+			index = len(searchFiles) - 1 - index
+		}
+
+		select {
+		case queue <- searchFiles[index]:
+		case <-searchDone:
+			// Remaining files are no longer needed
+			close(queue)
+			workers.Wait()
+			return
+		}
+	}
+	close(queue)
+	workers.Wait()
+}
+
+// Sends matches from a single file in the requested time order, closing its stream once finished
+// Clock changes and concatenated archives can leave a file's events out of time order,
+// so the matches of the file are held and sorted before sending in either direction
+func (file *searchFile) search(searchParams SearchParameters, order string, searchDone <-chan struct{}) {
+	close(file.started)
+	defer close(file.stream)
+
+	printMessage(verbosityProgress, "Searching file %s\n", file.path)
+
+	send := func(result searchResult) bool {
+		select {
+		case file.stream <- result:
+			return true
+		case <-searchDone:
+			return false
+		}
+	}
+
+	var heldResults []searchResult
+	err := logReaderSearch(file.path, searchParams, func(match LogJSON) bool {
+		result := searchResult{log: match}
+		result.start, _ = time.Parse(time.RFC3339, match.StartTimestamp)
+		heldResults = append(heldResults, result)
+
+		select {
+		case <-searchDone:
+			return false
+		default:
+			return true
+		}
+	})
+	if err != nil {
+		send(searchResult{err: fmt.Errorf("%s: %v", file.path, err)})
 		return
 	}
 
-	sortedSearchResults := sortLogsByTimestamp(rawSearchResults, userSearchOpts.outputOrder)
+	slices.SortStableFunc(heldResults, func(a, b searchResult) int {
+		return a.start.Compare(b.start)
+	})
+	if order == "desc" {
+		slices.Reverse(heldResults)
+	}
+	for _, result := range heldResults {
+		if !send(result) {
+			return
+		}
+	}
+}
+
+// Merges the ordered streams of all files, passing each result to emit in overall time order
+// A result is only emitted once no open stream could still send an earlier (or later for descending) event,
+// so output is identical regardless of which worker runs first. Ties are broken by file order.
+func mergeSearchFiles(searchFiles []*searchFile, order string, emit func(LogJSON) bool) (err error) {
+	descending := order == "desc"
 
-	var outputJSON SearchOutput
-	outputJSON.TotalResults = len(sortedSearchResults)
-	outputJSON.Results = sortedSearchResults
+	// Received results not yet emitted, these only pile up while files overlap in time
+	queues := make([][]searchResult, len(searchFiles))
+	closed := make([]bool, len(searchFiles))
 
-	searchResults, err := json.MarshalIndent(outputJSON, "", "  ")
-	logError("Invalid JSON", err)
+	// Bound on the next result of each stream, tightened by every received result
+	bounds := make([]time.Time, len(searchFiles))
+	for index, file := range searchFiles {
+		bounds[index] = file.firstEvent
+		if descending {
+			bounds[index] = file.lastModified
+		}
+	}
 
-	printMessage(verbosityStandard, "%s\n", string(searchResults))
+	for {
+		// Best received result
+		next := -1
+		for index, queue := range queues {
+			if len(queue) == 0 {
+				continue
+			}
+			if next == -1 {
+				next = index
+				continue
+			}
+
+			comparison := queue[0].start.Compare(queues[next][0].start)
+			if (descending && comparison > 0) || (!descending && comparison < 0) {
+				next = index
+			}
+		}
+
+		// Open streams with nothing received could still send a better result
+		canEmit := next != -1
+		var neededFiles []int
+		for index := range searchFiles {
+			if closed[index] || len(queues[index]) > 0 {
+				continue
+			}
+			if next != -1 {
+				candidate := queues[next][0].start
+				if descending && (candidate.After(bounds[index]) || (candidate.Equal(bounds[index]) && next < index)) {
+					continue
+				}
+				if !descending && (candidate.Before(bounds[index]) || (candidate.Equal(bounds[index]) && next < index)) {
+					continue
+				}
+			}
+			canEmit = false
+			neededFiles = append(neededFiles, index)
+		}
+
+		if canEmit {
+			if !emit(queues[next][0].log) {
+				return
+			}
+			queues[next] = queues[next][1:]
+			continue
+		}
+
+		// All streams finished and emitted
+		if len(neededFiles) == 0 {
+			return
+		}
+
+		// A needed file without a worker only starts once workers held by full streams are freed, so every open stream is read until then
+		waitFiles := neededFiles
+		for _, index := range neededFiles {
+			if !searchFiles[index].isStarted() {
+				waitFiles = nil
+				for openIndex := range searchFiles {
+					if !closed[openIndex] {
+						waitFiles = append(waitFiles, openIndex)
+					}
+				}
+				break
+			}
+		}
+
+		var waitCases []reflect.SelectCase
+		for _, index := range waitFiles {
+			waitCases = append(waitCases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(searchFiles[index].stream)})
+		}
+		chosen, value, open := reflect.Select(waitCases)
+		index := waitFiles[chosen]
+		if !open {
+			closed[index] = true
+			continue
+		}
+
+		result := value.Interface().(searchResult)
+		if result.err != nil {
+			err = result.err
+			return
+		}
+		queues[index] = append(queues[index], result)
+		bounds[index] = result.start
+	}
+}
+
+// Reports if a worker picked up the file
+func (file *searchFile) isStarted() bool {
+	select {
+	case <-file.started:
+		return true
+	default:
+		return false
+	}
 }
@@ -0,0 +1,99 @@
+// APTHistoryLogger/m/v2
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeSearchFiles(t *testing.T) {
+	// Files overlap in time and hold more matches than a stream buffers
+	directory := t.TempDir()
+	var paths []string
+	for fileIndex := range 2 {
+		var history strings.Builder
+		for eventIndex := range 3 * searchStreamBuffer {
+			minute := eventIndex*2 + fileIndex
+			// Second file has two events out of order, like after a clock change
+			if fileIndex == 1 && (eventIndex == 10 || eventIndex == 11) {
+				minute = (21-eventIndex)*2 + fileIndex
+			}
+			fmt.Fprintf(&history, "Start-Date: 2025-06-01  %02d:%02d:00\nCommandline: apt install pkg-%d\nInstall: pkg-%d:amd64 (1.0)\nEnd-Date: 2025-06-01  %02d:%02d:30\n\n",
+				minute/60, minute%60, minute, minute, minute/60, minute%60)
+		}
+		path := filepath.Join(directory, fmt.Sprintf("history.log.%d", fileIndex))
+		err := os.WriteFile(path, []byte(history.String()), 0644)
+		if err != nil {
+			t.Fatalf("failed to write test log: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	totalEvents := 2 * 3 * searchStreamBuffer
+
+	searchParams, err := SearchOptions{outputOrder: "asc", outputFormat: "json", jobs: 1, startTimestamp: "2025-01-01", endTimestamp: "2026-01-01"}.parseSearchOptions()
+	if err != nil {
+		t.Fatalf("parseSearchOptions() unexpected error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		order string
+		jobs  int
+		limit int
+	}{
+		{name: "Ascending single worker", order: "asc", jobs: 1},
+		{name: "Descending single worker", order: "desc", jobs: 1},
+		{name: "Ascending parallel", order: "asc", jobs: 2},
+		{name: "Limit stops early", order: "asc", jobs: 1, limit: 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			searchFiles, err := planSearchFiles(paths, false, searchParams)
+			if err != nil {
+				t.Fatalf("planSearchFiles() unexpected error = %v", err)
+			}
+
+			searchDone := make(chan struct{})
+			defer close(searchDone)
+			go searchFilesParallel(searchFiles, test.order, searchParams, test.jobs, searchDone)
+
+			var starts []string
+			merged := make(chan error)
+			go func() {
+				merged <- mergeSearchFiles(searchFiles, test.order, func(log LogJSON) bool {
+					starts = append(starts, log.StartTimestamp)
+					return test.limit == 0 || len(starts) < test.limit
+				})
+			}()
+
+			select {
+			case err = <-merged:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("mergeSearchFiles() did not finish")
+			}
+			if err != nil {
+				t.Fatalf("mergeSearchFiles() unexpected error = %v", err)
+			}
+
+			wantCount := totalEvents
+			if test.limit > 0 {
+				wantCount = test.limit
+			}
+			if len(starts) != wantCount {
+				t.Fatalf("merged %d results, want %d", len(starts), wantCount)
+			}
+			for index := 1; index < len(starts); index++ {
+				previous, _ := time.Parse(time.RFC3339, starts[index-1])
+				current, _ := time.Parse(time.RFC3339, starts[index])
+				if (test.order == "desc" && !current.Before(previous)) || (test.order != "desc" && !current.After(previous)) {
+					t.Fatalf("result %d (%s) out of %s order after %s", index, starts[index], test.order, starts[index-1])
+				}
+			}
+		})
+	}
+}
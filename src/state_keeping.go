@@ -110,17 +110,25 @@ func savePosition(inode uint64, position int64) (err error) {
 		return
 	}
 
-	stateFile, err := os.OpenFile(logStateFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	// Written aside and renamed over the state file, so exiting mid-write never leaves it truncated
+	stateFile, err := os.CreateTemp(stateDirectory, "log.state.*")
 	if err != nil {
 		err = fmt.Errorf("failed to open state file: %v", err)
 		return
 	}
-	defer stateFile.Close()
+	defer os.Remove(stateFile.Name())
 
 	_, err = fmt.Fprintf(stateFile, "%d %d", inode, position)
+	stateFile.Close()
 	if err != nil {
 		err = fmt.Errorf("failed to write current log position to state file: %v", err)
 		return
 	}
+
+	err = os.Rename(stateFile.Name(), logStateFilePath)
+	if err != nil {
+		err = fmt.Errorf("failed to replace state file: %v", err)
+		return
+	}
 	return
 }